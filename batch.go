@@ -0,0 +1,214 @@
+package scp
+
+import (
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+
+	"fknsrs.biz/p/scp/protocol"
+)
+
+// FileError is the failure to send a single file (or directory) in a batch
+// written with WithContinueOnError, which was skipped so the rest could be
+// sent.
+type FileError struct {
+	// Path is where the file would have been written, relative to the
+	// target directory.
+	Path string
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	return e.Path + ": " + e.Err.Error()
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+// BatchError is returned by WriteDir, and by Writer.Close, when writing with
+// WithContinueOnError and some of the files couldn't be sent.
+type BatchError struct {
+	// Sent holds the paths of the files that were sent, relative to the
+	// target directory, in the order they were sent.
+	Sent []string
+	// Failed holds an error for each file or directory that wasn't.
+	Failed []*FileError
+}
+
+func (e *BatchError) Error() string {
+	if len(e.Failed) == 1 {
+		return fmt.Sprintf("couldn't send 1 of %d files: %v", len(e.Sent)+1, e.Failed[0])
+	}
+
+	return fmt.Sprintf("couldn't send %d of %d files, starting with %v", len(e.Failed), len(e.Sent)+len(e.Failed), e.Failed[0])
+}
+
+// Manifest lists the files sent by WriteDir or a Writer when writing with
+// WithManifest, e.g. to keep as a record of a deployment. It's only updated by
+// one transfer at a time, except by WriteMany, which keeps one for each host
+// and merges them in as they finish.
+type Manifest struct {
+	Files []ManifestEntry
+}
+
+// ManifestEntry describes a file that was sent.
+type ManifestEntry struct {
+	// Host is the address of the host the file was sent to, in a manifest
+	// kept by WriteMany. Otherwise it's empty.
+	Host string
+	// Path is where the file was written, relative to the target
+	// directory.
+	Path string
+	Size int64
+	// Mode is the mode it was sent with, which is WithMode's if it was
+	// given.
+	Mode os.FileMode
+	// Digest is the digest of the content sent, when writing with
+	// WithChecksum. A Writer has also checked that the remote copy has the
+	// same one; WriteDir hasn't.
+	Digest []byte
+}
+
+// refused reports whether err is the remote scp turning down a file or
+// directory before any of its content was sent, which leaves it ready for the
+// next one.
+func refused(err error) bool {
+	pe, ok := err.(*ProtocolError)
+	return ok && pe.Severity == SeverityWarning
+}
+
+// remote returns the path of something called name in the directory being
+// sent, relative to the target directory.
+func (k *sender) remote(name string) string {
+	p := ""
+	for _, d := range k.dirs {
+		p = path.Join(p, d.Name())
+	}
+
+	return path.Join(p, name)
+}
+
+// skip records err with the thing at the remote path p and returns nil, so
+// that the rest of the batch is sent, if writing with WithContinueOnError to a
+// remote scp. Otherwise it returns err, which ends the transfer.
+func (k *sender) skip(p string, err error) error {
+	if !k.o.continueOnError || k.s == nil {
+		return err
+	}
+
+	k.failed = append(k.failed, &FileError{Path: p, Err: err})
+
+	return nil
+}
+
+// batchFile sends file as part of a batch, recording it as sent or, if the
+// remote scp refused it, as failed.
+func (k *sender) batchFile(file *File) error {
+	if k.o.gzip {
+		gz, err := NewGzipFile(file.Name()+".gz", file.Mode(), file)
+		if err != nil {
+			return k.skip(k.remote(file.Name()+".gz"), err)
+		}
+		defer gz.Close()
+
+		gz.mtime, gz.atime = file.mtime, file.atime
+		file = gz
+	}
+
+	p := k.remote(file.Name())
+	if err := protocol.CheckName(file.Name()); err != nil {
+		return k.skip(p, err)
+	}
+
+	if k.listed(p, file.Size()) {
+		return nil
+	}
+
+	// Nothing checks the remote copy here, but a manifest still gets the
+	// digest of what was sent.
+	var h hash.Hash
+	if k.o.manifest != nil && k.o.checksumHash != nil {
+		h = k.o.checksumHash()
+
+		tee := *file
+		tee.Reader = io.TeeReader(file, h)
+		file = &tee
+	}
+
+	if err := k.file(file); err != nil {
+		if refused(err) {
+			return k.skip(p, err)
+		}
+
+		return err
+	}
+
+	var sum []byte
+	if h != nil {
+		sum = h.Sum(nil)
+	}
+
+	k.done(p, file, sum)
+
+	return nil
+}
+
+// done records file, with its digest if there is one, as sent to the remote
+// path p, for WithContinueOnError and WithManifest.
+func (k *sender) done(p string, file *File, sum []byte) {
+	mode := file.Mode()
+	if k.o.forceMode {
+		mode = k.o.mode
+	}
+
+	record := func() {
+		if k.o.continueOnError {
+			k.sent = append(k.sent, p)
+		}
+
+		if k.o.manifest != nil {
+			k.o.manifest.Files = append(k.o.manifest.Files, ManifestEntry{Path: p, Size: file.Size(), Mode: mode, Digest: sum})
+		}
+	}
+
+	// With WithPipelining, the file isn't done with until the response to
+	// its content has arrived.
+	if k.pending != "" {
+		k.settled = record
+		return
+	}
+
+	record()
+}
+
+// listed reports whether a file of the given size at the remote path p is in
+// the manifest given to WithResumeFrom, and so has already been sent.
+func (k *sender) listed(p string, size int64) bool {
+	if !k.o.resumeFrom {
+		return false
+	}
+
+	if k.listedSizes == nil {
+		k.listedSizes = map[string]int64{}
+		for _, e := range k.o.manifest.Files {
+			k.listedSizes[e.Path] = e.Size
+		}
+	}
+
+	s, ok := k.listedSizes[p]
+
+	return ok && s == size
+}
+
+// batchErr returns a *BatchError for the files that failed, if there were
+// any.
+func (k *sender) batchErr() error {
+	if len(k.failed) == 0 {
+		return nil
+	}
+
+	return &BatchError{Sent: k.sent, Failed: k.failed}
+}
@@ -0,0 +1,367 @@
+package scp
+
+import (
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// refusingSink returns a client whose remote side is a Sink writing into dir
+// that turns down any file called "b" with a warning, as OpenSSH's scp does
+// with a file it can't create.
+func refusingSink(t testing.TB, dir string) *ssh.Client {
+	t.Helper()
+
+	return newFakeClient(t, func(cmd string, ch ssh.Channel) int {
+		s, err := NewSink(dir, WithFileHook(func(f *File, target string) (string, error) {
+			if f.Name() == "b" {
+				return "", errors.New(f.Path() + ": Permission denied")
+			}
+
+			return target, nil
+		}))
+		if err != nil {
+			return 1
+		}
+
+		if _, err := s.Serve(ch); err != nil {
+			return 1
+		}
+
+		return 0
+	})
+}
+
+func TestWriteDirContinueOnError(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "batch")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeLocal(t, root, "a", "aaa")
+	writeLocal(t, root, "b", "bb")
+	writeLocal(t, root, "c", "c")
+
+	dst := t.TempDir()
+	if _, err := WriteDir(refusingSink(t, dst), "/", root); err == nil || !strings.Contains(err.Error(), "Permission denied") {
+		t.Fatalf("WriteDir of a refused file gave %v", err)
+	}
+	if got := readTree(t, dst); !sameTree(got, map[string]string{"batch/": "", "batch/a": "aaa"}) {
+		t.Fatalf("WriteDir stopping at a refused file wrote %q", got)
+	}
+
+	dst = t.TempDir()
+	_, err := WriteDir(refusingSink(t, dst), "/", root, WithContinueOnError())
+
+	var be *BatchError
+	if !errors.As(err, &be) {
+		t.Fatalf("WriteDir with WithContinueOnError gave %v; expected a *BatchError", err)
+	}
+	if !reflect.DeepEqual(be.Sent, []string{"batch/a", "batch/c"}) || len(be.Failed) != 1 || be.Failed[0].Path != "batch/b" {
+		t.Fatalf("WriteDir with WithContinueOnError sent %q and failed %v", be.Sent, be.Failed)
+	}
+
+	var pe *ProtocolError
+	if !errors.As(be.Failed[0], &pe) || pe.Severity != SeverityWarning {
+		t.Fatalf("failure was %v; expected the remote side's warning", be.Failed[0].Err)
+	}
+
+	if got := readTree(t, dst); !sameTree(got, map[string]string{"batch/": "", "batch/a": "aaa", "batch/c": "c"}) {
+		t.Fatalf("WriteDir with WithContinueOnError wrote %q", got)
+	}
+}
+
+func TestWriterContinueOnError(t *testing.T) {
+	files := func() []*File {
+		return []*File{
+			NewFile("a", 3, 0644, strings.NewReader("aaa")),
+			NewFile("b", 2, 0644, strings.NewReader("bb")),
+			NewFile("c", 1, 0644, strings.NewReader("c")),
+		}
+	}
+
+	dst := t.TempDir()
+	w, err := NewWriter(refusingSink(t, dst), "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var errs []error
+	for _, f := range files() {
+		_, err := w.WriteFile(f)
+		errs = append(errs, err)
+	}
+	if errs[0] != nil || errs[1] == nil || errs[2] != errs[1] {
+		t.Fatalf("Writer gave %v; expected a failure for b to be repeated for c", errs)
+	}
+	w.Close()
+
+	dst = t.TempDir()
+	w, err = NewWriter(refusingSink(t, dst), "/", WithContinueOnError())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs = nil
+	for _, f := range files() {
+		_, err := w.WriteFile(f)
+		errs = append(errs, err)
+	}
+	if errs[0] != nil || errs[1] == nil || errs[2] != nil {
+		t.Fatalf("Writer with WithContinueOnError gave %v; expected just b to fail", errs)
+	}
+
+	var be *BatchError
+	if err := w.Close(); !errors.As(err, &be) {
+		t.Fatalf("Close with WithContinueOnError gave %v; expected a *BatchError", err)
+	}
+	if !reflect.DeepEqual(be.Sent, []string{"a", "c"}) || len(be.Failed) != 1 || be.Failed[0].Path != "b" || be.Failed[0].Err != errs[1] {
+		t.Fatalf("Close with WithContinueOnError reported %q sent and %v failed", be.Sent, be.Failed)
+	}
+
+	if got := readTree(t, dst); !sameTree(got, map[string]string{"a": "aaa", "c": "c"}) {
+		t.Fatalf("Writer with WithContinueOnError wrote %q", got)
+	}
+}
+
+func TestContinueOnErrorUnsendable(t *testing.T) {
+	// A name with a newline in it can't go in a record, which is found out
+	// before anything of the file is sent.
+	root := filepath.Join(t.TempDir(), "batch")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeLocal(t, root, "a", "aaa")
+	writeLocal(t, root, "a\nb", "bb")
+	writeLocal(t, root, "c", "c")
+
+	dst := t.TempDir()
+	_, err := WriteDir(refusingSink(t, dst), "/", root, WithContinueOnError())
+
+	var be *BatchError
+	if !errors.As(err, &be) {
+		t.Fatalf("WriteDir with WithContinueOnError gave %v; expected a *BatchError", err)
+	}
+	if !reflect.DeepEqual(be.Sent, []string{"batch/a", "batch/c"}) || len(be.Failed) != 1 || be.Failed[0].Path != "batch/a\nb" {
+		t.Fatalf("WriteDir with WithContinueOnError sent %q and failed %v", be.Sent, be.Failed)
+	}
+	if got := readTree(t, dst); !sameTree(got, map[string]string{"batch/": "", "batch/a": "aaa", "batch/c": "c"}) {
+		t.Fatalf("WriteDir with WithContinueOnError wrote %q", got)
+	}
+
+	dst = t.TempDir()
+	w, err := NewWriter(refusingSink(t, dst), "/", WithContinueOnError())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var errs []error
+	for _, f := range []*File{
+		NewFile("a", 3, 0644, strings.NewReader("aaa")),
+		NewFile("a\nb", 2, 0644, strings.NewReader("bb")),
+		NewFile("c", 1, 0644, strings.NewReader("c")),
+	} {
+		_, err := w.WriteFile(f)
+		errs = append(errs, err)
+	}
+	if errs[0] != nil || errs[1] == nil || errs[2] != nil {
+		t.Fatalf("Writer with WithContinueOnError gave %v; expected just a\\nb to fail", errs)
+	}
+
+	if err := w.Close(); !errors.As(err, &be) {
+		t.Fatalf("Close with WithContinueOnError gave %v; expected a *BatchError", err)
+	}
+	if !reflect.DeepEqual(be.Sent, []string{"a", "c"}) || len(be.Failed) != 1 || be.Failed[0].Err != errs[1] {
+		t.Fatalf("Close with WithContinueOnError reported %q sent and %v failed", be.Sent, be.Failed)
+	}
+	if got := readTree(t, dst); !sameTree(got, map[string]string{"a": "aaa", "c": "c"}) {
+		t.Fatalf("Writer with WithContinueOnError wrote %q", got)
+	}
+}
+
+func TestWithManifest(t *testing.T) {
+	c := newTestClient(t)
+	sum := func(s string) []byte {
+		h := sha256.Sum256([]byte(s))
+		return h[:]
+	}
+
+	var m Manifest
+	if _, err := WriteDir(c, t.TempDir(), makeTree(t), WithManifest(&m), WithChecksum(sha256.New, "sha256sum %s")); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []ManifestEntry{
+		{Path: "tree/a.txt", Size: 3, Mode: 0644, Digest: sum("aaa")},
+		{Path: "tree/sub/b.txt", Size: 2, Mode: 0644, Digest: sum("bb")},
+	}
+	if !reflect.DeepEqual(m.Files, expected) {
+		t.Fatalf("WriteDir's manifest was %+v; expected %+v", m.Files, expected)
+	}
+
+	m = Manifest{}
+	w, err := NewWriter(c, t.TempDir(), WithManifest(&m), WithMode(0600), WithChecksum(sha256.New, "sha256sum %s"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []*File{
+		NewFile("a", 3, 0644, strings.NewReader("aaa")),
+		NewFile("b", 2, 0644, strings.NewReader("bb")),
+	} {
+		if _, err := w.WriteFile(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected = []ManifestEntry{
+		{Path: "a", Size: 3, Mode: 0600, Digest: sum("aaa")},
+		{Path: "b", Size: 2, Mode: 0600, Digest: sum("bb")},
+	}
+	if !reflect.DeepEqual(m.Files, expected) {
+		t.Fatalf("Writer's manifest was %+v; expected %+v", m.Files, expected)
+	}
+}
+
+// flakySink returns a client whose remote side is a Sink writing into dir that
+// turns down the first file called "b" it's sent, as it might if it were short
+// of space for a moment, and the names of the files each session was sent.
+func flakySink(t testing.TB, dir string) (*ssh.Client, func() [][]string) {
+	t.Helper()
+
+	var mu sync.Mutex
+	var sessions [][]string
+	failed := false
+
+	c := newFakeClient(t, func(cmd string, ch ssh.Channel) int {
+		mu.Lock()
+		i := len(sessions)
+		sessions = append(sessions, nil)
+		mu.Unlock()
+
+		s, err := NewSink(dir, WithFileHook(func(f *File, target string) (string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			sessions[i] = append(sessions[i], f.Name())
+			if f.Name() == "b" && !failed {
+				failed = true
+				return "", errors.New(f.Path() + ": No space left on device")
+			}
+
+			return target, nil
+		}))
+		if err != nil {
+			return 1
+		}
+
+		if _, err := s.Serve(ch); err != nil {
+			return 1
+		}
+
+		return 0
+	})
+
+	return c, func() [][]string {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return sessions
+	}
+}
+
+// manifestPaths returns the paths of the files in m.
+func manifestPaths(m *Manifest) []string {
+	var paths []string
+	for _, e := range m.Files {
+		paths = append(paths, e.Path)
+	}
+
+	return paths
+}
+
+func TestWriterResumeFrom(t *testing.T) {
+	dst := t.TempDir()
+	c, sessions := flakySink(t, dst)
+
+	var m Manifest
+	send := func() error {
+		w, err := NewWriter(c, "/", WithResumeFrom(&m), WithPipelining())
+		if err != nil {
+			return err
+		}
+
+		for _, f := range []*File{
+			NewFile("a", 3, 0644, strings.NewReader("aaa")),
+			NewFile("b", 2, 0644, strings.NewReader("bb")),
+			NewFile("c", 1, 0644, strings.NewReader("c")),
+		} {
+			if _, err := w.WriteFile(f); err != nil {
+				w.Close()
+				return err
+			}
+		}
+
+		return w.Close()
+	}
+
+	if err := send(); err == nil {
+		t.Fatal("first attempt succeeded")
+	}
+	if paths := manifestPaths(&m); !reflect.DeepEqual(paths, []string{"a"}) {
+		t.Fatalf("manifest after the first attempt listed %q; expected just a", paths)
+	}
+
+	if err := send(); err != nil {
+		t.Fatal(err)
+	}
+	if paths := manifestPaths(&m); !reflect.DeepEqual(paths, []string{"a", "b", "c"}) {
+		t.Fatalf("manifest after the retry listed %q", paths)
+	}
+
+	if got := sessions(); !reflect.DeepEqual(got, [][]string{{"a", "b"}, {"b", "c"}}) {
+		t.Fatalf("sessions were sent %q; expected the retry to start from b", got)
+	}
+	if got := readTree(t, dst); !sameTree(got, map[string]string{"a": "aaa", "b": "bb", "c": "c"}) {
+		t.Fatalf("Writer created %q", got)
+	}
+}
+
+func TestWriteDirResumeFrom(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "batch")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeLocal(t, root, "a", "aaa")
+	writeLocal(t, root, "b", "bb")
+	writeLocal(t, root, "c", "c")
+
+	dst := t.TempDir()
+	c, sessions := flakySink(t, dst)
+
+	var m Manifest
+	if _, err := WriteDir(c, "/", root, WithResumeFrom(&m)); err == nil {
+		t.Fatal("first attempt succeeded")
+	}
+	if _, err := WriteDir(c, "/", root, WithResumeFrom(&m)); err != nil {
+		t.Fatal(err)
+	}
+
+	if paths := manifestPaths(&m); !reflect.DeepEqual(paths, []string{"batch/a", "batch/b", "batch/c"}) {
+		t.Fatalf("manifest listed %q", paths)
+	}
+	if got := sessions(); !reflect.DeepEqual(got, [][]string{{"a", "b"}, {"b", "c"}}) {
+		t.Fatalf("sessions were sent %q; expected the retry to start from b", got)
+	}
+	if got := readTree(t, dst); !sameTree(got, map[string]string{"batch/": "", "batch/a": "aaa", "batch/b": "bb", "batch/c": "c"}) {
+		t.Fatalf("WriteDir created %q", got)
+	}
+}
@@ -0,0 +1,116 @@
+package scp
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Client pairs an ssh.Client with a set of options, so that options shared by
+// many transfers only have to be given once. Its methods are the same as the
+// package-level functions of the same names, with the Client's options
+// applied before any given to the call itself.
+//
+// A Client is safe to use from several goroutines at once, as long as the
+// options it holds are (e.g. a Manifest from WithManifest is not).
+type Client struct {
+	c    *ssh.Client
+	opts []Option
+}
+
+// NewClient returns a Client that runs transfers over c with opts.
+func NewClient(c *ssh.Client, opts ...Option) *Client {
+	return &Client{c: c, opts: append([]Option(nil), opts...)}
+}
+
+// With returns a copy of the Client with opts applied after its own, sharing
+// the same ssh.Client. The original is left as it was.
+func (c *Client) With(opts ...Option) *Client {
+	return &Client{c: c.c, opts: c.options(opts)}
+}
+
+// SSHClient returns the ssh.Client the Client runs its transfers over.
+func (c *Client) SSHClient() *ssh.Client {
+	return c.c
+}
+
+// options returns the Client's options followed by opts, in a slice of its
+// own so that neither can be modified through it.
+func (c *Client) options(opts []Option) []Option {
+	all := make([]Option, 0, len(c.opts)+len(opts))
+	all = append(all, c.opts...)
+
+	return append(all, opts...)
+}
+
+// Read is like the package-level Read.
+func (c *Client) Read(file string, opts ...Option) (*File, error) {
+	return Read(c.c, file, c.options(opts)...)
+}
+
+// ReadContext is like the package-level ReadContext.
+func (c *Client) ReadContext(ctx context.Context, file string, opts ...Option) (*File, error) {
+	return ReadContext(ctx, c.c, file, c.options(opts)...)
+}
+
+// ReadLimit is like the package-level ReadLimit.
+func (c *Client) ReadLimit(file string, w io.Writer, n int64, opts ...Option) (int64, error) {
+	return ReadLimit(c.c, file, w, n, c.options(opts)...)
+}
+
+// ReadToWriterAt is like the package-level ReadToWriterAt.
+func (c *Client) ReadToWriterAt(file string, w io.WriterAt, off int64, opts ...Option) (int64, error) {
+	return ReadToWriterAt(c.c, file, w, off, c.options(opts)...)
+}
+
+// ReadDir is like the package-level ReadDir.
+func (c *Client) ReadDir(dir string, fn func(f *File) error, opts ...Option) ([]string, error) {
+	return ReadDir(c.c, dir, fn, c.options(opts)...)
+}
+
+// Write is like the package-level Write.
+func (c *Client) Write(dir string, file *File, opts ...Option) ([]string, error) {
+	return Write(c.c, dir, file, c.options(opts)...)
+}
+
+// WriteContext is like the package-level WriteContext.
+func (c *Client) WriteContext(ctx context.Context, dir string, file *File, opts ...Option) ([]string, error) {
+	return WriteContext(ctx, c.c, dir, file, c.options(opts)...)
+}
+
+// WriteDir is like the package-level WriteDir.
+func (c *Client) WriteDir(dir, root string, opts ...Option) ([]string, error) {
+	return WriteDir(c.c, dir, root, c.options(opts)...)
+}
+
+// WriteFile is like the package-level WriteFile.
+func (c *Client) WriteFile(dir, localPath string, opts ...Option) ([]string, error) {
+	return WriteFile(c.c, dir, localPath, c.options(opts)...)
+}
+
+// ReadFile is like the package-level ReadFile.
+func (c *Client) ReadFile(remote, localPath string, opts ...Option) error {
+	return ReadFile(c.c, remote, localPath, c.options(opts)...)
+}
+
+// NewWriter is like the package-level NewWriter.
+func (c *Client) NewWriter(dir string, opts ...Option) (*Writer, error) {
+	return NewWriter(c.c, dir, c.options(opts)...)
+}
+
+// WriteReader is like the package-level WriteReader.
+func (c *Client) WriteReader(dir, name string, mode os.FileMode, r io.Reader, opts ...Option) ([]string, error) {
+	return WriteReader(c.c, dir, name, mode, r, c.options(opts)...)
+}
+
+// ReadGlob is like the package-level ReadGlob.
+func (c *Client) ReadGlob(pattern string, opts ...Option) (*Glob, error) {
+	return ReadGlob(c.c, pattern, c.options(opts)...)
+}
+
+// ReadMany is like the package-level ReadMany.
+func (c *Client) ReadMany(files []string, dir string, concurrency int, opts ...Option) []ReadResult {
+	return ReadMany(c.c, files, dir, concurrency, c.options(opts)...)
+}
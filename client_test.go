@@ -0,0 +1,43 @@
+package scp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestClient(t *testing.T) {
+	c := newTestClient(t)
+	dir := t.TempDir()
+
+	ch := make(chan Event, 100)
+
+	base := NewClient(c, WithEvents(ch), WithTransferID("base"))
+	derived := base.With(WithTransferID("derived"))
+
+	if base.SSHClient() != c || derived.SSHClient() != c {
+		t.Fatal("Client doesn't hold on to its ssh.Client")
+	}
+
+	for client, id := range map[*Client]string{base: "base", derived: "derived"} {
+		if _, err := client.Write(dir, NewFile(id, 1, 0644, strings.NewReader("x"))); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, e := range collect(t, ch) {
+			if e.TransferID != id {
+				t.Fatalf("%v event of the %s Client has transfer ID %q", e.Type, id, e.TransferID)
+			}
+		}
+	}
+
+	// An option given to the call comes last, overriding the Client's.
+	f, err := base.Read(dir+"/base", WithTransferID("call"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, f)
+
+	if f.TransferID() != "call" {
+		t.Fatalf("File read with the call's option has transfer ID %q", f.TransferID())
+	}
+}
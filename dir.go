@@ -0,0 +1,263 @@
+package scp
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"fknsrs.biz/p/scp/protocol"
+	"golang.org/x/crypto/ssh"
+)
+
+// WriteDir writes the local file or directory tree at root into the remote
+// directory dir over a single session, the way `scp -r` does. A directory is
+// created on the remote side with the same name as root, and everything inside
+// it, including empty subdirectories, is recreated beneath that. Warnings are
+// collected across the whole tree and returned in the same way as for Write.
+//
+// Symbolic links are followed by default, so the files and directories they
+// point to are sent in their place; see WithSymlinks for the alternatives.
+//
+// With WithContinueOnError, a file or directory that can't be sent is skipped
+// over, and once the rest of the tree has been sent, the error is a
+// *BatchError listing what was skipped.
+func WriteDir(c *ssh.Client, dir string, root string, opts ...Option) (warnings []string, err error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	o.emit(Event{Type: EventStart, Name: root})
+	defer func() {
+		o.emit(Event{Type: EventDone, Name: root, Err: err})
+	}()
+	if o.callbackErr != nil {
+		return nil, o.callbackErr
+	}
+
+	// The base name of root becomes the name of the top-level directory, so
+	// something like "." has to be resolved first.
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.checkWritable {
+		if err := CheckWritable(c, dir); err != nil {
+			return nil, err
+		}
+	}
+
+	flags := "-rt"
+	if o.preserve {
+		flags = "-prt"
+	}
+
+	k, err := startSender(c, o, flags, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := k.tree(root); err != nil {
+		k.abandon()
+		return k.warnings, err
+	}
+
+	if err := k.close(); err != nil {
+		return k.warnings, err
+	}
+
+	return k.warnings, k.batchErr()
+}
+
+// tree sends the local file or directory at path, recursing into directories.
+func (k *sender) tree(path string) error {
+	info, err := k.stat(path)
+	if err != nil {
+		return k.skip(k.remote(filepath.Base(path)), err)
+	}
+
+	if !info.IsDir() {
+		return k.localFile(path, info)
+	}
+
+	p := k.remote(info.Name())
+
+	mode := info.Mode()
+	if k.o.forceDirMode {
+		mode = k.o.dirMode
+	}
+
+	// Nothing has been sent for the directory yet if it can't be, so the
+	// remote side is still in step for whatever comes after it.
+	d := protocol.Record{Kind: 'D', Mode: mode, Name: info.Name()}
+	if err := d.Check(); err != nil {
+		return k.skip(p, err)
+	}
+
+	// A followed link back to a directory that's already being sent would
+	// go round forever, or at least until the path gets too long.
+	for _, a := range k.dirs {
+		if os.SameFile(a, info) {
+			return k.skip(p, fmt.Errorf("%s: symbolic link loop", path))
+		}
+	}
+	if len(k.dirs) >= k.o.depthLimit() {
+		return k.skip(p, fmt.Errorf("%w: %s is more than %d levels down", ErrTooDeep, path, k.o.depthLimit()))
+	}
+
+	k.dirs = append(k.dirs, info)
+	defer func() { k.dirs = k.dirs[:len(k.dirs)-1] }()
+
+	if err := k.times(info.Name(), info.ModTime(), time.Time{}); err != nil {
+		return err
+	}
+
+	if err := k.record(d, info.Name(), 0); err != nil {
+		if refused(err) {
+			return k.skip(p, err)
+		}
+
+		return err
+	}
+
+	// Every D record has to be matched by an E, even if something goes
+	// wrong part way through the directory, or the remote scp is left a
+	// level down waiting for records that will never come.
+	entries, err := k.readDir(path)
+	if err != nil {
+		err = k.skip(p, err)
+	}
+	if err == nil {
+		for _, e := range entries {
+			if err = k.entry(k.join(path, e.Name()), e); err != nil {
+				break
+			}
+		}
+	}
+
+	if eerr := k.record(protocol.Record{Kind: 'E'}, info.Name(), 0); err == nil {
+		err = eerr
+	}
+
+	return err
+}
+
+// entry sends something found in a directory, whose own description (not
+// that of anything it links to) is info.
+func (k *sender) entry(path string, info os.FileInfo) error {
+	if info.Mode()&os.ModeSymlink == 0 {
+		return k.tree(path)
+	}
+
+	switch k.o.symlinks {
+	case SymlinksSkip:
+		msg := fmt.Sprintf("skipping symbolic link %s", path)
+		k.warnings = append(k.warnings, msg)
+		k.o.emit(Event{Type: EventWarning, Name: info.Name(), Message: msg})
+
+		return nil
+	case SymlinksAsFiles:
+		return k.symlink(path, info)
+	}
+
+	return k.tree(path)
+}
+
+// symlink sends the symbolic link at path as a file holding its target.
+func (k *sender) symlink(path string, info os.FileInfo) error {
+	target, err := k.readlink(path)
+	if err != nil {
+		return k.skip(k.remote(info.Name()), err)
+	}
+
+	return k.batchFile(symlinkFile(info, target))
+}
+
+// symlinkFile returns a File for the symbolic link described by info, which
+// points to target, as sent with SymlinksAsFiles.
+func symlinkFile(info os.FileInfo, target string) *File {
+	f := NewFile(info.Name(), int64(len(target)), 0644, strings.NewReader(target))
+	f.mtime = info.ModTime()
+
+	return f
+}
+
+// localFile sends the content of the local file at path.
+func (k *sender) localFile(path string, info os.FileInfo) error {
+	fd, err := k.open(path)
+	if err != nil {
+		return k.skip(k.remote(info.Name()), err)
+	}
+	defer fd.Close()
+
+	f, err := NewFileFromInfo(info, fd)
+	if err != nil {
+		return k.skip(k.remote(info.Name()), err)
+	}
+
+	return k.batchFile(f)
+}
+
+// ReadDir reads the remote file or directory tree at dir over a single
+// session, the way `scp -r` does, calling fn for each file it contains. The
+// File passed to fn has its Path set to its location relative to dir's parent,
+// i.e. starting with the base name of dir, built up from the directories the
+// remote side has descended into. With WithDirectories, fn is called for each
+// directory too.
+//
+// The content of each file streams straight off the session, so it's only
+// valid until fn returns: the next record can't be read until the content of
+// the current one has been consumed. Anything fn leaves unread is discarded
+// once it returns. If fn returns an error, the transfer is abandoned and that
+// error is returned.
+//
+// Warnings sent by the remote side, such as for files it couldn't read, are
+// collected and returned as with Write.
+//
+// ReadDir writes nothing locally itself, so if the transfer fails part way
+// there's nothing for it to clean up or list: fn has been given exactly the
+// files that arrived, in order, and reading the content of one that was cut
+// short returns an error. A caller that writes the files out can keep its own
+// record of what it wrote, and remove it or resume from it as it sees fit.
+func ReadDir(c *ssh.Client, dir string, fn func(f *File) error, opts ...Option) (warnings []string, err error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	o.emit(Event{Type: EventStart, Name: dir})
+	defer func() {
+		o.emit(Event{Type: EventDone, Name: dir, Err: err})
+	}()
+	if o.callbackErr != nil {
+		return nil, o.callbackErr
+	}
+
+	flags := "-rqf"
+	if o.preserve {
+		flags = "-prqf"
+	}
+
+	r, err := startReceiver(c, o, flags, dir, false)
+	if err != nil {
+		return nil, err
+	}
+	defer r.close()
+
+	for {
+		f, err := r.next()
+		if err == io.EOF {
+			return r.warnings, nil
+		} else if err != nil {
+			return r.warnings, err
+		}
+
+		if err := fn(f); err != nil {
+			return r.warnings, err
+		}
+	}
+}
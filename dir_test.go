@@ -0,0 +1,349 @@
+package scp
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// makeTree creates a small tree in a new directory called tree, and returns
+// its path.
+func makeTree(t testing.TB) string {
+	t.Helper()
+
+	root := filepath.Join(t.TempDir(), "tree")
+	for _, d := range []string{root, filepath.Join(root, "sub"), filepath.Join(root, "empty")} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeLocal(t, root, "a.txt", "aaa")
+	writeLocal(t, filepath.Join(root, "sub"), "b.txt", "bb")
+
+	return root
+}
+
+// readTree returns the content of every file beneath root by its slash
+// separated path, with an entry with no content for each directory.
+func readTree(t testing.TB, root string) map[string]string {
+	t.Helper()
+
+	got := map[string]string{}
+
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || p == root {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			got[filepath.ToSlash(rel)+"/"] = ""
+			return nil
+		}
+
+		b, err := ioutil.ReadFile(p)
+		got[filepath.ToSlash(rel)] = string(b)
+
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return got
+}
+
+func sameTree(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for k, v := range a {
+		if w, ok := b[k]; !ok || v != w {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestWriteDir(t *testing.T) {
+	c := newTestClient(t)
+	root := makeTree(t)
+	dst := t.TempDir()
+
+	if _, err := WriteDir(c, dst, root); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"tree/": "", "tree/a.txt": "aaa", "tree/sub/": "", "tree/sub/b.txt": "bb", "tree/empty/": ""}
+	if got := readTree(t, dst); !sameTree(got, expected) {
+		t.Fatalf("WriteDir created %q; expected %q", got, expected)
+	}
+
+	if _, err := WriteDir(c, dst, filepath.Join(root, "missing")); err == nil {
+		t.Fatal("WriteDir of a missing directory succeeded")
+	}
+}
+
+func TestWriteDirPreserve(t *testing.T) {
+	c := newTestClient(t)
+	root := makeTree(t)
+	dst := t.TempDir()
+
+	mtime := time.Unix(1500000000, 0)
+	for _, p := range []string{filepath.Join(root, "sub", "b.txt"), filepath.Join(root, "sub"), root} {
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := WriteDir(c, dst, root, WithPreserve()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"tree", "tree/sub", "tree/sub/b.txt"} {
+		info, err := os.Stat(filepath.Join(dst, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !info.ModTime().Equal(mtime) {
+			t.Errorf("%s has modification time %v; expected %v", p, info.ModTime(), mtime)
+		}
+	}
+}
+
+func TestWithDirMode(t *testing.T) {
+	c := newTestClient(t)
+	root := makeTree(t)
+	dst := t.TempDir()
+
+	var trace strings.Builder
+	if _, err := WriteDir(c, dst, root, WithDirMode(0750), WithMode(0600), WithTrace(&trace)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, l := range []string{"> D0750 0 tree\n", "> D0750 0 sub\n", "> C0600 3 a.txt\n", "> C0600 2 b.txt\n"} {
+		if !strings.Contains(trace.String(), l) {
+			t.Errorf("trace has no %q:\n%s", l, trace.String())
+		}
+	}
+
+	for _, p := range []string{"tree", "tree/sub", "tree/empty"} {
+		info, err := os.Stat(filepath.Join(dst, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info.Mode().Perm() != 0750 {
+			t.Errorf("%s has mode %v; expected 0750", p, info.Mode().Perm())
+		}
+	}
+}
+
+func TestReadDir(t *testing.T) {
+	c := newTestClient(t)
+	root := makeTree(t)
+
+	visit := func(opts ...Option) map[string]string {
+		got := map[string]string{}
+
+		_, err := ReadDir(c, root, func(f *File) error {
+			if f.IsDir() {
+				got[f.Path()+"/"] = ""
+				return nil
+			}
+
+			got[f.Path()] = readAll(t, f)
+
+			return nil
+		}, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return got
+	}
+
+	expected := map[string]string{"tree/a.txt": "aaa", "tree/sub/b.txt": "bb"}
+	if got := visit(); !sameTree(got, expected) {
+		t.Fatalf("ReadDir gave %q; expected %q", got, expected)
+	}
+
+	expected = map[string]string{"tree/": "", "tree/a.txt": "aaa", "tree/sub/": "", "tree/sub/b.txt": "bb", "tree/empty/": ""}
+	if got := visit(WithDirectories()); !sameTree(got, expected) {
+		t.Fatalf("ReadDir with WithDirectories gave %q; expected %q", got, expected)
+	}
+
+	// Content that isn't read is skipped over.
+	var paths []string
+	if _, err := ReadDir(c, root, func(f *File) error {
+		paths = append(paths, f.Path())
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(paths)
+
+	if strings.Join(paths, " ") != "tree/a.txt tree/sub/b.txt" {
+		t.Fatalf("ReadDir without reading content gave %q", paths)
+	}
+
+	stop := errors.New("stop")
+	if _, err := ReadDir(c, root, func(f *File) error { return stop }); err != stop {
+		t.Fatalf("ReadDir with a failing function gave %v; expected its error", err)
+	}
+}
+
+func TestReadDirAborted(t *testing.T) {
+	// A remote side whose output stops part way through the content of the
+	// third file.
+	c := newFakeClient(t, func(cmd string, ch ssh.Channel) int {
+		io.WriteString(ch, "D0755 0 tree\nC0644 3 a\naaa\x00C0644 2 b\nbb\x00C0644 10 c\nabc")
+		ch.CloseWrite()
+		io.Copy(ioutil.Discard, ch)
+
+		return 1
+	})
+
+	var got []string
+	_, err := ReadDir(c, "tree", func(f *File) error {
+		b, err := ioutil.ReadAll(f)
+		if err != nil {
+			got = append(got, f.Path()+" (cut short)")
+			return err
+		}
+
+		got = append(got, f.Path()+" "+string(b))
+
+		return nil
+	})
+	if err == nil {
+		t.Fatal("ReadDir from a remote side that went away succeeded")
+	}
+
+	if expected := []string{"tree/a aaa", "tree/b bb", "tree/c (cut short)"}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("aborted ReadDir gave %q; expected %q", got, expected)
+	}
+}
+
+func TestSymlinks(t *testing.T) {
+	c := newTestClient(t)
+	root := makeTree(t)
+
+	if err := os.Symlink("a.txt", filepath.Join(root, "link")); err != nil {
+		t.Skip(err)
+	}
+
+	tests := []struct {
+		symlinks Symlinks
+		link     string
+		warnings int
+	}{
+		{symlinks: SymlinksFollow, link: "aaa"},
+		{symlinks: SymlinksSkip, warnings: 1},
+		{symlinks: SymlinksAsFiles, link: "a.txt"},
+	}
+
+	for _, tt := range tests {
+		dst := t.TempDir()
+
+		warnings, err := WriteDir(c, dst, root, WithSymlinks(tt.symlinks))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(warnings) != tt.warnings {
+			t.Errorf("WriteDir with Symlinks %d gave warnings %q", tt.symlinks, warnings)
+		}
+
+		got, ok := readTree(t, dst)["tree/link"]
+		if tt.link == "" {
+			if ok {
+				t.Errorf("WriteDir with SymlinksSkip sent the link")
+			}
+
+			continue
+		}
+
+		if got != tt.link {
+			t.Errorf("WriteDir with Symlinks %d sent the link as %q; expected %q", tt.symlinks, got, tt.link)
+		}
+	}
+
+	if _, err := WriteFile(c, t.TempDir(), filepath.Join(root, "link"), WithSymlinks(SymlinksSkip)); err == nil {
+		t.Error("WriteFile with SymlinksSkip sent a link")
+	}
+
+	dst := t.TempDir()
+	if _, err := WriteFile(c, dst, filepath.Join(root, "link"), WithSymlinks(SymlinksAsFiles)); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dst, "link")); err != nil || string(b) != "a.txt" {
+		t.Errorf("WriteFile with SymlinksAsFiles sent %q, %v", b, err)
+	}
+}
+
+func TestWithMaxDepth(t *testing.T) {
+	c := newTestClient(t)
+	root := makeTree(t)
+	discard := func(f *File) error { return nil }
+
+	if _, err := WriteDir(c, t.TempDir(), root, WithMaxDepth(2)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := WriteDir(c, t.TempDir(), root, WithMaxDepth(1)); !errors.Is(err, ErrTooDeep) {
+		t.Fatalf("WriteDir of a tree with subdirectories at depth 1 gave %v; expected ErrTooDeep", err)
+	}
+
+	if _, err := ReadDir(c, root, discard, WithMaxDepth(2)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadDir(c, root, discard, WithMaxDepth(1)); !errors.Is(err, ErrTooDeep) {
+		t.Fatalf("ReadDir of a tree with subdirectories at depth 1 gave %v; expected ErrTooDeep", err)
+	}
+
+	// The serving side has its own limit, which the client hears about.
+	c = serveClient(t, t.TempDir(), WithMaxDepth(1))
+
+	if _, err := WriteDir(c, "/", root); err == nil || !strings.Contains(err.Error(), ErrTooDeep.Error()) {
+		t.Fatalf("WriteDir to a Sink at depth 1 gave %v; expected it to be too deep", err)
+	}
+
+	c = serveClient(t, filepath.Dir(root), WithMaxDepth(1))
+
+	if _, err := ReadDir(c, "/tree", discard); err == nil || !strings.Contains(err.Error(), ErrTooDeep.Error()) {
+		t.Fatalf("ReadDir from a Source at depth 1 gave %v; expected it to be too deep", err)
+	}
+}
+
+func TestSymlinkLoop(t *testing.T) {
+	c := newTestClient(t)
+	root := makeTree(t)
+
+	if err := os.Symlink(".", filepath.Join(root, "self")); err != nil {
+		t.Skip(err)
+	}
+
+	if _, err := WriteDir(c, t.TempDir(), root); err == nil || !strings.Contains(err.Error(), "loop") {
+		t.Fatalf("WriteDir of a tree with a link to itself gave %v; expected a loop to be found", err)
+	}
+
+	if _, err := WriteDir(c, t.TempDir(), root, WithSymlinks(SymlinksSkip)); err != nil {
+		t.Fatalf("WriteDir skipping links gave %v", err)
+	}
+}
@@ -0,0 +1,264 @@
+package scp
+
+import (
+	"crypto/rand"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// EventType identifies the kind of an Event.
+type EventType int
+
+const (
+	// EventStart is sent once, before the remote scp is started.
+	EventStart EventType = iota
+	// EventRecordSent is sent after a protocol record (e.g. a C record) has
+	// been written to the remote side.
+	EventRecordSent
+	// EventProgress is sent each time a chunk of content has been moved.
+	EventProgress
+	// EventWarning is sent for each non-fatal message from the remote side.
+	EventWarning
+	// EventDone is sent once, when the transfer has finished or failed.
+	EventDone
+)
+
+// String returns a short name for the event type.
+func (t EventType) String() string {
+	switch t {
+	case EventStart:
+		return "start"
+	case EventRecordSent:
+		return "record-sent"
+	case EventProgress:
+		return "progress"
+	case EventWarning:
+		return "warning"
+	case EventDone:
+		return "done"
+	}
+
+	return "unknown"
+}
+
+// Event describes something that happened during a transfer. Which fields
+// are set depends on the Type.
+type Event struct {
+	Type EventType
+
+	// TransferID identifies the transfer the event belongs to. It's the same
+	// for every event of a transfer; see WithTransferID.
+	TransferID string
+
+	// Name is the name of the file being transferred, if it's known yet.
+	// For Read, it's the remote path that was asked for, in every event.
+	Name string
+	// RecordName is the name the remote side sent in the C record of the
+	// file being read by Read, which may not match the path asked for. It's
+	// only set for Read's EventProgress and EventDone, once the record has
+	// arrived.
+	RecordName string
+	// Record is the record that was sent, without its trailing newline. It's
+	// only set for EventRecordSent.
+	Record string
+	// Transferred and Total are the number of content bytes moved so far and
+	// the number expected in total.
+	Transferred, Total int64
+	// Rate is a smoothed estimate of the transfer speed in bytes per second,
+	// and ETA is the time it suggests is left until Total is reached. They're
+	// only set for EventProgress, and both are zero until the transfer has
+	// been running long enough for the estimate to settle.
+	Rate float64
+	ETA  time.Duration
+	// Elapsed is the time since the transfer's start event. It's zero for
+	// the start event itself.
+	Elapsed time.Duration
+	// Message is the text of a warning. It's only set for EventWarning.
+	Message string
+	// Err is the error that ended the transfer, if any. It's only set for
+	// EventDone.
+	Err error
+}
+
+// Status follows a transfer given to WithStatus as it runs, so that something
+// like a dashboard can poll it from another goroutine. The zero value is ready
+// to use, and a Status can be reused for one transfer after another.
+type Status struct {
+	mu sync.Mutex
+	s  StatusSnapshot
+
+	// last is the number of bytes of the current file already counted in
+	// s.Bytes.
+	last int64
+}
+
+// StatusSnapshot is the state of a transfer at the moment Snapshot was called.
+type StatusSnapshot struct {
+	// Name is the name of the file being transferred, or of the directory
+	// or pattern given to the transfer before its first file has started.
+	Name string
+	// Transferred and Total are the number of content bytes of the current
+	// file moved so far and the number expected in total.
+	Transferred, Total int64
+	// Bytes is the number of content bytes moved so far by the whole
+	// transfer, across every file in it.
+	Bytes int64
+	// Elapsed is the time since the transfer started.
+	Elapsed time.Duration
+	// Rate and ETA are as for EventProgress, and are zero until the estimate
+	// has settled.
+	Rate float64
+	ETA  time.Duration
+	// Done is set once the transfer has finished, and Err is the error that
+	// ended it, if any.
+	Done bool
+	Err  error
+}
+
+// Snapshot returns the state of the transfer as of the last event it sent.
+func (s *Status) Snapshot() StatusSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.s
+}
+
+// update brings the status up to date with the event e.
+func (s *Status) update(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch e.Type {
+	case EventStart:
+		s.s = StatusSnapshot{Name: e.Name, Total: e.Total}
+		s.last = 0
+	case EventProgress:
+		if e.Name != s.s.Name || e.Transferred < s.last {
+			s.last = 0
+		}
+
+		s.s.Bytes += e.Transferred - s.last
+		s.last = e.Transferred
+
+		s.s.Name, s.s.Transferred, s.s.Total = e.Name, e.Transferred, e.Total
+		s.s.Rate, s.s.ETA = e.Rate, e.ETA
+	case EventDone:
+		s.s.Done, s.s.Err = true, e.Err
+		s.s.Rate, s.s.ETA = 0, 0
+	}
+
+	s.s.Elapsed = e.Elapsed
+}
+
+// emit delivers an event to the channel configured with WithEvents, to the
+// progress meter configured with WithProgressWriter and to the Status given to
+// WithStatus, if there are any. Once delivering an event has panicked, no more
+// are delivered, except to the Status.
+func (o *options) emit(e Event) {
+	e.TransferID = o.transferID
+
+	now := time.Now()
+	if e.Type == EventStart {
+		o.started = now
+
+		// The options can be shared by several transfers in turn, as they
+		// are by a Writer, and each of them reports its own progress.
+		o.progressLast = time.Time{}
+		o.progressHeld = false
+	} else if !o.started.IsZero() {
+		e.Elapsed = now.Sub(o.started)
+	}
+
+	if e.Type == EventProgress {
+		e.Rate, e.ETA = o.rate.update(e.Name, e.Transferred, e.Total, now)
+	}
+
+	if o.status != nil {
+		o.status.update(e)
+	}
+
+	if o.callbackErr != nil {
+		return
+	}
+
+	defer o.recoverCallback("delivering a " + e.Type.String() + " event")
+
+	if o.meter != nil {
+		o.meter.update(e)
+	}
+
+	if o.progress != nil {
+		o.reportProgress(e, now)
+	}
+
+	if o.events == nil {
+		return
+	}
+
+	if o.eventsBlock {
+		select {
+		case o.events <- e:
+		case <-o.ctx.Done():
+		}
+
+		return
+	}
+
+	select {
+	case o.events <- e:
+	default:
+	}
+}
+
+// reportProgress passes progress to the callback given to WithProgress, no
+// more often than WithProgressInterval allows. The call for the end of a file
+// is held back until the done event, since the transfer can still fail after
+// the content, or until the next file of a directory transfer starts.
+func (o *options) reportProgress(e Event, now time.Time) {
+	switch e.Type {
+	case EventProgress:
+		if e.Transferred == e.Total {
+			o.progressHeld, o.progressHeldTotal = true, e.Total
+			return
+		}
+
+		if o.progressHeld {
+			o.progressHeld = false
+			o.progress(o.progressHeldTotal, o.progressHeldTotal)
+		} else if now.Sub(o.progressLast) < o.progressInterval {
+			return
+		}
+		o.progressLast = now
+
+		o.progress(e.Transferred, e.Total)
+	case EventDone:
+		held, total := o.progressHeld, e.Total
+		o.progressHeld = false
+
+		if e.Err != nil {
+			return
+		}
+
+		// The done event of a directory or glob transfer has no total of
+		// its own, so the last file's stands in for it.
+		if held && total == 0 {
+			total = o.progressHeldTotal
+		}
+
+		o.progress(total, total)
+	}
+}
+
+// newTransferID generates a random version 4 UUID to identify a transfer.
+func newTransferID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,505 @@
+package scp
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// collect receives events from ch until the done event, failing if it doesn't
+// arrive in time.
+func collect(t testing.TB, ch <-chan Event) []Event {
+	t.Helper()
+
+	var events []Event
+
+	for {
+		select {
+		case e := <-ch:
+			events = append(events, e)
+
+			if e.Type == EventDone {
+				return events
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("no done event after %v", events)
+		}
+	}
+}
+
+// eventTypes returns the types of events, with consecutive repeats of the
+// same type collapsed into one.
+func eventTypes(events []Event) []EventType {
+	var types []EventType
+
+	for _, e := range events {
+		if len(types) == 0 || types[len(types)-1] != e.Type {
+			types = append(types, e.Type)
+		}
+	}
+
+	return types
+}
+
+func sameTypes(a, b []EventType) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestEventOrder(t *testing.T) {
+	c := newTestClient(t)
+	dir := t.TempDir()
+
+	ch := make(chan Event, 1000)
+
+	content := strings.Repeat("x", 10000)
+	if _, err := Write(c, dir, NewFile("f", int64(len(content)), 0644, strings.NewReader(content)), WithEvents(ch), WithBufferSize(1000)); err != nil {
+		t.Fatal(err)
+	}
+
+	events := collect(t, ch)
+
+	expected := []EventType{EventStart, EventRecordSent, EventProgress, EventDone}
+	if got := eventTypes(events); !sameTypes(got, expected) {
+		t.Fatalf("Write sent events %v; expected %v", got, expected)
+	}
+
+	var last int64
+	for _, e := range events {
+		if e.Type != EventProgress {
+			continue
+		}
+
+		if e.Transferred <= last || e.Total != int64(len(content)) {
+			t.Errorf("progress went from %d to %d of %d", last, e.Transferred, e.Total)
+		}
+		last = e.Transferred
+	}
+	if last != int64(len(content)) {
+		t.Errorf("progress stopped at %d", last)
+	}
+
+	if done := events[len(events)-1]; done.Err != nil || done.Total != int64(len(content)) {
+		t.Errorf("done event is %+v", done)
+	}
+
+	f, err := Read(c, filepath.Join(dir, "f"), WithEvents(ch), WithBufferSize(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, f)
+
+	expected = []EventType{EventStart, EventProgress, EventDone}
+	if got := eventTypes(collect(t, ch)); !sameTypes(got, expected) {
+		t.Fatalf("Read sent events %v; expected %v", got, expected)
+	}
+}
+
+func TestReadEventNames(t *testing.T) {
+	// The name in the C record is whatever the remote side chooses to send,
+	// but Name stays the path that was asked for.
+	c := newFakeClient(t, fakeSource(0, "C0644 5 other\n", "hello\x00"))
+
+	ch := make(chan Event, 100)
+
+	f, err := Read(c, "dir/a", WithEvents(ch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, f)
+
+	for _, e := range collect(t, ch) {
+		if e.Name != "dir/a" {
+			t.Errorf("%v event is for %q; expected dir/a", e.Type, e.Name)
+		}
+
+		expected := ""
+		if e.Type == EventProgress || e.Type == EventDone {
+			expected = "other"
+		}
+		if e.RecordName != expected {
+			t.Errorf("%v event has record name %q; expected %q", e.Type, e.RecordName, expected)
+		}
+	}
+}
+
+func TestEventDoneOnError(t *testing.T) {
+	c := newTestClient(t)
+
+	ch := make(chan Event, 100)
+
+	_, err := Read(c, filepath.Join(t.TempDir(), "missing"), WithEvents(ch))
+	if err == nil {
+		t.Fatal("Read of a missing file succeeded")
+	}
+
+	events := collect(t, ch)
+	if done := events[len(events)-1]; done.Err == nil {
+		t.Fatal("done event for a failed Read has no error")
+	}
+
+	select {
+	case e := <-ch:
+		t.Fatalf("event %v sent after the done event", e.Type)
+	default:
+	}
+}
+
+func TestWithBlockingEvents(t *testing.T) {
+	c := newTestClient(t)
+	dir := t.TempDir()
+
+	ch := make(chan Event)
+
+	var progress int
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for e := range ch {
+			if e.Type == EventProgress {
+				progress++
+				time.Sleep(time.Millisecond)
+			}
+			if e.Type == EventDone {
+				return
+			}
+		}
+	}()
+
+	content := strings.Repeat("x", 20000)
+	if _, err := Write(c, dir, NewFile("f", int64(len(content)), 0644, strings.NewReader(content)), WithEvents(ch), WithBlockingEvents(), WithBufferSize(1000)); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if progress != 20 {
+		t.Fatalf("received %d progress events; expected all 20", progress)
+	}
+}
+
+func TestWithBlockingEventsCancelled(t *testing.T) {
+	c := newTestClient(t)
+
+	// Nothing ever receives from ch, so only the context can end the
+	// transfer.
+	ch := make(chan Event)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := WriteContext(ctx, c, t.TempDir(), NewFile("f", 5, 0644, strings.NewReader("hello")), WithEvents(ch), WithBlockingEvents())
+		errs <- err
+	}()
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("WriteContext gave %v; expected context.DeadlineExceeded", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WriteContext blocked on an unread event channel after its context was done")
+	}
+}
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestTransferID(t *testing.T) {
+	c := newTestClient(t)
+	p := writeLocal(t, t.TempDir(), "f", "hello")
+
+	ch := make(chan Event, 100)
+
+	f, err := Read(c, p, WithEvents(ch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, f)
+
+	id := f.TransferID()
+	if !uuidPattern.MatchString(id) {
+		t.Fatalf("generated transfer ID %q isn't a version 4 UUID", id)
+	}
+
+	for _, e := range collect(t, ch) {
+		if e.TransferID != id {
+			t.Errorf("%v event has transfer ID %q; expected %q", e.Type, e.TransferID, id)
+		}
+	}
+
+	f, err = Read(c, p, WithEvents(ch), WithTransferID("mine"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, f)
+
+	if f.TransferID() != "mine" {
+		t.Errorf("File has transfer ID %q; expected %q", f.TransferID(), "mine")
+	}
+
+	for _, e := range collect(t, ch) {
+		if e.TransferID != "mine" {
+			t.Errorf("%v event has transfer ID %q; expected %q", e.Type, e.TransferID, "mine")
+		}
+	}
+
+	if a, b := newTransferID(), newTransferID(); a == b {
+		t.Errorf("two transfer IDs are both %q", a)
+	}
+}
+
+func TestCallbackPanic(t *testing.T) {
+	c := newTestClient(t)
+	dir := t.TempDir()
+
+	boom := WithProgress(func(transferred, total int64) {
+		panic("boom")
+	})
+
+	// The end of the content isn't reported until the transfer is over, so
+	// there has to be more than a chunk of it for the callback to be called
+	// while it's going.
+	content := strings.Repeat("x", 3*defaultChunkSize)
+
+	_, err := Write(c, dir, NewFile("f", int64(len(content)), 0644, strings.NewReader(content)), boom)
+	if err == nil || !strings.Contains(err.Error(), "panicked: boom") {
+		t.Fatalf("Write with a panicking callback gave %v", err)
+	}
+
+	p := writeLocal(t, dir, "g", content)
+
+	f, err := Read(c, p, boom)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ioutil.ReadAll(f); err == nil || !strings.Contains(err.Error(), "panicked: boom") {
+		t.Fatalf("Read with a panicking callback gave %v", err)
+	}
+
+	// The panic still ends a ReadDir whose function doesn't check the error
+	// from reading the content.
+	_, err = ReadDir(c, dir, func(f *File) error {
+		ioutil.ReadAll(f)
+		return nil
+	}, boom)
+	if err == nil || !strings.Contains(err.Error(), "panicked: boom") {
+		t.Fatalf("ReadDir with a panicking callback gave %v", err)
+	}
+
+	// And likewise a sink's.
+	served := make(chan error, 1)
+	sink := newFakeClient(t, func(cmd string, ch ssh.Channel) int {
+		s, err := NewSinkFunc(func(f *File) error {
+			ioutil.ReadAll(f)
+			return nil
+		}, boom)
+		if err != nil {
+			served <- err
+			return 1
+		}
+
+		_, err = s.Serve(ch)
+		served <- err
+		if err != nil {
+			return 1
+		}
+
+		return 0
+	})
+
+	Write(sink, "/", NewFile("a", int64(len(content)), 0644, strings.NewReader(content)))
+	if err := <-served; err == nil || !strings.Contains(err.Error(), "panicked: boom") {
+		t.Fatalf("sink with a panicking callback gave %v", err)
+	}
+}
+
+func TestWithProgress(t *testing.T) {
+	c := newTestClient(t)
+	dir := t.TempDir()
+
+	var calls [][2]int64
+	progress := WithProgress(func(transferred, total int64) {
+		calls = append(calls, [2]int64{transferred, total})
+	})
+
+	content := strings.Repeat("x", 5000)
+	if _, err := Write(c, dir, NewFile("f", int64(len(content)), 0644, strings.NewReader(content)), progress, WithBufferSize(1000)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(calls) != 5 {
+		t.Fatalf("progress was called %d times; expected once for each of 5 chunks", len(calls))
+	}
+	for i, call := range calls {
+		if call != [2]int64{int64(i+1) * 1000, 5000} {
+			t.Errorf("call %d was %v", i, call)
+		}
+	}
+
+	calls = nil
+
+	if _, err := Write(c, dir, NewFile("f", int64(len(content)), 0644, strings.NewReader(content)), progress, WithBufferSize(1000), WithProgressInterval(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(calls) != 2 || calls[1] != [2]int64{5000, 5000} {
+		t.Fatalf("progress calls with a long interval were %v; expected the first and the last", calls)
+	}
+
+	calls = nil
+
+	if _, err := Write(c, filepath.Join(dir, "missing", "dir"), NewFile("f", 1, 0644, strings.NewReader("x")), progress); err == nil {
+		t.Fatal("Write to a missing directory succeeded")
+	}
+	if len(calls) != 0 {
+		t.Fatalf("progress was called %v for a failed transfer", calls)
+	}
+
+	// Nor is the final total reported for a transfer that fails after all
+	// of its content has been moved, whether the remote side warns about the
+	// content or exits uncleanly.
+	warned := newFakeClient(t, fakeSource(1, "C0644 5 a\n", "hello\x01scp: a: file changed as we read it\n"))
+
+	f, err := Read(warned, "a", progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(f); err == nil {
+		t.Fatal("Read with a warning after the content succeeded")
+	}
+	f.Close()
+
+	failed := newFakeClient(t, fakeSink("\x00", "\x00", 1))
+	if _, err := Write(failed, "/", NewFile("f", 5, 0644, strings.NewReader("hello")), progress); err == nil {
+		t.Fatal("Write to a remote side that exited uncleanly succeeded")
+	}
+
+	for _, call := range calls {
+		if call == [2]int64{5, 5} {
+			t.Fatalf("progress calls for transfers that failed after their content were %v", calls)
+		}
+	}
+
+	calls = nil
+
+	// Each file written with a Writer gets its own final call, even an empty
+	// one after a file that was reported in full.
+	w, err := NewWriter(c, dir, progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	for _, content := range []string{"abc", ""} {
+		if _, err := w.WriteFile(NewFile("f", int64(len(content)), 0644, strings.NewReader(content))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(calls) != 2 || calls[0] != [2]int64{3, 3} || calls[1] != [2]int64{0, 0} {
+		t.Fatalf("progress calls for a Writer were %v; expected [3 3] and [0 0]", calls)
+	}
+}
+
+func TestWithStatus(t *testing.T) {
+	c := newTestClient(t)
+
+	root := filepath.Join(t.TempDir(), "tree")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeLocal(t, root, "a", strings.Repeat("a", 2000))
+	writeLocal(t, root, "b", strings.Repeat("b", 2000))
+
+	var s Status
+
+	done := make(chan struct{})
+	polled := make(chan []StatusSnapshot)
+	go func() {
+		var snaps []StatusSnapshot
+		defer func() { polled <- snaps }()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+				snaps = append(snaps, s.Snapshot())
+			}
+		}
+	}()
+
+	_, err := WriteDir(c, t.TempDir(), root, WithStatus(&s), WithRateLimit(10000), WithBufferSize(500))
+	close(done)
+	snaps := <-polled
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var last int64
+	seen := map[int64]bool{}
+	for _, snap := range snaps {
+		if snap.Bytes < last {
+			t.Fatalf("bytes went from %d to %d", last, snap.Bytes)
+		}
+		last = snap.Bytes
+
+		if snap.Bytes > 0 && snap.Bytes < 4000 {
+			seen[snap.Bytes] = true
+		}
+	}
+	if len(seen) < 3 {
+		t.Fatalf("polling saw %d distinct byte counts in between; expected it to see the transfer move", len(seen))
+	}
+
+	if snap := s.Snapshot(); !snap.Done || snap.Err != nil || snap.Bytes != 4000 || snap.Name != "b" || snap.Transferred != 2000 || snap.Elapsed <= 0 {
+		t.Fatalf("final snapshot is %+v", snap)
+	}
+}
+
+func TestEventTypeString(t *testing.T) {
+	for typ, s := range map[EventType]string{
+		EventStart:      "start",
+		EventRecordSent: "record-sent",
+		EventProgress:   "progress",
+		EventWarning:    "warning",
+		EventDone:       "done",
+		EventType(99):   "unknown",
+	} {
+		if typ.String() != s {
+			t.Errorf("%d.String() is %q; expected %q", int(typ), typ.String(), s)
+		}
+	}
+}
+
+func TestEventErr(t *testing.T) {
+	c := newFakeClient(t, fakeSink("\x02scp: no\n", "", 1))
+	ch := make(chan Event, 100)
+
+	_, err := Write(c, "/tmp", NewFile("a", 1, 0644, strings.NewReader("a")), WithEvents(ch))
+
+	events := collect(t, ch)
+	if done := events[len(events)-1]; !errors.Is(done.Err, err) {
+		t.Fatalf("done event has error %v; expected %v", done.Err, err)
+	}
+}
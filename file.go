@@ -0,0 +1,260 @@
+package scp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/kballard/go-shellquote"
+	"golang.org/x/crypto/ssh"
+)
+
+// WriteFile writes the local file at localPath to dir, like Write. The name,
+// size, permissions and modification time are taken from the local file, and
+// it's closed once the transfer is done. The remote file gets the base name of
+// localPath unless WithRemoteName says otherwise. If localPath is a symbolic
+// link, what happens depends on WithSymlinks; by default it's followed.
+func WriteFile(c *ssh.Client, dir, localPath string, opts ...Option) ([]string, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.symlinks != SymlinksFollow {
+		info, err := os.Lstat(localPath)
+		if err != nil {
+			return nil, err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			if o.symlinks == SymlinksSkip {
+				return nil, fmt.Errorf("%s is a symbolic link", localPath)
+			}
+
+			target, err := os.Readlink(localPath)
+			if err != nil {
+				return nil, err
+			}
+
+			f := symlinkFile(info, target)
+
+			if o.remoteName != "" {
+				f.name = o.remoteName
+			}
+
+			return Write(c, dir, f, opts...)
+		}
+	}
+
+	fd, err := os.Open(localPath)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	info, err := fd.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := NewFileFromInfo(info, fd)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.remoteName != "" {
+		f.name = o.remoteName
+	}
+
+	return Write(c, dir, f, opts...)
+}
+
+// ReadFile reads the remote file into the local file at localPath, like Read,
+// creating it with the permissions reported by the remote side (subject to the
+// umask) or truncating it if it already exists. If localPath is an existing
+// directory, the file is created inside it under the name the remote side
+// gives it, as passed through WithNameSanitizer. With WithPreserve, the local
+// file's times are set to match the remote one's as well.
+//
+// If anything goes wrong once the local file has been created, it's removed,
+// so that a failed transfer doesn't leave a truncated copy behind, unless
+// WithResume is given so that it can be carried on from later.
+func ReadFile(c *ssh.Client, remote, localPath string, opts ...Option) (err error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return err
+	}
+
+	if o.resume {
+		if ok, err := resumeFile(c, remote, localPath, o); ok || err != nil {
+			return err
+		}
+	}
+
+	f, err := Read(c, remote, opts...)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if info, err := os.Stat(localPath); err == nil && info.IsDir() {
+		name, err := o.localName(f.Name())
+		if err != nil {
+			f.abort()
+			return err
+		}
+
+		localPath = filepath.Join(localPath, name)
+	}
+
+	fd, err := os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode().Perm())
+	if err != nil {
+		f.abort()
+		return err
+	}
+
+	defer func() {
+		if cerr := fd.Close(); err == nil {
+			err = cerr
+		}
+
+		if err != nil && !o.resume {
+			os.Remove(localPath)
+		}
+	}()
+
+	if _, err := io.Copy(fd, f); err != nil {
+		return err
+	}
+
+	if !f.ModTime().IsZero() && !f.AccessTime().IsZero() {
+		if err := os.Chtimes(localPath, f.AccessTime(), f.ModTime()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resumeFile does the work of ReadFile with WithResume, if there's already
+// some of the file at localPath to carry on from, reporting whether there was.
+func resumeFile(c *ssh.Client, remote, localPath string, o *options) (bool, error) {
+	if info, err := os.Stat(localPath); err == nil && info.IsDir() {
+		name, err := o.localName(path.Base(remote))
+		if err != nil {
+			return false, err
+		}
+
+		localPath = filepath.Join(localPath, name)
+	}
+
+	info, err := os.Stat(localPath)
+	if os.IsNotExist(err) || err == nil && info.Size() == 0 {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	size, err := remoteSize(c, remote)
+	if err != nil {
+		return true, err
+	}
+	if info.Size() > size {
+		return true, fmt.Errorf("%w: %s has %d bytes, but %s only has %d", ErrSizeMismatch, localPath, info.Size(), remote, size)
+	}
+
+	fd, err := os.OpenFile(localPath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return true, err
+	}
+	defer fd.Close()
+
+	s, err := c.NewSession()
+	if err != nil {
+		return true, err
+	}
+	defer s.Close()
+
+	stdout, err := s.StdoutPipe()
+	if err != nil {
+		return true, err
+	}
+
+	// tail counts from one, so this starts at the first byte that's missing.
+	if err := s.Start(shellquote.Join("tail", "-c", fmt.Sprintf("+%d", info.Size()+1), remote)); err != nil {
+		return true, err
+	}
+
+	n, err := io.Copy(fd, stdout)
+	if err != nil {
+		return true, err
+	}
+	if err := s.Wait(); err != nil {
+		return true, err
+	}
+
+	if info.Size()+n != size {
+		return true, fmt.Errorf("%w: %s has %d bytes after resuming; expected %d", ErrSizeMismatch, localPath, info.Size()+n, size)
+	}
+
+	if err := fd.Close(); err != nil {
+		return true, err
+	}
+
+	if o.preserve {
+		mtime, err := remoteModTime(c, remote)
+		if err != nil {
+			return true, err
+		}
+
+		if err := os.Chtimes(localPath, mtime, mtime); err != nil {
+			return true, err
+		}
+	}
+
+	return true, nil
+}
+
+// WriteReader writes the content of r to dir under the given name and mode,
+// like Write, for when the size of the content isn't known in advance. Since
+// the remote side has to be told the size before any content is sent, all of
+// r is read first, into a temporary file by default, or into memory with
+// WithMemoryBuffer. Either way the transfer doesn't start until r is
+// exhausted, and the whole stream takes up disk space or memory until it's
+// done.
+func WriteReader(c *ssh.Client, dir, name string, mode os.FileMode, r io.Reader, opts ...Option) ([]string, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.memoryBuffer {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+
+		return Write(c, dir, NewFile(name, int64(len(b)), mode, bytes.NewReader(b)), opts...)
+	}
+
+	t, cleanup, err := tempFile("", "scp-write-")
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	size, err := io.Copy(t, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := t.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return Write(c, dir, NewFile(name, size, mode, t), opts...)
+}
@@ -0,0 +1,211 @@
+package scp
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteFile(t *testing.T) {
+	c := newTestClient(t)
+	src := t.TempDir()
+	dst := t.TempDir()
+
+	p := writeLocal(t, src, "f", "hello")
+	if err := os.Chmod(p, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := WriteFile(c, dst, p); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := WriteFile(c, dst, p, WithRemoteName("g")); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readTree(t, dst); !sameTree(got, map[string]string{"f": "hello", "g": "hello"}) {
+		t.Fatalf("WriteFile created %q", got)
+	}
+
+	if info, err := os.Stat(filepath.Join(dst, "f")); err != nil || info.Mode() != 0600 {
+		t.Fatalf("WriteFile created %v, %v; expected mode 0600", info, err)
+	}
+
+	if _, err := WriteFile(c, dst, filepath.Join(src, "missing")); err == nil {
+		t.Fatal("WriteFile of a missing file succeeded")
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	c := newTestClient(t)
+	src := t.TempDir()
+	dst := t.TempDir()
+
+	p := writeLocal(t, src, "f", "hello")
+
+	mtime := time.Unix(1500000000, 0)
+	if err := os.Chtimes(p, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ReadFile(c, p, dst); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReadFile(c, p, filepath.Join(dst, "g"), WithPreserve()); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readTree(t, dst); !sameTree(got, map[string]string{"f": "hello", "g": "hello"}) {
+		t.Fatalf("ReadFile created %q", got)
+	}
+
+	if info, err := os.Stat(filepath.Join(dst, "g")); err != nil || !info.ModTime().Equal(mtime) {
+		t.Fatalf("ReadFile with WithPreserve created %v, %v; expected modification time %v", info.ModTime(), err, mtime)
+	}
+
+	if err := ReadFile(c, filepath.Join(src, "missing"), filepath.Join(dst, "missing")); err == nil {
+		t.Fatal("ReadFile of a missing file succeeded")
+	}
+	if _, err := os.Stat(filepath.Join(dst, "missing")); !os.IsNotExist(err) {
+		t.Fatalf("ReadFile of a missing file left %v behind", err)
+	}
+}
+
+func TestReadFileRemovesPartial(t *testing.T) {
+	c := newFakeClient(t, fakeSource(0, "C0644 10 f\n", "abc"))
+	dst := filepath.Join(t.TempDir(), "f")
+
+	if err := ReadFile(c, "f", dst, WithStallTimeout(100*time.Millisecond)); !errors.Is(err, ErrStalled) {
+		t.Fatalf("ReadFile of stalled content gave %v; expected ErrStalled", err)
+	}
+
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Fatalf("ReadFile of stalled content left %v behind", err)
+	}
+}
+
+func TestReadFileResume(t *testing.T) {
+	c := newTestClient(t)
+	src := t.TempDir()
+	dst := t.TempDir()
+
+	p := writeLocal(t, src, "f", "hello world")
+
+	// The start of the local copy differs from the remote file, to show
+	// that it isn't fetched again.
+	writeLocal(t, dst, "f", "HELLO")
+	if err := ReadFile(c, p, dst, WithResume()); err != nil {
+		t.Fatal(err)
+	}
+
+	writeLocal(t, dst, "g", "hello world")
+	if err := ReadFile(c, p, filepath.Join(dst, "g"), WithResume()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a local file, or with an empty one, the whole file is read.
+	writeLocal(t, dst, "h", "")
+	if err := ReadFile(c, p, filepath.Join(dst, "h"), WithResume()); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReadFile(c, p, filepath.Join(dst, "i"), WithResume()); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"f": "HELLO world", "g": "hello world", "h": "hello world", "i": "hello world"}
+	if got := readTree(t, dst); !sameTree(got, expected) {
+		t.Fatalf("ReadFile with WithResume gave %q; expected %q", got, expected)
+	}
+
+	writeLocal(t, dst, "j", "hello world, and more")
+	if err := ReadFile(c, p, filepath.Join(dst, "j"), WithResume()); !errors.Is(err, ErrSizeMismatch) {
+		t.Fatalf("ReadFile with WithResume onto a larger local file gave %v; expected ErrSizeMismatch", err)
+	}
+}
+
+func TestReadFileResumeKeepsPartial(t *testing.T) {
+	c := newFakeClient(t, fakeSource(0, "C0644 10 f\n", "abc"))
+	dst := filepath.Join(t.TempDir(), "f")
+
+	if err := ReadFile(c, "f", dst, WithResume(), WithStallTimeout(100*time.Millisecond)); !errors.Is(err, ErrStalled) {
+		t.Fatalf("ReadFile of stalled content gave %v; expected ErrStalled", err)
+	}
+
+	if b, err := ioutil.ReadFile(dst); err != nil || string(b) != "abc" {
+		t.Fatalf("ReadFile with WithResume of stalled content left %q, %v; expected what was received", b, err)
+	}
+}
+
+func TestWithNameSanitizer(t *testing.T) {
+	colons := WithNameSanitizer(func(name string) (string, error) {
+		return strings.ReplaceAll(name, ":", "_"), nil
+	})
+
+	c := newFakeClient(t, fakeSource(0, "C0644 3 a:b\n", "abc\x00"))
+	dst := t.TempDir()
+
+	if err := ReadFile(c, "a:b", dst, colons); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTree(t, dst); !sameTree(got, map[string]string{"a_b": "abc"}) {
+		t.Fatalf("ReadFile created %q", got)
+	}
+
+	// By default a control character is refused, and whatever a sanitizer
+	// comes up with still has to be a single element of a path.
+	c = newFakeClient(t, fakeSource(0, "C0644 3 a\x1bb\n", "abc\x00"))
+	if err := ReadFile(c, "a", dst); !errors.Is(err, ErrUnsafeFilename) {
+		t.Fatalf("ReadFile of a name with a control character gave %v; expected ErrUnsafeFilename", err)
+	}
+
+	escape := WithNameSanitizer(func(name string) (string, error) { return "../" + name, nil })
+	if err := ReadFile(c, "a", dst, escape); !errors.Is(err, ErrUnsafeFilename) {
+		t.Fatalf("ReadFile with a sanitizer giving a path gave %v; expected ErrUnsafeFilename", err)
+	}
+
+	if got := readTree(t, dst); len(got) != 1 {
+		t.Fatalf("refused names left %q behind", got)
+	}
+
+	// A Sink's names go through it too.
+	root := t.TempDir()
+	c = serveClient(t, root, colons)
+
+	if _, err := Write(c, "/", NewFile("c:d", 1, 0644, strings.NewReader("x"))); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTree(t, root); !sameTree(got, map[string]string{"c_d": "x"}) {
+		t.Fatalf("Sink created %q", got)
+	}
+}
+
+func TestWriteReader(t *testing.T) {
+	c := newTestClient(t)
+	dir := t.TempDir()
+
+	content := strings.Repeat("streamed ", 1000)
+
+	if _, err := WriteReader(c, dir, "a", 0644, strings.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := WriteReader(c, dir, "b", 0644, strings.NewReader(content), WithMemoryBuffer()); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readTree(t, dir); !sameTree(got, map[string]string{"a": content, "b": content}) {
+		t.Fatal("WriteReader didn't send the whole stream")
+	}
+
+	boom := errors.New("boom")
+	if _, err := WriteReader(c, dir, "c", 0644, &failingReader{n: 5, err: boom}); err != boom {
+		t.Fatalf("WriteReader with a failing reader gave %v", err)
+	}
+
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "c")); !os.IsNotExist(err) {
+		t.Fatalf("WriteReader with a failing reader sent %q", b)
+	}
+}
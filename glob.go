@@ -0,0 +1,115 @@
+package scp
+
+import (
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Glob iterates over the files matched by a pattern given to ReadGlob, all of
+// which are sent over a single session.
+type Glob struct {
+	o       *options
+	r       *receiver
+	pattern string
+	done    bool
+
+	// matched is set once Next has handed out a file.
+	matched bool
+}
+
+// ReadGlob starts reading every file matched by pattern, which is expanded by
+// the remote shell, so it can use the usual wildcards (*, ? and [...]). All
+// other characters in it are taken literally.
+//
+// Anything the remote scp can't send, like a directory that matches, is
+// skipped over with a warning, available from Warnings. If the pattern
+// matches nothing, the remote scp sends a warning about the pattern itself,
+// and Next returns it straight away as a ProtocolError wrapping ErrNoMatch.
+// The Glob must be closed once it's no longer needed.
+func ReadGlob(c *ssh.Client, pattern string, opts ...Option) (*Glob, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	o.emit(Event{Type: EventStart, Name: pattern})
+	if o.callbackErr != nil {
+		o.emit(Event{Type: EventDone, Name: pattern, Err: o.callbackErr})
+		return nil, o.callbackErr
+	}
+
+	flags := "-qf"
+	if o.preserve {
+		flags = "-pqf"
+	}
+
+	r, err := startReceiver(c, o, flags, pattern, true)
+	if err != nil {
+		o.emit(Event{Type: EventDone, Name: pattern, Err: err})
+		return nil, err
+	}
+
+	return &Glob{o: o, r: r, pattern: pattern}, nil
+}
+
+// Next returns the next file, or io.EOF once there are no more. The content of
+// a file comes straight off the session, so it has to be read (or abandoned)
+// before Next is called again, at which point whatever is left of it is
+// discarded. Once Next has returned an error other than io.EOF, the Glob can't
+// be used for anything but closing.
+func (g *Glob) Next() (*File, error) {
+	if g.done {
+		return nil, io.EOF
+	}
+
+	f, err := g.r.next()
+	if err == io.EOF && !g.matched && len(g.r.warnings) == 1 && isNoSuchFile(g.r.firstWarning.Raw) {
+		pe := *g.r.firstWarning
+		pe.noMatch = true
+		err = &pe
+	}
+	if err != nil {
+		g.finish(err)
+	} else {
+		g.matched = true
+	}
+
+	return f, err
+}
+
+// Warnings returns the warnings the remote side has sent so far, for files it
+// couldn't send and the like.
+func (g *Glob) Warnings() []string {
+	return g.r.warnings
+}
+
+// Close shuts the session down, whether or not every file has been read.
+func (g *Glob) Close() error {
+	g.finish(nil)
+	g.r.close()
+
+	return nil
+}
+
+// isNoSuchFile reports whether msg is the message OpenSSH's scp sends for a
+// path that doesn't exist, which is what a pattern the remote shell couldn't
+// expand is left as.
+func isNoSuchFile(msg string) bool {
+	return strings.HasSuffix(msg, ": No such file or directory")
+}
+
+// finish emits the Done event, the first time it's called.
+func (g *Glob) finish(err error) {
+	if g.done {
+		return
+	}
+	g.done = true
+
+	if err == io.EOF {
+		err = nil
+	}
+
+	g.o.emit(Event{Type: EventDone, Name: g.pattern, Err: err})
+}
@@ -0,0 +1,140 @@
+package scp
+
+import (
+	"errors"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// globAll reads every file matched by pattern, returning their contents by
+// name and the warnings sent.
+func globAll(t testing.TB, g *Glob) (map[string]string, []string) {
+	t.Helper()
+	defer g.Close()
+
+	got := map[string]string{}
+
+	for {
+		f, err := g.Next()
+		if err == io.EOF {
+			return got, g.Warnings()
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		got[f.Name()] = readAll(t, f)
+	}
+}
+
+func TestReadGlob(t *testing.T) {
+	c := newTestClient(t)
+	dir := t.TempDir()
+
+	writeLocal(t, dir, "a.txt", "aaa")
+	writeLocal(t, dir, "b.log", "bb")
+	writeLocal(t, dir, "my file.log", "spaced")
+
+	g, err := ReadGlob(c, filepath.Join(dir, "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := globAll(t, g); !sameTree(got, map[string]string{"a.txt": "aaa"}) {
+		t.Fatalf("ReadGlob gave %q", got)
+	}
+
+	g, err = ReadGlob(c, filepath.Join(dir, "my f*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := globAll(t, g); !sameTree(got, map[string]string{"my file.log": "spaced"}) {
+		t.Fatalf("ReadGlob with a space in the pattern gave %q", got)
+	}
+
+	// The stand-in scp only serves a single path, so a pattern matching
+	// several files needs the real thing.
+	scp, err := exec.LookPath("scp")
+	if err != nil {
+		t.Skip("no scp to expand a pattern matching several files")
+	}
+
+	g, err = ReadGlob(c, filepath.Join(dir, "*.log"), WithSourceSCPPath(scp))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := globAll(t, g); !sameTree(got, map[string]string{"b.log": "bb", "my file.log": "spaced"}) {
+		t.Fatalf("ReadGlob gave %q", got)
+	}
+
+	g, err = ReadGlob(c, filepath.Join(dir, "*.none"), WithSourceSCPPath(scp))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer g.Close()
+
+	if _, err := g.Next(); !errors.Is(err, ErrNoMatch) {
+		t.Fatalf("ReadGlob of a pattern matching nothing gave %v; expected ErrNoMatch", err)
+	}
+}
+
+// warnOnly returns a handler that plays `scp -f` for a pattern the remote scp
+// can send nothing for, sending just the warning msg and exiting with 1 as
+// OpenSSH's scp does.
+func warnOnly(msg string) testHandler {
+	return func(cmd string, ch ssh.Channel) int {
+		io.ReadFull(ch, make([]byte, 1))
+		io.WriteString(ch, "\x01"+msg+"\n")
+
+		return 1
+	}
+}
+
+func TestReadGlobNoMatch(t *testing.T) {
+	const msg = "scp: /d/*.none: No such file or directory"
+
+	g, err := ReadGlob(newFakeClient(t, warnOnly(msg)), "/d/*.none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	_, err = g.Next()
+	if !errors.Is(err, ErrNoMatch) {
+		t.Fatalf("Next for a pattern matching nothing gave %v; expected ErrNoMatch", err)
+	}
+
+	var pe *ProtocolError
+	if !errors.As(err, &pe) || pe.Raw != msg || pe.Severity != SeverityWarning {
+		t.Fatalf("Next for a pattern matching nothing gave %#v; expected the warning that was sent", err)
+	}
+	if warnings := g.Warnings(); len(warnings) != 1 || warnings[0] != msg {
+		t.Fatalf("warnings were %q", warnings)
+	}
+
+	// A file that can't be read is just a file that's skipped.
+	g, err = ReadGlob(newFakeClient(t, warnOnly("scp: /d/secret.txt: Permission denied")), "/d/*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, warnings := globAll(t, g); len(got) != 0 || len(warnings) != 1 {
+		t.Fatalf("ReadGlob of an unreadable file gave %q and warnings %q; expected one warning", got, warnings)
+	}
+
+	// As is one that disappears after others have been sent.
+	g, err = ReadGlob(newFakeClient(t, fakeSource(1, "C0644 5 a.txt\n", "hello\x00\x01scp: /d/b.txt: No such file or directory\n")), "/d/*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, warnings := globAll(t, g); !sameTree(got, map[string]string{"a.txt": "hello"}) || len(warnings) != 1 {
+		t.Fatalf("ReadGlob gave %q and warnings %q", got, warnings)
+	}
+}
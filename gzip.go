@@ -0,0 +1,46 @@
+package scp
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+)
+
+// NewGzipFile constructs a File whose content is r compressed with gzip. The
+// name is used as given, so it should usually end in ".gz".
+//
+// Because the size has to be known before the transfer starts, the compressed
+// content is first written to a temporary file, which is removed when the
+// returned File is closed.
+func NewGzipFile(name string, mode os.FileMode, r io.Reader) (*File, error) {
+	t, cleanup, err := tempFile("", "scp-gzip-")
+	if err != nil {
+		return nil, err
+	}
+
+	zw := gzip.NewWriter(t)
+
+	if _, err := io.Copy(zw, r); err != nil {
+		cleanup()
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	size, err := t.Seek(0, io.SeekCurrent)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	if _, err := t.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	f := NewFile(name, size, mode, t)
+	f.close = cleanup
+
+	return f, nil
+}
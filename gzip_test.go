@@ -0,0 +1,95 @@
+package scp
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// gunzip returns the decompressed content of the gzip file at path.
+func gunzip(t testing.TB, path string) string {
+	t.Helper()
+
+	fd, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+
+	zr, err := gzip.NewReader(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("decompressing %s: %v", path, err)
+	}
+
+	return string(b)
+}
+
+func TestWithGzip(t *testing.T) {
+	c := newTestClient(t)
+	dir := t.TempDir()
+
+	content := strings.Repeat("compressible ", 1000)
+
+	if _, err := Write(c, dir, NewFile("f", int64(len(content)), 0644, strings.NewReader(content)), WithGzip()); err != nil {
+		t.Fatal(err)
+	}
+
+	p := filepath.Join(dir, "f.gz")
+	if info, err := os.Stat(p); err != nil || info.Size() >= int64(len(content)) {
+		t.Fatalf("compressed file is %v, %v", info, err)
+	}
+
+	if got := gunzip(t, p); got != content {
+		t.Fatalf("compressed file decompresses to %d bytes", len(got))
+	}
+}
+
+func TestWithGzipDir(t *testing.T) {
+	c := newTestClient(t)
+	dst := t.TempDir()
+
+	if _, err := WriteDir(c, dst, makeTree(t), WithGzip()); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := gunzip(t, filepath.Join(dst, "tree", "a.txt.gz")); got != "aaa" {
+		t.Errorf("a.txt.gz decompresses to %q", got)
+	}
+	if got := gunzip(t, filepath.Join(dst, "tree", "sub", "b.txt.gz")); got != "bb" {
+		t.Errorf("sub/b.txt.gz decompresses to %q", got)
+	}
+
+	// A Source compresses what it serves the same way.
+	src := t.TempDir()
+	writeLocal(t, src, "f", "hello")
+
+	s, err := NewSource(filepath.Join(src, "f"), WithGzip())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = newFakeClient(t, func(cmd string, ch ssh.Channel) int {
+		if _, err := s.Serve(ch); err != nil {
+			return 1
+		}
+
+		return 0
+	})
+
+	out := t.TempDir()
+	if err := ReadFile(c, "f", out); err != nil {
+		t.Fatal(err)
+	}
+	if got := gunzip(t, filepath.Join(out, "f.gz")); got != "hello" {
+		t.Errorf("file served decompresses to %q", got)
+	}
+}
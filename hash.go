@@ -0,0 +1,32 @@
+package scp
+
+import (
+	"errors"
+	"hash"
+)
+
+// ErrIncompleteDigest is returned by File.Sum when the content of the file
+// hasn't been read in full, so the digest doesn't cover all of it.
+var ErrIncompleteDigest = errors.New("digest incomplete; content not fully read")
+
+// digest tracks a hash being computed over a file's content as it's read.
+type digest struct {
+	h   hash.Hash
+	sum []byte
+}
+
+// Sum returns the digest of the file's content computed by the hash given to
+// WithHash. It's only available once the content has been read to the end
+// (i.e. the Reader has returned io.EOF); before that, or if the transfer
+// failed part way through, ErrIncompleteDigest is returned.
+func (f File) Sum() ([]byte, error) {
+	if f.digest == nil {
+		return nil, errors.New("no hash was attached to the transfer")
+	}
+
+	if f.digest.sum == nil {
+		return nil, ErrIncompleteDigest
+	}
+
+	return f.digest.sum, nil
+}
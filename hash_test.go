@@ -0,0 +1,85 @@
+package scp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"testing"
+)
+
+func TestWithHash(t *testing.T) {
+	c := newTestClient(t)
+	p := writeLocal(t, t.TempDir(), "f", "hello")
+
+	f, err := Read(c, p, WithHash(sha256.New))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Sum(); err != ErrIncompleteDigest {
+		t.Fatalf("Sum before reading gave %v; expected ErrIncompleteDigest", err)
+	}
+
+	readAll(t, f)
+
+	sum, err := f.Sum()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := sha256.Sum256([]byte("hello"))
+	if !bytes.Equal(sum, expected[:]) {
+		t.Fatalf("Sum gave %x; expected %x", sum, expected)
+	}
+
+	f, err = Read(c, p, WithHash(sha256.New))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	ioutil.ReadAll(f)
+
+	if _, err := f.Sum(); err != ErrIncompleteDigest {
+		t.Fatalf("Sum of an abandoned transfer gave %v; expected ErrIncompleteDigest", err)
+	}
+
+	f, err = Read(c, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, f)
+
+	if _, err := f.Sum(); err == nil {
+		t.Fatal("Sum without WithHash succeeded")
+	}
+
+	// Transfers sharing the option each get a hash of their own, even when
+	// their content is read at the same time.
+	q := writeLocal(t, t.TempDir(), "g", "world")
+	client := NewClient(c, WithHash(sha256.New))
+
+	f, err = client.Read(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := client.Read(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range []struct {
+		f       *File
+		content string
+	}{{f, "hello"}, {g, "world"}} {
+		readAll(t, r.f)
+
+		sum, err := r.f.Sum()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if expected := sha256.Sum256([]byte(r.content)); !bytes.Equal(sum, expected[:]) {
+			t.Errorf("Sum of %q gave %x; expected %x", r.content, sum, expected)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package scp
+
+import (
+	"fmt"
+	"path"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// WriteResult is the outcome of writing to one of the hosts given to
+// WriteMany.
+type WriteResult struct {
+	Client   *ssh.Client
+	Warnings []string
+	Err      error
+}
+
+// WriteMany writes a file to the same directory on each of the given clients,
+// running up to concurrency transfers at once (or all of them, if concurrency
+// is less than one). Since a File can only be read once, fileFactory is called
+// to produce a fresh one for each client, and it's closed once that transfer
+// is done.
+//
+// A failure on one host doesn't stop the others. The results are returned in
+// the same order as clients.
+//
+// With WithManifest, each entry has its Host set to the address of the host
+// the file was sent to. With WithResumeFrom, a host is only sent the file if
+// the manifest doesn't already list it for that host.
+func WriteMany(clients []*ssh.Client, dir string, fileFactory func() *File, concurrency int, opts ...Option) []WriteResult {
+	if concurrency < 1 {
+		concurrency = len(clients)
+	}
+
+	results := make([]WriteResult, len(clients))
+	sem := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+
+	// An invalid option is reported by each Write below.
+	var m *Manifest
+	if o, err := newOptions(opts); err == nil {
+		m = o.manifest
+	}
+	var mu sync.Mutex
+
+	for i, c := range clients {
+		wg.Add(1)
+
+		go func(i int, c *ssh.Client) {
+			defer wg.Done()
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			results[i] = WriteResult{Client: c}
+
+			// A panic in the factory would otherwise take down every
+			// other transfer along with this one.
+			var f *File
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						results[i].Err = fmt.Errorf("file factory panicked: %v", r)
+					}
+				}()
+
+				f = fileFactory()
+			}()
+			if f == nil {
+				if results[i].Err == nil {
+					results[i].Err = fmt.Errorf("file factory returned nil")
+				}
+
+				return
+			}
+			defer f.Close()
+
+			if m == nil {
+				results[i].Warnings, results[i].Err = Write(c, dir, f, opts...)
+				return
+			}
+
+			host := c.RemoteAddr().String()
+
+			mu.Lock()
+			own := m.forHost(host)
+			mu.Unlock()
+			n := len(own.Files)
+
+			// WithManifest leaves WithResumeFrom's effect as it was.
+			results[i].Warnings, results[i].Err = Write(c, dir, f, append(opts[:len(opts):len(opts)], WithManifest(own))...)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			for _, e := range own.Files[n:] {
+				e.Host = host
+				m.Files = append(m.Files, e)
+			}
+		}(i, c)
+	}
+
+	wg.Wait()
+
+	return results
+}
+
+// forHost returns a manifest for one of WriteMany's transfers to host, holding
+// the entries m already has for it. The transfer adds its own after them.
+func (m *Manifest) forHost(host string) *Manifest {
+	own := &Manifest{}
+	for _, e := range m.Files {
+		if e.Host == host {
+			e.Host = ""
+			own.Files = append(own.Files, e)
+		}
+	}
+
+	return own
+}
+
+// ReadResult is the outcome of reading one of the files given to ReadMany.
+type ReadResult struct {
+	Path string
+	Err  error
+}
+
+// ReadMany reads each of the remote files into the local directory dir, as
+// ReadFile does, running up to concurrency transfers at once (or all of them,
+// if concurrency is less than one). Each transfer has a session of its own, so
+// they run side by side over c without getting in each other's way. Files
+// are created in dir under their base names, so a file with the same base
+// name as an earlier one isn't read at all; its result has an error wrapping
+// ErrDuplicateName.
+//
+// A failure on one file doesn't stop the others. If the connection itself
+// fails, every transfer that hasn't finished fails with it. The results are
+// returned in the same order as files.
+func ReadMany(c *ssh.Client, files []string, dir string, concurrency int, opts ...Option) []ReadResult {
+	if concurrency < 1 {
+		concurrency = len(files)
+	}
+
+	results := make([]ReadResult, len(files))
+	sem := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+
+	seen := make(map[string]string)
+
+	for i, file := range files {
+		name := path.Base(file)
+		if first, ok := seen[name]; ok {
+			results[i] = ReadResult{Path: file, Err: fmt.Errorf("%w: %s and %s would both be read into %s", ErrDuplicateName, first, file, name)}
+			continue
+		}
+		seen[name] = file
+
+		wg.Add(1)
+
+		go func(i int, file string) {
+			defer wg.Done()
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			results[i] = ReadResult{Path: file, Err: ReadFile(c, file, dir, opts...)}
+		}(i, file)
+	}
+
+	wg.Wait()
+
+	return results
+}
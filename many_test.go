@@ -0,0 +1,180 @@
+package scp
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestWriteMany(t *testing.T) {
+	clients := []*ssh.Client{newTestClient(t), newTestClient(t)}
+	dirs := []string{t.TempDir(), t.TempDir()}
+
+	// Both servers share the local filesystem, so each gets a directory of
+	// its own by way of WithArgvHook.
+	calls := 0
+	factory := func() *File {
+		calls++
+		return NewFile("f", 5, 0644, strings.NewReader("hello"))
+	}
+
+	n := 0
+	hook := WithArgvHook(func(argv []string) []string {
+		argv[len(argv)-1] = dirs[n]
+		n++
+
+		return argv
+	})
+
+	results := WriteMany(clients, "unused", factory, 1, hook)
+	if len(results) != 2 || calls != 2 {
+		t.Fatalf("WriteMany gave %d results from %d files; expected 2", len(results), calls)
+	}
+
+	for i, r := range results {
+		if r.Client != clients[i] || r.Err != nil {
+			t.Errorf("result %d is %+v", i, r)
+		}
+
+		if b, err := ioutil.ReadFile(filepath.Join(dirs[i], "f")); err != nil || string(b) != "hello" {
+			t.Errorf("host %d has %q, %v", i, b, err)
+		}
+	}
+
+	results = WriteMany(clients, dirs[0], func() *File { panic("boom") }, 0)
+	for i, r := range results {
+		if r.Err == nil || !strings.Contains(r.Err.Error(), "panicked") {
+			t.Errorf("result %d with a panicking factory is %v", i, r.Err)
+		}
+	}
+
+	results = WriteMany(clients, dirs[0], func() *File { return nil }, 0)
+	for i, r := range results {
+		if r.Err == nil {
+			t.Errorf("result %d with a factory returning nil succeeded", i)
+		}
+	}
+}
+
+func TestWriteManyManifest(t *testing.T) {
+	sink := func(cmd string, ch ssh.Channel) int {
+		s, err := NewSinkFunc(func(f *File) error {
+			_, err := ioutil.ReadAll(f)
+			return err
+		})
+		if err != nil {
+			return 1
+		}
+
+		if _, err := s.Serve(ch); err != nil {
+			return 1
+		}
+
+		return 0
+	}
+
+	clients := make([]*ssh.Client, 8)
+	for i := range clients {
+		clients[i] = newFakeClient(t, sink)
+	}
+	factory := func() *File {
+		return NewFile("f", 5, 0644, strings.NewReader("hello"))
+	}
+
+	// Every transfer runs at once, each adding to the same manifest.
+	var m Manifest
+	for i, r := range WriteMany(clients, "/", factory, 0, WithManifest(&m)) {
+		if r.Err != nil {
+			t.Errorf("result %d is %v", i, r.Err)
+		}
+	}
+
+	if len(m.Files) != len(clients) {
+		t.Fatalf("manifest has %+v; expected an entry for each of %d hosts", m.Files, len(clients))
+	}
+
+	hosts := map[string]bool{}
+	for _, e := range m.Files {
+		if e.Path != "f" || e.Size != 5 {
+			t.Errorf("manifest has %+v", e)
+		}
+
+		hosts[e.Host] = true
+	}
+	for i, c := range clients {
+		if !hosts[c.RemoteAddr().String()] {
+			t.Errorf("manifest has no entry for host %d", i)
+		}
+	}
+
+	// Resuming with it sends the file to a host it doesn't list, and only
+	// that one.
+	extra := newFakeClient(t, sink)
+
+	for i, r := range WriteMany(append(clients, extra), "/", factory, 1, WithResumeFrom(&m)) {
+		if r.Err != nil {
+			t.Errorf("resumed result %d is %v", i, r.Err)
+		}
+	}
+
+	if len(m.Files) != len(clients)+1 || m.Files[len(clients)].Host != extra.RemoteAddr().String() {
+		t.Fatalf("resumed manifest has %+v; expected one more entry, for the new host", m.Files)
+	}
+}
+
+func TestReadMany(t *testing.T) {
+	c := newTestClient(t)
+	src := t.TempDir()
+	dst := t.TempDir()
+
+	files := []string{
+		writeLocal(t, src, "a", "aaa"),
+		filepath.Join(src, "missing"),
+		writeLocal(t, src, "b", "bb"),
+	}
+
+	results := ReadMany(c, files, dst, 2)
+	if len(results) != len(files) {
+		t.Fatalf("ReadMany gave %d results for %d files", len(results), len(files))
+	}
+
+	for i, r := range results {
+		if r.Path != files[i] {
+			t.Errorf("result %d is for %s; expected %s", i, r.Path, files[i])
+		}
+
+		if (r.Err != nil) != (i == 1) {
+			t.Errorf("result %d has error %v", i, r.Err)
+		}
+	}
+
+	if got := readTree(t, dst); !sameTree(got, map[string]string{"a": "aaa", "b": "bb"}) {
+		t.Fatalf("ReadMany created %q", got)
+	}
+
+	// Files that would be read into the same place.
+	other := t.TempDir()
+	dst = t.TempDir()
+
+	files = []string{
+		writeLocal(t, src, "c", "first"),
+		writeLocal(t, other, "c", "second"),
+		writeLocal(t, other, "d", "d"),
+	}
+
+	results = ReadMany(c, files, dst, 0)
+	if results[0].Err != nil || results[2].Err != nil {
+		t.Fatalf("ReadMany of distinct names gave %v and %v", results[0].Err, results[2].Err)
+	}
+	if !errors.Is(results[1].Err, ErrDuplicateName) {
+		t.Fatalf("ReadMany of a duplicate name gave %v; expected ErrDuplicateName", results[1].Err)
+	}
+
+	if got := readTree(t, dst); !sameTree(got, map[string]string{"c": "first", "d": "d"}) {
+		t.Fatalf("ReadMany created %q", got)
+	}
+}
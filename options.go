@@ -0,0 +1,1070 @@
+package scp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"fknsrs.biz/p/scp/protocol"
+	"github.com/kballard/go-shellquote"
+	"golang.org/x/crypto/ssh"
+)
+
+// Option configures optional behaviour of a transfer. Options are passed to
+// the transfer functions and are applied in order.
+type Option func(*options)
+
+type options struct {
+	statModTime     bool
+	skipHeaderAck   bool
+	skipFinalStatus bool
+	verifySize      bool
+	checkWritable   bool
+
+	verifyPlacement bool
+	gzip            bool
+	preserve        bool
+
+	tempFile bool
+	tempDir  string
+
+	remoteName   string
+	memoryBuffer bool
+
+	resume bool
+
+	directories bool
+
+	continueOnError bool
+	manifest        *Manifest
+	resumeFrom      bool
+	pipelining      bool
+	barrier         bool
+	barrierSync     bool
+
+	forceMode bool
+	mode      os.FileMode
+
+	forceDirMode bool
+	dirMode      os.FileMode
+
+	scpPath       string
+	sourceSCPPath string
+	sinkSCPPath   string
+	extraArgs     []string
+
+	legacyProtocol    bool
+	noStrictFilenames bool
+
+	nice     bool
+	niceness int
+
+	ctx context.Context
+
+	events      chan<- Event
+	eventsBlock bool
+
+	transferID string
+
+	meter *meter
+	rate  rateEstimator
+
+	progress         func(transferred, total int64)
+	progressInterval time.Duration
+	progressLast     time.Time
+
+	// progressHeld is set while the call for a file whose content has all
+	// been moved is held back, until it's known to have gone through; its
+	// total is progressHeldTotal.
+	progressHeld      bool
+	progressHeldTotal int64
+
+	status *Status
+
+	// started is when the transfer's start event was emitted.
+	started time.Time
+
+	limiter *limiter
+
+	teardown Teardown
+	symlinks Symlinks
+	maxDepth int
+
+	stallTimeout time.Duration
+
+	pipeBufferSize int
+	bufferSize     int
+
+	argvHook func(argv []string) []string
+	fileHook func(f *File, target string) (string, error)
+
+	nameSanitizer func(name string) (string, error)
+
+	trace io.Writer
+
+	newHash func() hash.Hash
+
+	checksumHash    func() hash.Hash
+	checksumCommand string
+
+	// err records an invalid option, which is reported when the options
+	// are used.
+	err error
+
+	// callbackErr records a panic in caller-supplied code, which aborts the
+	// transfer.
+	callbackErr error
+}
+
+// Teardown selects how a session is shut down once a transfer is complete.
+type Teardown int
+
+const (
+	// TeardownDrainWait reads and discards anything else the remote scp
+	// sends, waits for it to exit, and then closes the session. An unclean
+	// exit is reported as an error. This is the default.
+	TeardownDrainWait Teardown = iota
+	// TeardownClose closes the session as soon as the transfer is complete,
+	// without waiting for the remote scp to exit. It's for servers that never
+	// close their side of the session, at the cost of not finding out
+	// whether the remote scp exited cleanly.
+	TeardownClose
+)
+
+// Symlinks selects what happens to symbolic links found when sending local
+// files. The protocol has no way to describe a link, so none of the choices
+// recreate one on the remote side.
+type Symlinks int
+
+const (
+	// SymlinksFollow sends whatever a link points to in its place, as `scp
+	// -r` does. A link to a directory is sent as a directory, and a link
+	// that points nowhere is an error. This is the default.
+	SymlinksFollow Symlinks = iota
+	// SymlinksSkip leaves links out, reporting each one with a warning.
+	SymlinksSkip
+	// SymlinksAsFiles sends each link as a regular file with mode 0644,
+	// whose content is the path the link points to, so that at least the
+	// link itself is recorded.
+	SymlinksAsFiles
+)
+
+func newOptions(opts []Option) (*options, error) {
+	o := &options{ctx: context.Background()}
+
+	for _, fn := range opts {
+		fn(o)
+	}
+
+	if o.err != nil {
+		return nil, o.err
+	}
+
+	if o.transferID == "" {
+		o.transferID = newTransferID()
+	}
+
+	if o.meter != nil && o.meter.w == nil {
+		o.meter = nil
+	}
+
+	return o, nil
+}
+
+// transfer returns a copy of o for one of the transfers run with it by
+// something that's used over and over, such as a Sink or Source, which may
+// be serving several clients at once. The state each transfer keeps as it
+// goes is its own, so a callback that panics only ends the one transfer.
+func (o *options) transfer() *options {
+	t := *o
+
+	t.started = time.Time{}
+	t.progressLast = time.Time{}
+	t.progressHeld = false
+	t.rate = rateEstimator{}
+	t.callbackErr = nil
+
+	if o.meter != nil {
+		t.meter = &meter{w: o.meter.w, interval: o.meter.interval}
+	}
+	if o.limiter != nil {
+		t.limiter = &limiter{rate: o.limiter.rate}
+	}
+
+	return &t
+}
+
+// command builds the remote command line that runs program with the given
+// flags on path.
+func (o *options) command(program, flags, path string) (string, error) {
+	return o.commandLine(program, flags, path, false)
+}
+
+// globCommand is like command, but leaves the wildcards in pattern for the
+// remote shell to expand. Everything else in it is escaped.
+func (o *options) globCommand(program, flags, pattern string) (string, error) {
+	return o.commandLine(program, flags, pattern, true)
+}
+
+func (o *options) commandLine(program, flags, path string, glob bool) (string, error) {
+	var args []string
+
+	if o.nice {
+		args = append(args, "nice", "-n", strconv.Itoa(o.niceness), "ionice", "-c3")
+	}
+
+	args = append(args, program)
+
+	if o.legacyProtocol {
+		args = append(args, "-O")
+	}
+	if o.noStrictFilenames {
+		args = append(args, "-T")
+	}
+
+	args = append(args, o.extraArgs...)
+	args = append(args, flags, path)
+
+	if o.argvHook != nil {
+		if err := o.safely("argv hook", func() { args = o.argvHook(args) }); err != nil {
+			return "", err
+		}
+	}
+
+	if !glob {
+		cmd := shellquote.Join(args...)
+		o.traceCommand(cmd)
+
+		return cmd, nil
+	}
+
+	// The pattern is still the last argument unless the argv hook has done
+	// something unusual, in which case it's on its own.
+	last, err := quoteGlob(args[len(args)-1])
+	if err != nil {
+		return "", err
+	}
+
+	cmd := strings.TrimSpace(shellquote.Join(args[:len(args)-1]...) + " " + last)
+	o.traceCommand(cmd)
+
+	return cmd, nil
+}
+
+// quoteGlob escapes everything in pattern that the shell would treat
+// specially, except for the wildcards *, ? and [...]. A newline can't be
+// escaped that way, so a pattern containing one is refused.
+func quoteGlob(pattern string) (string, error) {
+	if strings.ContainsRune(pattern, '\n') {
+		return "", fmt.Errorf("pattern %q contains a newline", pattern)
+	}
+
+	var b strings.Builder
+	for _, r := range pattern {
+		switch {
+		case strings.ContainsRune("*?[]", r):
+		case r < 0x80 && !strings.ContainsRune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./,:@%+=", r):
+			b.WriteByte('\\')
+		}
+
+		b.WriteRune(r)
+	}
+
+	return b.String(), nil
+}
+
+// watch closes s if the transfer's context is done before the returned
+// function is called. Closing the session is the only way to unblock whatever
+// is waiting on the remote side.
+func (o *options) watch(s *ssh.Session) (stop func()) {
+	if o.ctx.Done() == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-o.ctx.Done():
+			s.Close()
+		case <-done:
+		}
+	}()
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// contextErr returns the context's error in place of err once the context is
+// done, since err is then most likely the result of watch closing the session.
+func (o *options) contextErr(err error) error {
+	if err != nil && o.ctx.Err() != nil {
+		return o.ctx.Err()
+	}
+
+	return err
+}
+
+// throttle waits for long enough that moving n more bytes of content keeps
+// the transfer within the rate set by WithRateLimit, or until the transfer's
+// context is done.
+func (o *options) throttle(n int) error {
+	if o.limiter == nil {
+		return nil
+	}
+
+	d := o.limiter.delay(n, time.Now())
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-o.ctx.Done():
+		return o.ctx.Err()
+	}
+}
+
+// recoverCallback is deferred around calls into caller-supplied code. A panic
+// is turned into an error, which aborts the transfer at the next opportunity,
+// rather than crashing the goroutine it happened on and leaving the session
+// open.
+func (o *options) recoverCallback(what string) {
+	if r := recover(); r != nil {
+		o.callbackErr = fmt.Errorf("%s panicked: %v", what, r)
+	}
+}
+
+// safely calls fn, returning an error if it panics.
+func (o *options) safely(what string, fn func()) error {
+	func() {
+		defer o.recoverCallback(what)
+		fn()
+	}()
+
+	return o.callbackErr
+}
+
+// sourceProgram returns the remote scp program to run when reading.
+func (o *options) sourceProgram() string {
+	if o.sourceSCPPath != "" {
+		return o.sourceSCPPath
+	}
+	if o.scpPath != "" {
+		return o.scpPath
+	}
+
+	return "scp"
+}
+
+// sinkProgram returns the remote scp program to run when writing.
+func (o *options) sinkProgram() string {
+	if o.sinkSCPPath != "" {
+		return o.sinkSCPPath
+	}
+	if o.scpPath != "" {
+		return o.scpPath
+	}
+
+	return "scp"
+}
+
+// localName returns the name under which something the other side calls name
+// is created locally, as set by WithNameSanitizer.
+func (o *options) localName(name string) (string, error) {
+	if o.nameSanitizer == nil {
+		if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+			return "", fmt.Errorf("%w: %q contains a control character", ErrUnsafeFilename, name)
+		}
+
+		return name, nil
+	}
+
+	var local string
+	var err error
+	if cerr := o.safely("name sanitizer", func() { local, err = o.nameSanitizer(name) }); cerr != nil {
+		return "", cerr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err := protocol.CheckName(local); err != nil {
+		return "", fmt.Errorf("name sanitizer turned %q into %q: %w", name, local, err)
+	}
+
+	return local, nil
+}
+
+// DefaultMaxDepth is the number of levels of directories that can be
+// transferred when WithMaxDepth isn't used.
+const DefaultMaxDepth = 100
+
+// depthLimit returns the number of levels of directories allowed.
+func (o *options) depthLimit() int {
+	if o.maxDepth > 0 {
+		return o.maxDepth
+	}
+
+	return DefaultMaxDepth
+}
+
+// defaultChunkSize is the size of the buffer content is copied through when
+// WithBufferSize isn't used.
+const defaultChunkSize = 32 * 1024
+
+// chunkSize returns the size of the buffer to copy content through.
+func (o *options) chunkSize() int {
+	if o.bufferSize > 0 {
+		return o.bufferSize
+	}
+
+	return defaultChunkSize
+}
+
+// readWriter wraps the session's pipes in buffers of the configured size.
+func (o *options) readWriter(stdout io.Reader, stdin io.Writer) *bufio.ReadWriter {
+	if o.pipeBufferSize > 0 {
+		return bufio.NewReadWriter(bufio.NewReaderSize(stdout, o.pipeBufferSize), bufio.NewWriterSize(stdin, o.pipeBufferSize))
+	}
+
+	return bufio.NewReadWriter(bufio.NewReader(stdout), bufio.NewWriter(stdin))
+}
+
+// WithStatModTime makes Read and Stat look up the modification time of the
+// remote file by running stat in a separate session, so that File.ModTime
+// returns it. This works without needing the remote scp to preserve times, but
+// it does require a stat command on the remote host.
+func WithStatModTime() Option {
+	return func(o *options) {
+		o.statModTime = true
+	}
+}
+
+// WithEvents makes the transfer send an Event on ch for each step it takes.
+//
+// Events for a single transfer are sent in the order they happen, starting
+// with EventStart and ending with EventDone; nothing is sent after
+// EventDone. The channel is never closed by the transfer, so it can be shared
+// between several of them. By default an event is dropped if ch isn't ready
+// to receive it, so the size of the channel's buffer decides how many events
+// can be queued up. See WithBlockingEvents to change that.
+func WithEvents(ch chan<- Event) Option {
+	return func(o *options) {
+		o.events = ch
+	}
+}
+
+// WithBlockingEvents makes the transfer wait for the channel given to
+// WithEvents to accept each event instead of dropping it. A slow receiver
+// will slow the transfer down with it, although once the transfer's context is
+// done, an event that isn't accepted is dropped, so that a receiver that has
+// stopped listening can't stop the transfer from being cancelled.
+func WithBlockingEvents() Option {
+	return func(o *options) {
+		o.eventsBlock = true
+	}
+}
+
+// WithoutHeaderAck makes Read start receiving content straight after the C
+// record, without first acknowledging it. OpenSSH and most other scp
+// implementations wait for that acknowledgement, so this should only be used
+// with very old servers that send the content immediately and would otherwise
+// mistake the acknowledgement for the response to the content.
+func WithoutHeaderAck() Option {
+	return func(o *options) {
+		o.skipHeaderAck = true
+	}
+}
+
+// WithoutFinalStatus makes Read and ReadDir go on once a file's content has
+// arrived, without waiting for the status byte that normally follows it. It's
+// for servers that don't send one, which would otherwise leave the transfer
+// waiting (or, if the server exits, failing) at the end of each file. Without
+// the status byte, there's no way to find out that the server couldn't read
+// the whole file.
+func WithoutFinalStatus() Option {
+	return func(o *options) {
+		o.skipFinalStatus = true
+	}
+}
+
+// WithTransferID sets the identifier attached to every event of the transfer,
+// and to the File returned by Read. By default a random UUID is generated for
+// each transfer, which is enough to tell concurrent transfers apart; a caller
+// can supply its own to correlate events with its own logs.
+func WithTransferID(id string) Option {
+	return func(o *options) {
+		o.transferID = id
+	}
+}
+
+// WithVerifySize makes Read check, once the content has been received, that
+// the remote file still has the size announced at the start of the transfer
+// and that exactly that many bytes arrived. The check is done by running wc in
+// a separate session. It's a cheap way to notice a file that was modified
+// while it was being read, but it's not a substitute for a checksum.
+func WithVerifySize() Option {
+	return func(o *options) {
+		o.verifySize = true
+	}
+}
+
+// WithLegacyProtocol passes -O to the remote scp. In OpenSSH's scp, -O only
+// picks the protocol it uses as a client, so it makes no difference to the
+// scp -t or -f this package runs, which always speaks the SCP protocol;
+// versions before 9.0 refuse it outright. It's only of use with a remote scp
+// that isn't OpenSSH's and understands -O in server mode.
+func WithLegacyProtocol() Option {
+	return func(o *options) {
+		o.legacyProtocol = true
+	}
+}
+
+// WithoutStrictFilenames passes -T to the remote scp. In OpenSSH's scp, -T
+// turns off the checks it makes as a client that the files a server sends
+// are the ones it asked for, so it makes no difference to the scp -t or -f
+// this package runs. The names this package receives are checked either way
+// (see ErrUnsafeFilename). It's only of use with a remote scp that isn't
+// OpenSSH's and understands -T in server mode.
+func WithoutStrictFilenames() Option {
+	return func(o *options) {
+		o.noStrictFilenames = true
+	}
+}
+
+// WithProgressWriter makes the transfer write a simple progress meter to w,
+// in the form "transferred/total (percent)", followed by an estimate of the
+// time left once there is one. Each update starts with a carriage return so
+// that it overwrites the previous one on a terminal, and a final line showing
+// 100% is written when the transfer succeeds. Updates are written at most once
+// a second by default; see WithProgressInterval.
+func WithProgressWriter(w io.Writer) Option {
+	return func(o *options) {
+		if o.meter == nil {
+			o.meter = &meter{interval: time.Second}
+		}
+
+		o.meter.w = w
+	}
+}
+
+// WithProgressInterval sets the minimum time between updates written by
+// WithProgressWriter, and between calls to the function given to
+// WithProgress (apart from the last, which is always made). It has no effect
+// on its own, and events sent to the channel given to WithEvents aren't
+// affected.
+func WithProgressInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.progressInterval = d
+
+		if o.meter == nil {
+			o.meter = &meter{}
+		}
+
+		o.meter.interval = d
+	}
+}
+
+// WithStatus makes the transfer keep s up to date as it runs, for polling with
+// s.Snapshot from another goroutine. It's updated with every chunk moved,
+// whatever WithProgressInterval says, and as with events, each file given to a
+// Writer is a transfer of its own. A Status should only be given to one
+// transfer at a time; a Sink or Source serving several clients at once mixes
+// them all into it.
+func WithStatus(s *Status) Option {
+	return func(o *options) {
+		o.status = s
+	}
+}
+
+// WithTeardown selects how the session used by Read or Write is shut down
+// once the content has been transferred. See Teardown for the choices.
+func WithTeardown(t Teardown) Option {
+	return func(o *options) {
+		o.teardown = t
+	}
+}
+
+// WithDirectories makes ReadDir call its function for each directory as well
+// as each file, as soon as the remote side descends into it and before
+// anything inside it. The File it's given has IsDir set, its Path, its mode
+// and, with WithPreserve, its times, but no content. This is what's needed to
+// mirror a tree that includes empty directories.
+func WithDirectories() Option {
+	return func(o *options) {
+		o.directories = true
+	}
+}
+
+// WithMode makes Write send mode as the mode of every file, in place of the
+// one the File reports, for callers who want consistent permissions on the
+// remote side whatever the local files have. Only the permission, setuid,
+// setgid and sticky bits are sent. The remote scp applies its umask to new
+// files unless WithPreserve is used as well. Directories sent by WriteDir
+// keep their own modes; see WithDirMode.
+func WithMode(mode os.FileMode) Option {
+	return func(o *options) {
+		o.forceMode = true
+		o.mode = mode
+	}
+}
+
+// WithDirMode is WithMode for directories: it makes WriteDir and a Source's
+// ServeDir send mode as the mode of every directory, in place of its own.
+func WithDirMode(mode os.FileMode) Option {
+	return func(o *options) {
+		o.forceDirMode = true
+		o.dirMode = mode
+	}
+}
+
+// WithSymlinks selects what WriteDir, WriteFile and Source do with symbolic
+// links. See Symlinks for the choices. The directory given to WriteDir (and to
+// NewSource) is always followed if it's a link, so the choice applies to what
+// is found inside it. WriteFile, having nothing else to send, returns an error
+// for a link it's told to skip.
+func WithSymlinks(s Symlinks) Option {
+	return func(o *options) {
+		o.symlinks = s
+	}
+}
+
+// WithMaxDepth limits how many levels of directories WriteDir, ReadDir, a Sink
+// and a Source's ServeDir will go through, counting the top-level directory
+// as one. Going any deeper is an error wrapping ErrTooDeep. The default is
+// DefaultMaxDepth, which is more than any sensible tree needs, but stops a
+// tree of pathological depth from being followed forever.
+func WithMaxDepth(n int) Option {
+	return func(o *options) {
+		if n < 1 {
+			o.err = fmt.Errorf("maximum depth %d out of range; expected at least 1", n)
+			return
+		}
+
+		o.maxDepth = n
+	}
+}
+
+// WithContinueOnError makes WriteDir and Writer carry on past a file that
+// can't be sent, as long as the remote scp is still ready for the next one:
+// that's when the file couldn't be read locally, or had a name that can't be
+// sent, or was a directory too deep or in a symbolic link loop, before any of
+// it was sent, or the remote scp refused it with a warning (for something like a permissions
+// problem) before its content. The rest of the batch is still sent, and a
+// *BatchError listing the failures is returned once it's done. A failure that
+// leaves the remote side out of step, like content that can't be read in
+// full, still ends the transfer.
+//
+// Without it, the first failure ends the transfer.
+func WithContinueOnError() Option {
+	return func(o *options) {
+		o.continueOnError = true
+	}
+}
+
+// WithBarrier makes Writer and WriteDir wait, once each file has been sent,
+// for the remote scp's response to it before starting on the next, even with
+// WithPipelining, so that each file is in place before the next one begins.
+// With sync, `sync` is also run on the remote host in a separate session, so
+// that each file has been written out to disk as well.
+//
+// That costs a round trip per file, which undoes WithPipelining, so sending
+// many small files over a link with any latency takes about as long as it
+// does without it. Each sync also costs a session of its own, and however
+// long the remote host takes to flush everything it has cached, which can be
+// much longer still.
+func WithBarrier(sync bool) Option {
+	return func(o *options) {
+		o.barrier = true
+		o.barrierSync = sync
+	}
+}
+
+// WithResumeFrom is like WithManifest, but first makes WriteDir and Writer
+// skip over any file that's already listed in m, with the same path and size.
+// That lets a batch that failed part of the way through be retried with the
+// same Manifest, which lists the files that made it, picking up where the
+// failed attempt left off. It relies on the files not having changed in
+// between, and nothing checks that the remote copies of the files skipped are
+// still there.
+func WithResumeFrom(m *Manifest) Option {
+	return func(o *options) {
+		if m == nil {
+			o.err = fmt.Errorf("WithResumeFrom needs a manifest")
+			return
+		}
+
+		o.manifest = m
+		o.resumeFrom = true
+	}
+}
+
+// WithPipelining makes Writer and WriteDir send each file without waiting for
+// the remote scp's response to its content: the response is read once the
+// next record has been sent, so that the two round trips overlap. The remote
+// scp still deals with everything in order, so nothing is lost, but a warning
+// or error about a file's content is reported along with the next file, or by
+// Close, rather than by the WriteFile call that sent it.
+//
+// Without it, each file costs two round trips, one for its record and one for
+// its content; with it, only one. Most of the time spent sending tiny files
+// goes on waiting for responses, so over a link with any latency that comes
+// close to halving it. It has no effect on Write, which sends just the one
+// file, or on files sent with WithVerifyPlacement or WithChecksum, which need
+// the response before the check can be made.
+func WithPipelining() Option {
+	return func(o *options) {
+		o.pipelining = true
+	}
+}
+
+// WithManifest makes Write, WriteDir and Writer add an entry to m for each file
+// sent, with its remote path, size and mode, and its digest if writing with
+// WithChecksum. Files that couldn't be sent are left out. WriteMany also
+// records which host each file was sent to.
+func WithManifest(m *Manifest) Option {
+	return func(o *options) {
+		o.manifest = m
+	}
+}
+
+// WithWritableCheck makes Write call CheckWritable on the target directory
+// before starting the transfer, so that a permissions problem is reported
+// clearly up front. This is mostly useful with WriteMany, where it stops a
+// misconfigured host from getting as far as the transfer itself.
+func WithWritableCheck() Option {
+	return func(o *options) {
+		o.checkWritable = true
+	}
+}
+
+// WithHash makes Read feed the content of the file through a hash made with
+// newHash as it's read, so that its digest can be retrieved with File.Sum once
+// the content has been read in full. This saves a second pass over the data
+// when it needs to be checked against a known digest. Each transfer gets a
+// hash of its own, so the option can be shared, e.g. by a Client.
+func WithHash(newHash func() hash.Hash) Option {
+	return func(o *options) {
+		if newHash == nil {
+			o.err = fmt.Errorf("WithHash needs a hash")
+			return
+		}
+
+		o.newHash = newHash
+	}
+}
+
+// WithChecksum makes Write check, once each file has been sent, that the
+// remote copy has the same digest as the content that was sent. The content is
+// fed through a hash made with newHash as it goes, and command is run on the
+// remote host in a separate session to compute the digest of the remote file.
+//
+// Every %s in command is replaced with the (quoted) path of the remote file,
+// and the first field of its output is taken as the digest in hex, which
+// suits sha256sum, md5sum, `shasum -a 256` and `openssl dgst -r` alike. For
+// example:
+//
+//	scp.WithChecksum(sha256.New, "sha256sum %s")
+//
+// If the digests differ, Write returns an error wrapping ErrChecksumMismatch.
+func WithChecksum(newHash func() hash.Hash, command string) Option {
+	return func(o *options) {
+		if newHash == nil || !strings.Contains(command, "%s") {
+			o.err = fmt.Errorf("WithChecksum needs a hash and a command containing %%s")
+			return
+		}
+
+		o.checksumHash = newHash
+		o.checksumCommand = command
+	}
+}
+
+// WithNice runs the remote scp under `nice -n n ionice -c3`, lowering its CPU
+// and I/O priority so that a bulk transfer doesn't get in the way of other
+// work on the server. The niceness must be between -20 and 19, although only
+// privileged users can use negative values. This relies on the nice and
+// ionice commands being available, which generally limits it to Linux hosts.
+func WithNice(n int) Option {
+	return func(o *options) {
+		if n < -20 || n > 19 {
+			o.err = fmt.Errorf("niceness %d out of range; expected -20 to 19", n)
+			return
+		}
+
+		o.nice = true
+		o.niceness = n
+	}
+}
+
+// WithStallTimeout makes Read give up if no content arrives for longer than
+// d, closing the session and returning an error wrapping ErrStalled through
+// the File's Reader. Without it, a file that shrinks while it's being sent
+// (e.g. a log being rotated) can leave the transfer waiting forever for bytes
+// that will never come. It only applies once the content has started; the
+// handshake isn't covered.
+func WithStallTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.stallTimeout = d
+	}
+}
+
+// WithPipeBufferSize sets the size of the buffers placed between the session's
+// stdin and stdout and the protocol code, which default to 4KB each. Larger
+// buffers mean fewer, bigger writes to and reads from the SSH channel, which
+// can help throughput on fast, high-latency links. Each transfer holds two of
+// them, so the memory cost is twice n per concurrent transfer.
+func WithPipeBufferSize(n int) Option {
+	return func(o *options) {
+		o.pipeBufferSize = n
+	}
+}
+
+// WithBufferSize sets the size of the buffer that file content is copied
+// through, which is also the most that's moved in one go between progress
+// events. It defaults to 32KB. The buffer is allocated once per transfer and
+// reused for every chunk. See WithPipeBufferSize for the buffers around the
+// session itself.
+func WithBufferSize(n int) Option {
+	return func(o *options) {
+		o.bufferSize = n
+	}
+}
+
+// WithArgvHook calls fn with the full argument list for the remote command
+// (e.g. ["scp", "-t", "/tmp"]) just before it's quoted and started, and runs
+// whatever fn returns instead. It's an escape hatch for servers that need
+// something this package doesn't otherwise support, and a handy place to
+// inspect exactly what's being run.
+func WithArgvHook(fn func(argv []string) []string) Option {
+	return func(o *options) {
+		o.argvHook = fn
+	}
+}
+
+// WithFileHook makes a Sink call fn for each file a client sends, before
+// anything is created, so that a server can enforce a policy on what it
+// accepts. The File has the name, size, mode and Path the client sent, and
+// (with WithPreserve) its times, but no content, and target is where it would
+// be written. Returning an error refuses the file: the client is sent the
+// error as a warning, which lets it carry on with the rest of the upload.
+// Otherwise, the file is written to the path fn returns, or to target if
+// that's empty. A sink made with NewSinkFunc ignores the path, since its
+// function decides what happens to the file.
+func WithFileHook(fn func(f *File, target string) (string, error)) Option {
+	return func(o *options) {
+		o.fileHook = fn
+	}
+}
+
+// WithNameSanitizer makes ReadFile and a Sink pass the name of each file (and,
+// for a Sink, directory) they create locally through fn, which can rewrite
+// characters the local filesystem doesn't allow, such as ':' on Windows, or
+// refuse the name with an error. Whatever fn returns still has to be a single
+// element of a path. By default, names are used as they are, except that a
+// name containing a control character is refused.
+func WithNameSanitizer(fn func(name string) (string, error)) Option {
+	return func(o *options) {
+		o.nameSanitizer = fn
+	}
+}
+
+// WithSCPPath sets the program run on the remote host in place of "scp", for
+// hosts where it isn't on the PATH of a non-login shell or where it needs to
+// be a wrapper of some kind. It applies to both reading and writing, unless
+// overridden for one direction by WithSourceSCPPath or WithSinkSCPPath.
+//
+// The program doesn't have to be scp at all, only something that takes the
+// same flags and speaks the protocol on its stdin and stdout. That makes this
+// a way to test against a controlled counterpart: point it at a helper (a
+// script, or a test binary that acts as the helper when an environment
+// variable is set) on a local ssh server, and it'll be run with e.g. "-qf
+// path" or "-t dir" just as scp would be. WithArgvHook can be used to inspect
+// or adjust the full command line if the helper needs more than a path.
+func WithSCPPath(path string) Option {
+	return func(o *options) {
+		o.scpPath = path
+	}
+}
+
+// WithSourceSCPPath sets the program run on the remote host in place of "scp"
+// when reading (i.e. for "scp -f"), taking precedence over WithSCPPath.
+func WithSourceSCPPath(path string) Option {
+	return func(o *options) {
+		o.sourceSCPPath = path
+	}
+}
+
+// WithSinkSCPPath sets the program run on the remote host in place of "scp"
+// when writing (i.e. for "scp -t"), taking precedence over WithSCPPath.
+func WithSinkSCPPath(path string) Option {
+	return func(o *options) {
+		o.sinkSCPPath = path
+	}
+}
+
+// WithExtraArgs passes extra arguments to the remote scp, after any flags set
+// by other options and before the ones that select the direction and path,
+// e.g. "-l" and "8192" to limit its bandwidth. Each argument is quoted for the
+// remote shell separately, so they can contain spaces. Calling it more than
+// once adds to the arguments already given. To run something in front of scp
+// instead, like sudo, see WithSCPPath or WithArgvHook.
+func WithExtraArgs(args ...string) Option {
+	return func(o *options) {
+		o.extraArgs = append(o.extraArgs, args...)
+	}
+}
+
+// WithVerifyPlacement makes Write check, once the transfer is complete, that
+// the file exists where it was expected to end up: inside the target if that
+// is a directory, or at the target path itself otherwise. This catches remote
+// scp implementations that interpret the target differently.
+func WithVerifyPlacement() Option {
+	return func(o *options) {
+		o.verifyPlacement = true
+	}
+}
+
+// WithGzip makes Write compress the file with gzip before sending it, and
+// upload it under its name with ".gz" appended. Writer, WriteDir and Source do
+// the same with each file they send. The remote file is simply the compressed
+// data; nothing decompresses it on the other side. Since the size has to be
+// known up front, each file is compressed into a temporary file first (see
+// NewGzipFile), so this costs local disk space and delays the start of the
+// transfer.
+func WithGzip() Option {
+	return func(o *options) {
+		o.gzip = true
+	}
+}
+
+// WithPreserve passes -p to the remote scp so that file times are carried
+// across along with the content.
+//
+// When reading, the remote scp sends the modification and access times of
+// each file, and they're made available from File.ModTime and
+// File.AccessTime. Unlike WithStatModTime this needs no extra session, but it
+// relies on the remote scp honouring -p; if it doesn't send the times, they're
+// simply left unset.
+//
+// When writing, the times of each File (see File.SetTimes and
+// NewFileFromInfo) are sent ahead of it, and the remote scp applies them to
+// the file it creates. Files without a modification time are sent without
+// any. WriteDir sends the times of directories as well.
+func WithPreserve() Option {
+	return func(o *options) {
+		o.preserve = true
+	}
+}
+
+// WithProgress calls fn as content moves, with the number of bytes moved so
+// far and the total expected, once for each chunk. It's called from whichever
+// goroutine is moving the content, which for Read is not the caller's, so it
+// should return quickly.
+//
+// When a transfer succeeds, the last call is always fn(total, total), made
+// exactly once, even for an empty file. It's only made once the transfer has
+// finished, including the remote side's confirmation, so a transfer that fails
+// after its content has all been moved never makes it. Once a transfer has
+// failed, fn isn't called again. For a directory or glob transfer, each file
+// but the last gets its final call when the next one starts, and the last when
+// the transfer has finished.
+func WithProgress(fn func(transferred, total int64)) Option {
+	return func(o *options) {
+		o.progress = fn
+	}
+}
+
+// WithTempFile makes Read receive the whole file into a temporary file in dir
+// before returning, so that the File it returns is backed by an *os.File: its
+// Reader can be type-asserted to an io.ReadSeeker (or io.ReaderAt) for random
+// access. If dir is empty, the default directory for temporary files is used
+// (see os.TempDir). It trades disk space and latency for seekability, and any
+// error during the transfer is returned by Read itself. The temporary file is
+// removed when the File is closed, so it must be.
+func WithTempFile(dir string) Option {
+	return func(o *options) {
+		o.tempFile = true
+		o.tempDir = dir
+	}
+}
+
+// WithResume makes ReadFile carry on from an earlier transfer that was cut
+// short. If the local file already has some content, only the rest of the
+// remote file is fetched, by running `tail -c` on the remote host, and it's
+// appended; the combined size is then checked against the remote file's, by
+// running wc, and if they differ ReadFile returns an error wrapping
+// ErrSizeMismatch. A failed transfer leaves whatever was received in place,
+// rather than removing it, so that it can be resumed in turn. With
+// WithPreserve, the local file's times are set from the remote one's found
+// with stat.
+//
+// Nothing checks that the content already there matches the start of the
+// remote file, so this is only safe if the remote file hasn't changed since
+// the earlier transfer: if it has, and it's no smaller than the local file,
+// the result is a corrupt copy without any error.
+func WithResume() Option {
+	return func(o *options) {
+		o.resume = true
+	}
+}
+
+// WithRemoteName sets the name WriteFile gives the remote file, in place of
+// the base name of the local one.
+func WithRemoteName(name string) Option {
+	return func(o *options) {
+		o.remoteName = name
+	}
+}
+
+// WithRateLimit limits the rate at which file content is sent or received to
+// bytesPerSecond, by pausing between chunks on this side of the connection,
+// much as `scp -l` does on the remote side. Only the content counts towards
+// the rate; records and acknowledgements aren't held up. A limit of zero or
+// less means no limit.
+func WithRateLimit(bytesPerSecond int64) Option {
+	return func(o *options) {
+		if bytesPerSecond <= 0 {
+			o.limiter = nil
+			return
+		}
+
+		o.limiter = &limiter{rate: bytesPerSecond}
+	}
+}
+
+// WithMemoryBuffer makes WriteReader hold the content in memory while it
+// works out its size, rather than in a temporary file. It's quicker for small
+// streams, but the whole stream has to fit in memory.
+func WithMemoryBuffer() Option {
+	return func(o *options) {
+		o.memoryBuffer = true
+	}
+}
+
+// WithTrace writes a line to w for each record and status byte exchanged with
+// the remote scp, starting with ">" for those sent and "<" for those
+// received, e.g. "> C0644 5 hello.txt" and "< \x00". File content isn't
+// included, but the command run to start the remote scp is, once any argv
+// hook has had its way with it, e.g. "> exec scp -t /tmp". It's meant for
+// working out where a conversation with an unusual server goes wrong, e.g.
+// WithTrace(os.Stderr).
+func WithTrace(w io.Writer) Option {
+	return func(o *options) {
+		o.trace = w
+	}
+}
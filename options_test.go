@@ -0,0 +1,138 @@
+package scp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCommand(t *testing.T) {
+	tests := []struct {
+		opts     []Option
+		flags    string
+		path     string
+		expected string
+	}{
+		{flags: "-t", path: "/tmp", expected: "scp -t /tmp"},
+		{flags: "-qf", path: "my file", expected: "scp -qf 'my file'"},
+		{flags: "-t", path: "it's", expected: `scp -t it\'s`},
+		{opts: []Option{WithLegacyProtocol(), WithoutStrictFilenames()}, flags: "-qf", path: "a", expected: "scp -O -T -qf a"},
+		{opts: []Option{WithNice(10)}, flags: "-t", path: "a", expected: "nice -n 10 ionice -c3 scp -t a"},
+		{opts: []Option{WithSCPPath("/opt/bin/scp"), WithExtraArgs("-l", "8192"), WithExtraArgs("-o x")}, flags: "-t", path: "a", expected: "/opt/bin/scp -l 8192 '-o x' -t a"},
+		{opts: []Option{WithArgvHook(func(argv []string) []string { return append([]string{"sudo"}, argv...) })}, flags: "-t", path: "a", expected: "sudo scp -t a"},
+	}
+
+	for _, tt := range tests {
+		o, err := newOptions(tt.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := o.command(o.sinkProgram(), tt.flags, tt.path)
+		if err != nil {
+			t.Errorf("command(%q, %q) gave error %v", tt.flags, tt.path, err)
+		} else if got != tt.expected {
+			t.Errorf("command(%q, %q) is %q; expected %q", tt.flags, tt.path, got, tt.expected)
+		}
+	}
+}
+
+func TestGlobCommand(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		expected string
+	}{
+		{pattern: "/tmp/*.txt", expected: `scp -qf /tmp/*.txt`},
+		{pattern: "a?[bc]", expected: `scp -qf a?[bc]`},
+		{pattern: "my file*", expected: `scp -qf my\ file*`},
+		{pattern: "$(rm -rf ~);*", expected: `scp -qf \$\(rm\ -rf\ \~\)\;*`},
+		{pattern: "it's*", expected: `scp -qf it\'s*`},
+	}
+
+	for _, tt := range tests {
+		o, err := newOptions(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := o.globCommand(o.sourceProgram(), "-qf", tt.pattern)
+		if err != nil {
+			t.Errorf("globCommand(%q) gave error %v", tt.pattern, err)
+		} else if got != tt.expected {
+			t.Errorf("globCommand(%q) is %q; expected %q", tt.pattern, got, tt.expected)
+		}
+	}
+
+	if _, err := quoteGlob("a\nb"); err == nil {
+		t.Error("quoteGlob accepted a newline")
+	}
+}
+
+func TestCommandTrace(t *testing.T) {
+	var trace strings.Builder
+
+	o, err := newOptions([]Option{WithTrace(&trace), WithArgvHook(func(argv []string) []string { return append([]string{"sudo"}, argv...) })})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := o.command(o.sinkProgram(), "-t", "my file"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.globCommand(o.sourceProgram(), "-qf", "*.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := "> exec sudo scp -t 'my file'\n> exec sudo scp -qf *.txt\n"; trace.String() != expected {
+		t.Fatalf("trace is %q; expected %q", trace.String(), expected)
+	}
+}
+
+func TestArgvHookPanic(t *testing.T) {
+	o, err := newOptions([]Option{WithArgvHook(func(argv []string) []string { panic("boom") })})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := o.command("scp", "-t", "a"); err == nil {
+		t.Fatal("command succeeded with a panicking argv hook")
+	}
+}
+
+func TestPrograms(t *testing.T) {
+	tests := []struct {
+		opts         []Option
+		source, sink string
+	}{
+		{source: "scp", sink: "scp"},
+		{opts: []Option{WithSCPPath("/a/scp")}, source: "/a/scp", sink: "/a/scp"},
+		{opts: []Option{WithSCPPath("/a/scp"), WithSourceSCPPath("/b/scp")}, source: "/b/scp", sink: "/a/scp"},
+		{opts: []Option{WithSinkSCPPath("/c/scp"), WithSCPPath("/a/scp")}, source: "/a/scp", sink: "/c/scp"},
+	}
+
+	for _, tt := range tests {
+		o, err := newOptions(tt.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if o.sourceProgram() != tt.source || o.sinkProgram() != tt.sink {
+			t.Errorf("programs are %q and %q; expected %q and %q", o.sourceProgram(), o.sinkProgram(), tt.source, tt.sink)
+		}
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	for _, opt := range []Option{
+		WithNice(20),
+		WithNice(-21),
+		WithChecksum(nil, "sha256sum %s"),
+		WithChecksum(nil, "sha256sum"),
+		WithHash(nil),
+		WithMaxDepth(0),
+		WithResumeFrom(nil),
+	} {
+		if _, err := newOptions([]Option{opt}); err == nil {
+			t.Errorf("newOptions accepted an invalid option")
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package scp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/kballard/go-shellquote"
+	"golang.org/x/crypto/ssh"
+)
+
+// ServerProfile describes the protocol behaviour of a host's scp, as detected
+// by Probe.
+type ServerProfile struct {
+	// LeadingReadyByte is true if the remote source sends a zero byte before
+	// its first record, which Read skips over by itself.
+	LeadingReadyByte bool
+	// HeaderAck is true if the remote source waits for the C record to be
+	// acknowledged before sending content, as OpenSSH does. If it's false,
+	// WithoutHeaderAck is needed.
+	HeaderAck bool
+	// FinalStatus is true if the remote source sends a status byte after the
+	// content of a file. If it's false, WithoutFinalStatus is needed.
+	FinalStatus bool
+	// ModeDigits is the number of octal digits the remote source uses for the
+	// mode in a C record, normally 4.
+	ModeDigits int
+	// NoStrictFilenames is true if the remote scp accepts -T, so that
+	// WithoutStrictFilenames can be used. OpenSSH's accepts it, but ignores
+	// it in server mode.
+	NoStrictFilenames bool
+	// LegacyProtocol is true if the remote scp accepts -O, so that
+	// WithLegacyProtocol can be used. OpenSSH's accepts it from 9.0, but
+	// ignores it in server mode.
+	LegacyProtocol bool
+}
+
+// Options returns the options that transfers to the host need, given what the
+// profile says about it. Options that are merely available, like
+// WithoutStrictFilenames, aren't included.
+func (p ServerProfile) Options() []Option {
+	var opts []Option
+
+	if !p.HeaderAck {
+		opts = append(opts, WithoutHeaderAck())
+	}
+	if !p.FinalStatus {
+		opts = append(opts, WithoutFinalStatus())
+	}
+
+	return opts
+}
+
+// probeWait is how long Probe waits for the remote side to send something
+// before deciding that it isn't going to without being prompted.
+const probeWait = time.Second
+
+// Probe works out which protocol quirks the scp on the host behind c has, by
+// writing a small file to a temporary directory (made with mktemp), reading it
+// back in a few different ways and then removing the directory. Some of the
+// behaviour can only be detected by waiting to see whether something arrives,
+// so it takes a few seconds even on a fast link.
+//
+// The options are used for every transfer Probe makes, so that things like
+// WithSCPPath can be given for hosts that need it.
+func Probe(c *ssh.Client, opts ...Option) (p ServerProfile, err error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return p, err
+	}
+
+	out, err := runOutput(c, "mktemp -d")
+	if err != nil {
+		return p, fmt.Errorf("probe: making temporary directory: %w", err)
+	}
+	dir := strings.TrimSpace(string(out))
+
+	defer func() {
+		if _, rerr := runOutput(c, shellquote.Join("rm", "-rf", dir)); rerr != nil && err == nil {
+			err = fmt.Errorf("probe: removing %s: %w", dir, rerr)
+		}
+	}()
+
+	const content = "scp probe\n"
+	file := path.Join(dir, "probe")
+
+	if _, err := Write(c, dir, NewFile("probe", int64(len(content)), 0644, strings.NewReader(content)), opts...); err != nil {
+		return p, fmt.Errorf("probe: writing %s: %w", file, err)
+	}
+
+	if err := probeSource(c, file, o, &p); err != nil {
+		return p, fmt.Errorf("probe: reading %s: %w", file, err)
+	}
+
+	opts = append(opts[:len(opts):len(opts)], p.Options()...)
+
+	p.NoStrictFilenames = probeRead(c, file, content, append(opts, WithoutStrictFilenames())...)
+	p.LegacyProtocol = probeRead(c, file, content, append(opts, WithLegacyProtocol())...)
+
+	return p, nil
+}
+
+// probeRead reports whether file can be read with opts and has content.
+func probeRead(c *ssh.Client, file, content string, opts ...Option) bool {
+	f, err := Read(c, file, opts...)
+	if err != nil {
+		return false
+	}
+
+	b, err := ioutil.ReadAll(f)
+
+	return err == nil && string(b) == content
+}
+
+// probeSource reads file by hand, noting how the remote source behaves at each
+// step where implementations are known to differ.
+func probeSource(c *ssh.Client, file string, o *options, p *ServerProfile) error {
+	s, err := c.NewSession()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	stdout, err := s.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	stdin, err := s.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	rw := bufio.NewReadWriter(bufio.NewReader(stdout), bufio.NewWriter(stdin))
+
+	cmd, err := o.command(o.sourceProgram(), "-qf", file)
+	if err != nil {
+		return err
+	}
+
+	if err := s.Start(cmd); err != nil {
+		return err
+	}
+
+	ack := func() error {
+		return o.sendOK(rw.Writer)
+	}
+
+	if err := ack(); err != nil {
+		return err
+	}
+
+	b, err := rw.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	if b == 0 {
+		p.LeadingReadyByte = true
+
+		if b, err = rw.ReadByte(); err != nil {
+			return err
+		}
+	}
+
+	if err := rw.UnreadByte(); err != nil {
+		return err
+	}
+
+	l, err := o.readRecord(rw.Reader)
+	if err != nil {
+		return err
+	}
+
+	_, size, _, err := parseCopy(l)
+	if err != nil {
+		return err
+	}
+
+	if i := bytes.IndexByte(l, ' '); i > 1 {
+		p.ModeDigits = i - 1
+	}
+
+	// Content arriving before the header has been acknowledged means the
+	// source doesn't wait for it. Either way, the acknowledgement is sent so
+	// that the rest of the exchange can go ahead.
+	arrived := probePeek(rw.Reader)
+
+	var peekErr error
+	select {
+	case peekErr = <-arrived:
+	case <-time.After(probeWait):
+		p.HeaderAck = true
+	}
+
+	if err := ack(); err != nil {
+		return err
+	}
+
+	if p.HeaderAck {
+		peekErr = <-arrived
+	}
+	if peekErr != nil {
+		return peekErr
+	}
+
+	if _, err := io.CopyN(ioutil.Discard, rw, size); err != nil {
+		return err
+	}
+
+	arrived = probePeek(rw.Reader)
+
+	select {
+	case err := <-arrived:
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		if err == nil {
+			p.FinalStatus = true
+
+			if _, err := o.readResponse(rw.Reader); err != nil {
+				return err
+			}
+		}
+	case <-time.After(probeWait):
+	}
+
+	return ack()
+}
+
+// probePeek waits in the background for at least one byte to be available
+// from r, without consuming it.
+func probePeek(r *bufio.Reader) <-chan error {
+	ch := make(chan error, 1)
+
+	go func() {
+		_, err := r.Peek(1)
+		ch <- err
+	}()
+
+	return ch
+}
+
+// runOutput runs cmd in a new session on c and returns its standard output.
+func runOutput(c *ssh.Client, cmd string) ([]byte, error) {
+	s, err := c.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	return s.Output(cmd)
+}
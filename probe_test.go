@@ -0,0 +1,125 @@
+package scp
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestProbe(t *testing.T) {
+	if testing.Short() {
+		t.Skip("probing waits for things that never arrive")
+	}
+
+	c := newTestClient(t)
+
+	p, err := Probe(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := ServerProfile{HeaderAck: true, FinalStatus: true, ModeDigits: 4}
+	if p != expected {
+		t.Fatalf("Probe gave %+v; expected %+v", p, expected)
+	}
+
+	if opts := p.Options(); len(opts) != 0 {
+		t.Fatalf("profile of a well-behaved scp needs %d options", len(opts))
+	}
+
+	if opts := (ServerProfile{}).Options(); len(opts) != 2 {
+		t.Fatalf("profile of an scp without the header acknowledgement or final status needs %d options; expected 2", len(opts))
+	}
+}
+
+// quirkySource plays an old `scp -f` that sends a ready byte and a three digit
+// mode, doesn't wait for its header to be acknowledged and sends no status
+// after the content. It also never exits by itself, so it needs TeardownClose.
+func quirkySource(cmd string, ch ssh.Channel) int {
+	io.ReadFull(ch, make([]byte, 1))
+	io.WriteString(ch, "\x00C644 10 probe\nscp probe\n")
+	io.Copy(ioutil.Discard, ch)
+
+	return 0
+}
+
+func TestProbeQuirks(t *testing.T) {
+	if testing.Short() {
+		t.Skip("probing waits for things that never arrive")
+	}
+
+	var mu sync.Mutex
+	var commands []string
+
+	c := newFakeClient(t, func(cmd string, ch ssh.Channel) int {
+		mu.Lock()
+		commands = append(commands, cmd)
+		mu.Unlock()
+
+		switch {
+		case cmd == "mktemp -d":
+			io.WriteString(ch, "/tmp/probe.x\n")
+		case strings.HasPrefix(cmd, "rm "):
+		case strings.Contains(cmd, " -O "):
+			io.WriteString(ch.Stderr(), "unknown option -- O\n")
+			return 1
+		case strings.Contains(cmd, " -t "):
+			return fakeSink("\x00", "\x00", 0)(cmd, ch)
+		case strings.Contains(cmd, " -qf "):
+			return quirkySource(cmd, ch)
+		default:
+			return 1
+		}
+
+		return 0
+	})
+
+	p, err := Probe(c, WithSCPPath("/opt/bin/scp"), WithTeardown(TeardownClose))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := ServerProfile{LeadingReadyByte: true, ModeDigits: 3, NoStrictFilenames: true}
+	if p != expected {
+		t.Fatalf("Probe gave %+v; expected %+v", p, expected)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, cmd := range commands {
+		if strings.Contains(cmd, "scp") && !strings.HasPrefix(cmd, "/opt/bin/scp ") {
+			t.Errorf("Probe ran %q, ignoring WithSCPPath", cmd)
+		}
+	}
+}
+
+func TestWithoutFinalStatus(t *testing.T) {
+	c := newFakeClient(t, fakeSource(0, "C0644 3 a\n", "abc"))
+
+	f, err := Read(c, "a", WithoutFinalStatus())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, f); got != "abc" {
+		t.Fatalf("read %q", got)
+	}
+
+	var names []string
+	_, err = ReadDir(c, "a", func(f *File) error {
+		names = append(names, f.Name())
+		_, err := io.Copy(ioutil.Discard, f)
+		return err
+	}, WithoutFinalStatus())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(names) != 1 || names[0] != "a" {
+		t.Fatalf("ReadDir gave %v", names)
+	}
+}
@@ -0,0 +1,153 @@
+package scp
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// meter writes a simple text progress meter for a single transfer, using a
+// carriage return to overwrite the previous line each time.
+type meter struct {
+	w        io.Writer
+	interval time.Duration
+	last     time.Time
+	// line is set once something has been printed, until the line is ended.
+	line bool
+}
+
+func (m *meter) update(e Event) {
+	switch e.Type {
+	case EventProgress:
+		// The end of each file is always shown, since a directory transfer
+		// has nothing else to show it with.
+		if now := time.Now(); now.Sub(m.last) >= m.interval || e.Transferred == e.Total {
+			m.last = now
+			m.print(e.Transferred, e.Total, e.ETA, "")
+		}
+	case EventDone:
+		if e.Err != nil {
+			return
+		}
+
+		// The done event of a directory or glob transfer has no total of
+		// its own, so the line for the last file is left as it is.
+		if e.Total == 0 && m.line {
+			fmt.Fprint(m.w, "\n")
+			m.line = false
+			return
+		}
+
+		m.print(e.Total, e.Total, 0, "\n")
+	}
+}
+
+func (m *meter) print(transferred, total int64, eta time.Duration, end string) {
+	pct := int64(100)
+	if total > 0 {
+		pct = transferred * 100 / total
+	}
+
+	var left string
+	if eta > 0 {
+		left = fmt.Sprintf(" %s left", eta.Round(time.Second))
+	}
+
+	fmt.Fprintf(m.w, "\r%d/%d (%d%%)%s%s", transferred, total, pct, left, end)
+	m.line = end == ""
+}
+
+const (
+	// rateWarmup is how long a transfer has to run before its rate is
+	// reported. The first few chunks mostly measure how fast buffers fill,
+	// not how fast the link is.
+	rateWarmup = time.Second
+	// rateSmoothing is the time constant of the moving average; samples
+	// older than this have less than a third of their original weight.
+	rateSmoothing = 5 * time.Second
+)
+
+// rateEstimator keeps an exponentially weighted moving average of the rate at
+// which a file's content is moving. It starts over whenever it sees a
+// different file, so it can follow the files of a directory transfer one
+// after another.
+type rateEstimator struct {
+	name  string
+	n     int64
+	start time.Time
+	last  time.Time
+	rate  float64
+}
+
+// update records that transferred of total bytes of the named file had been
+// moved at now, and returns the smoothed rate and the estimated time left, or
+// zeroes if it's too early to tell.
+func (r *rateEstimator) update(name string, transferred, total int64, now time.Time) (float64, time.Duration) {
+	if r.start.IsZero() || name != r.name || transferred < r.n {
+		*r = rateEstimator{name: name, n: transferred, start: now, last: now}
+		return 0, 0
+	}
+
+	dt := now.Sub(r.last)
+	if dt <= 0 {
+		return r.estimate(transferred, total, now)
+	}
+
+	sample := float64(transferred-r.n) / dt.Seconds()
+	if r.rate == 0 {
+		r.rate = sample
+	} else {
+		alpha := 1 - math.Exp(-dt.Seconds()/rateSmoothing.Seconds())
+		r.rate += alpha * (sample - r.rate)
+	}
+
+	r.n = transferred
+	r.last = now
+
+	return r.estimate(transferred, total, now)
+}
+
+func (r *rateEstimator) estimate(transferred, total int64, now time.Time) (float64, time.Duration) {
+	if now.Sub(r.start) < rateWarmup || r.rate <= 0 {
+		return 0, 0
+	}
+
+	var eta time.Duration
+	if left := total - transferred; left > 0 {
+		eta = time.Duration(float64(left) / r.rate * float64(time.Second))
+	}
+
+	return r.rate, eta
+}
+
+// limiterSlack is how far behind schedule a limiter can fall, e.g. while a
+// Writer is between files, before it starts over rather than letting the
+// transfer catch up in a burst.
+const limiterSlack = time.Second
+
+// limiter keeps a transfer to a fixed rate by working out when each byte is
+// due, given the time the transfer started.
+type limiter struct {
+	rate  int64
+	start time.Time
+	n     int64
+}
+
+// delay records that n more bytes are being moved at now, and returns how
+// long to wait before moving any more to stay within the rate.
+func (l *limiter) delay(n int, now time.Time) time.Duration {
+	if l.start.IsZero() || now.Sub(l.due()) > limiterSlack {
+		l.start = now
+		l.n = 0
+	}
+
+	l.n += int64(n)
+
+	return l.due().Sub(now)
+}
+
+// due returns the time by which the bytes moved so far should have been.
+func (l *limiter) due() time.Time {
+	return l.start.Add(time.Duration(float64(l.n) / float64(l.rate) * float64(time.Second)))
+}
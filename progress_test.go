@@ -0,0 +1,154 @@
+package scp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMeter(t *testing.T) {
+	var buf bytes.Buffer
+	m := &meter{w: &buf, interval: time.Hour}
+
+	m.update(Event{Type: EventStart, Total: 10})
+	m.update(Event{Type: EventProgress, Transferred: 5, Total: 10, ETA: 3 * time.Second})
+	m.update(Event{Type: EventProgress, Transferred: 8, Total: 10})
+	m.update(Event{Type: EventDone, Total: 10})
+
+	if got, expected := buf.String(), "\r5/10 (50%) 3s left\r10/10 (100%)\n"; got != expected {
+		t.Fatalf("meter wrote %q; expected %q", got, expected)
+	}
+
+	buf.Reset()
+	m = &meter{w: &buf}
+
+	m.update(Event{Type: EventProgress, Transferred: 1, Total: 10})
+	m.update(Event{Type: EventProgress, Transferred: 2, Total: 10})
+	m.update(Event{Type: EventDone, Total: 10, Err: errors.New("failed")})
+
+	if got, expected := buf.String(), "\r1/10 (10%)\r2/10 (20%)"; got != expected {
+		t.Fatalf("meter wrote %q; expected %q with no final line for a failure", got, expected)
+	}
+
+	// A directory transfer, whose done event has no total, and whose last
+	// progress event is shown even though it's too soon after the first.
+	buf.Reset()
+	m = &meter{w: &buf, interval: time.Hour}
+
+	m.update(Event{Type: EventStart})
+	m.update(Event{Type: EventProgress, Name: "a", Transferred: 5, Total: 5})
+	m.update(Event{Type: EventProgress, Name: "b", Transferred: 1, Total: 3})
+	m.update(Event{Type: EventProgress, Name: "b", Transferred: 3, Total: 3})
+	m.update(Event{Type: EventDone})
+
+	if got, expected := buf.String(), "\r5/5 (100%)\r3/3 (100%)\n"; got != expected {
+		t.Fatalf("meter wrote %q; expected %q", got, expected)
+	}
+
+	// Nothing was moved at all.
+	buf.Reset()
+	m = &meter{w: &buf}
+
+	m.update(Event{Type: EventStart})
+	m.update(Event{Type: EventDone})
+
+	if got, expected := buf.String(), "\r0/0 (100%)\n"; got != expected {
+		t.Fatalf("meter wrote %q; expected %q", got, expected)
+	}
+}
+
+func TestWithProgressWriter(t *testing.T) {
+	c := newTestClient(t)
+	dir := t.TempDir()
+
+	var buf bytes.Buffer
+	if _, err := Write(c, dir, NewFile("f", 5, 0644, strings.NewReader("hello")), WithProgressWriter(&buf)); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := buf.String(); !strings.HasSuffix(got, "\r5/5 (100%)\n") || strings.Count(got, "\n") != 1 {
+		t.Fatalf("meter wrote %q; expected it to end with a single line at 100%%", got)
+	}
+
+	root := makeTree(t)
+
+	buf.Reset()
+	if _, err := WriteDir(c, dir, root, WithProgressWriter(&buf)); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := buf.String(); !strings.HasSuffix(got, " (100%)\n") || strings.Contains(got, "0/0") || strings.Count(got, "\n") != 1 {
+		t.Fatalf("meter wrote %q for WriteDir; expected it to end with the last file at 100%%", got)
+	}
+
+	buf.Reset()
+	if _, err := ReadDir(c, root, func(f *File) error {
+		_, err := io.Copy(ioutil.Discard, f)
+		return err
+	}, WithProgressWriter(&buf)); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := buf.String(); !strings.HasSuffix(got, " (100%)\n") || strings.Contains(got, "0/0") || strings.Count(got, "\n") != 1 {
+		t.Fatalf("meter wrote %q for ReadDir; expected it to end with the last file at 100%%", got)
+	}
+}
+
+func TestRateEstimator(t *testing.T) {
+	var r rateEstimator
+	start := time.Unix(1000, 0)
+
+	if rate, eta := r.update("f", 0, 3000, start); rate != 0 || eta != 0 {
+		t.Fatalf("first update gave %v, %v; expected nothing yet", rate, eta)
+	}
+	if rate, eta := r.update("f", 100, 3000, start.Add(100*time.Millisecond)); rate != 0 || eta != 0 {
+		t.Fatalf("update during warmup gave %v, %v; expected nothing yet", rate, eta)
+	}
+
+	rate, eta := r.update("f", 1000, 3000, start.Add(time.Second))
+	if rate < 999 || rate > 1001 || eta < 1900*time.Millisecond || eta > 2100*time.Millisecond {
+		t.Fatalf("update at 1000 bytes a second gave %v, %v; expected 1000 and 2s", rate, eta)
+	}
+
+	if rate, eta := r.update("g", 0, 3000, start.Add(2*time.Second)); rate != 0 || eta != 0 {
+		t.Fatalf("update for another file gave %v, %v; expected the estimate to start over", rate, eta)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := &limiter{rate: 1000}
+	now := time.Unix(1000, 0)
+
+	if d := l.delay(500, now); d != 500*time.Millisecond {
+		t.Fatalf("delay for 500 bytes at 1000/s is %v", d)
+	}
+	if d := l.delay(500, now.Add(200*time.Millisecond)); d != 800*time.Millisecond {
+		t.Fatalf("delay for the next 500 bytes is %v", d)
+	}
+
+	// Falling well behind schedule starts things over rather than allowing
+	// a burst to catch up.
+	if d := l.delay(100, now.Add(10*time.Second)); d != 100*time.Millisecond {
+		t.Fatalf("delay after a long pause is %v", d)
+	}
+}
+
+func TestWithRateLimit(t *testing.T) {
+	c := newTestClient(t)
+	dir := t.TempDir()
+
+	content := strings.Repeat("x", 3000)
+
+	start := time.Now()
+	if _, err := Write(c, dir, NewFile("f", int64(len(content)), 0644, strings.NewReader(content)), WithRateLimit(10000), WithBufferSize(1000)); err != nil {
+		t.Fatal(err)
+	}
+
+	if d := time.Since(start); d < 250*time.Millisecond {
+		t.Fatalf("3000 bytes at 10000 bytes a second took %v", d)
+	}
+}
@@ -0,0 +1,135 @@
+package protocol
+
+import (
+	"bufio"
+	"io"
+)
+
+// Encoder writes records, status bytes and content to one side of a transfer.
+// Every method flushes what it's written before returning, since the other
+// side won't respond until it has received it.
+type Encoder struct {
+	w *bufio.Writer
+}
+
+// NewEncoder returns an Encoder that writes to w. If w is a *bufio.Writer
+// it's used as it is, so that writes made through it directly, such as of
+// content, stay in order with the Encoder's.
+func NewEncoder(w io.Writer) *Encoder {
+	if bw, ok := w.(*bufio.Writer); ok {
+		return &Encoder{w: bw}
+	}
+
+	return &Encoder{w: bufio.NewWriter(w)}
+}
+
+// WriteRecord writes r followed by a newline, once it's passed Check.
+func (e *Encoder) WriteRecord(r Record) error {
+	if err := r.Check(); err != nil {
+		return err
+	}
+
+	if _, err := e.w.WriteString(r.String() + "\n"); err != nil {
+		return err
+	}
+
+	return e.w.Flush()
+}
+
+// WriteOK writes a zero status byte, which acknowledges whatever the other
+// side sent last, or marks the end of the content of a file.
+func (e *Encoder) WriteOK() error {
+	if err := e.w.WriteByte(OK); err != nil {
+		return err
+	}
+
+	return e.w.Flush()
+}
+
+// WriteStatus writes a status byte of the given severity (Warning or Error)
+// followed by msg, which is run through Sanitize first.
+func (e *Encoder) WriteStatus(severity byte, msg string) error {
+	if err := e.w.WriteByte(severity); err != nil {
+		return err
+	}
+	if _, err := e.w.WriteString(Sanitize(msg) + "\n"); err != nil {
+		return err
+	}
+
+	return e.w.Flush()
+}
+
+// Write writes content, which the other side must already be expecting from
+// a C record.
+func (e *Encoder) Write(p []byte) (int, error) {
+	n, err := e.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	return n, e.w.Flush()
+}
+
+// Decoder reads records, status bytes and content from one side of a
+// transfer. It buffers what it reads, so once it's in use the underlying
+// reader shouldn't be read from directly.
+type Decoder struct {
+	r *bufio.Reader
+}
+
+// NewDecoder returns a Decoder that reads from r. If r is a *bufio.Reader
+// it's used as it is, so that nothing it has buffered is lost and it can
+// still be read from directly in between calls to the Decoder.
+func NewDecoder(r io.Reader) *Decoder {
+	if br, ok := r.(*bufio.Reader); ok {
+		return &Decoder{r: br}
+	}
+
+	return &Decoder{r: bufio.NewReader(r)}
+}
+
+// Peek returns the next byte without consuming it, which is enough to tell
+// whether a record or a status message is coming.
+func (d *Decoder) Peek() (byte, error) {
+	b, err := d.r.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+
+	return b[0], nil
+}
+
+// ReadRecord reads and parses the next record, as ParseRecord does.
+func (d *Decoder) ReadRecord() (Record, error) {
+	l, err := d.ReadLine()
+	if err != nil {
+		return Record{}, err
+	}
+
+	return ParseRecord(l)
+}
+
+// ReadLine reads the next record without parsing it, including its trailing
+// newline, for when it needs to be looked at or logged first. If the stream
+// ends part way through a record, what there was of it is returned along
+// with io.ErrUnexpectedEOF.
+func (d *Decoder) ReadLine() ([]byte, error) {
+	l, err := d.r.ReadBytes('\n')
+	if err == io.EOF && len(l) > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return l, err
+}
+
+// ReadStatus reads the next status byte and its message, as the package-level
+// ReadStatus does.
+func (d *Decoder) ReadStatus() (*Status, error) {
+	return ReadStatus(d.r)
+}
+
+// Read reads content. The caller has to keep track of how much of it is left,
+// from the size in the C record, so as not to read past it.
+func (d *Decoder) Read(p []byte) (int, error) {
+	return d.r.Read(p)
+}
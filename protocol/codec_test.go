@@ -0,0 +1,150 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+
+	steps := []struct {
+		write    func() error
+		expected string
+	}{
+		{func() error { return e.WriteRecord(Record{Kind: 'D', Mode: 0755, Name: "d"}) }, "D0755 0 d\n"},
+		{func() error { return e.WriteRecord(Record{Kind: 'C', Mode: 0644, Size: 5, Name: "a b"}) }, "C0644 5 a b\n"},
+		{func() error { _, err := e.Write([]byte("hello")); return err }, "hello"},
+		{e.WriteOK, "\x00"},
+		{func() error { return e.WriteRecord(Record{Kind: 'E'}) }, "E\n"},
+		{func() error { return e.WriteStatus(Warning, "odd") }, "\x01odd\n"},
+		{func() error { return e.WriteStatus(Error, "bad\nline") }, "\x02bad\\x0aline\n"},
+	}
+
+	// Everything is flushed as it's written, since the other side is
+	// waiting for it.
+	for i, step := range steps {
+		if err := step.write(); err != nil {
+			t.Fatalf("step %d failed: %v", i, err)
+		}
+
+		if got := buf.String(); got != step.expected {
+			t.Fatalf("step %d wrote %q; expected %q", i, got, step.expected)
+		}
+
+		buf.Reset()
+	}
+
+	for _, r := range []Record{{Kind: 'C', Name: "a\nC0644 1 b"}, {Kind: 'D', Name: ".."}, {Kind: 'C'}} {
+		if err := e.WriteRecord(r); err == nil {
+			t.Errorf("%+v was written", r)
+		}
+	}
+	if buf.Len() != 0 {
+		t.Errorf("records that failed their check wrote %q", buf.String())
+	}
+}
+
+func TestEncoderSharesBuffer(t *testing.T) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+
+	w.WriteString("before ")
+	if err := NewEncoder(w).WriteOK(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := buf.String(); got != "before \x00" {
+		t.Fatalf("wrote %q; expected what was buffered to come first", got)
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	d := NewDecoder(strings.NewReader("T1 0 2 0\nC0644 5 a\nhello\x00\x01odd\nE\r\n\x02no\n"))
+
+	expect := func(kind byte) Record {
+		t.Helper()
+
+		b, err := d.Peek()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b != kind {
+			t.Fatalf("next byte is %q; expected %q", b, kind)
+		}
+
+		r, err := d.ReadRecord()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return r
+	}
+
+	expect('T')
+	if r := expect('C'); r.Size != 5 || r.Name != "a" {
+		t.Fatalf("read %+v", r)
+	}
+
+	content := make([]byte, 5)
+	if _, err := io.ReadFull(d, content); err != nil || string(content) != "hello" {
+		t.Fatalf("content was %q, %v", content, err)
+	}
+
+	if st, err := d.ReadStatus(); st != nil || err != nil {
+		t.Fatalf("status after content was %+v, %v", st, err)
+	}
+	if st, err := d.ReadStatus(); err != nil || st.Severity != Warning || st.Message != "odd" {
+		t.Fatalf("warning was %+v, %v", st, err)
+	}
+
+	expect('E')
+
+	if st, err := d.ReadStatus(); err != nil || st.Severity != Error || st.Message != "no" {
+		t.Fatalf("error was %+v, %v", st, err)
+	}
+
+	if _, err := d.ReadRecord(); err != io.EOF {
+		t.Fatalf("ReadRecord at the end gave %v; expected io.EOF", err)
+	}
+	if _, err := d.Peek(); err != io.EOF {
+		t.Fatalf("Peek at the end gave %v; expected io.EOF", err)
+	}
+}
+
+func TestDecoderReadLine(t *testing.T) {
+	d := NewDecoder(strings.NewReader("X1 2 3\nC0644 5"))
+
+	l, err := d.ReadLine()
+	if err != nil || string(l) != "X1 2 3\n" {
+		t.Fatalf("ReadLine gave %q, %v", l, err)
+	}
+
+	if l, err := d.ReadLine(); string(l) != "C0644 5" || err != io.ErrUnexpectedEOF {
+		t.Fatalf("ReadLine of a partial record gave %q, %v; expected it with io.ErrUnexpectedEOF", l, err)
+	}
+
+	d = NewDecoder(strings.NewReader("C0644 5"))
+	if _, err := d.ReadRecord(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("ReadRecord of a partial record gave %v; expected io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestDecoderSharesBuffer(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("C0644 3 a\nabc"))
+
+	if _, err := NewDecoder(r).ReadRecord(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The content is still there to be read directly.
+	if b, err := ioutil.ReadAll(r); err != nil || string(b) != "abc" {
+		t.Fatalf("read %q, %v after the record", b, err)
+	}
+}
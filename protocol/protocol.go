@@ -0,0 +1,264 @@
+// Package protocol implements the framing of the SCP protocol: the C, D, E and
+// T records that describe what's being sent, and the status bytes each side
+// uses to acknowledge the other. It's what package scp is built on, exported
+// for things like proxies and test servers that need to take the protocol
+// apart without running a transfer of their own.
+package protocol
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The status bytes that start a response. OK is sent on its own; the others
+// are followed by a message and a newline.
+const (
+	OK      byte = 0x00
+	Warning byte = 0x01
+	Error   byte = 0x02
+)
+
+// ErrMissingFilename is returned when a C or D record has no filename.
+var ErrMissingFilename = errors.New("missing filename in control record")
+
+// ErrUnsafeFilename is returned (wrapped) for a C or D record whose name isn't
+// a single path element, e.g. "../x" or "/etc/passwd". Honouring such a name
+// could write outside the directory a transfer was meant to go into.
+var ErrUnsafeFilename = errors.New("unsafe filename in control record")
+
+// Record is a single control record. Which fields are used depends on Kind:
+//
+//	'C'  a file, with Mode, Size and Name, whose content follows
+//	'D'  the start of a directory, with Mode and Name
+//	'E'  the end of the current directory
+//	'T'  the times of the C or D record that follows, in ModTime and AccessTime
+type Record struct {
+	Kind byte
+
+	Mode os.FileMode
+	Size int64
+	Name string
+
+	ModTime, AccessTime time.Time
+}
+
+// String encodes the record as it's sent, without its trailing newline. Only
+// the permission, setuid, setgid and sticky bits of Mode are included, and
+// times are sent to the second. The name isn't checked; see Check.
+func (r Record) String() string {
+	switch r.Kind {
+	case 'C':
+		return fmt.Sprintf("C%04o %d %s", modeBits(r.Mode), r.Size, r.Name)
+	case 'D':
+		return fmt.Sprintf("D%04o 0 %s", modeBits(r.Mode), r.Name)
+	case 'T':
+		return fmt.Sprintf("T%d 0 %d 0", r.ModTime.Unix(), r.AccessTime.Unix())
+	}
+
+	return string(r.Kind)
+}
+
+// Check makes sure the record can be sent: that is, for a C or D record, that
+// its name passes CheckName.
+func (r Record) Check() error {
+	if r.Kind == 'C' || r.Kind == 'D' {
+		return CheckName(r.Name)
+	}
+
+	return nil
+}
+
+// ParseRecord parses a single record, with or without its trailing newline.
+// Some servers end their records with "\r\n" rather than "\n", so both are
+// accepted, but only the one "\r": any more would have to be part of a name,
+// which couldn't then be told apart from the line ending. The names in C and D
+// records are checked with CheckName.
+func ParseRecord(l []byte) (Record, error) {
+	line := strings.TrimSuffix(strings.TrimSuffix(string(l), "\n"), "\r")
+	if strings.HasSuffix(line, "\r") {
+		return Record{}, fmt.Errorf("invalid record %q; expected at most one \\r before the newline", l)
+	}
+
+	l = []byte(line)
+	if len(l) == 0 {
+		return Record{}, fmt.Errorf("empty record")
+	}
+
+	switch l[0] {
+	case 'C', 'D':
+		return parseCopy(l)
+	case 'E':
+		if len(l) != 1 {
+			return Record{}, fmt.Errorf("invalid E record %q", l)
+		}
+
+		return Record{Kind: 'E'}, nil
+	case 'T':
+		return parseTime(l)
+	}
+
+	return Record{}, fmt.Errorf("invalid record type; expected C, D, E or T but got %02x", l[0])
+}
+
+// parseCopy parses a C or D record, which share the same format.
+func parseCopy(l []byte) (Record, error) {
+	kind := l[0]
+
+	// The name is everything after the second space, spaces and all.
+	bits := strings.SplitN(string(l), " ", 3)
+	if len(bits) < 2 {
+		return Record{}, fmt.Errorf("invalid %c record %q; expected mode, size and name", kind, l)
+	}
+	if len(bits) < 3 || len(bits[2]) == 0 {
+		return Record{}, ErrMissingFilename
+	}
+
+	rawMode, err := strconv.ParseUint(bits[0][1:], 8, 32)
+	if err != nil {
+		return Record{}, fmt.Errorf("invalid mode %q in %c record", bits[0][1:], kind)
+	}
+
+	size, err := strconv.ParseInt(bits[1], 10, 64)
+	if err != nil || size < 0 {
+		return Record{}, fmt.Errorf("invalid size %q in %c record", bits[1], kind)
+	}
+
+	if err := CheckName(bits[2]); err != nil {
+		return Record{}, err
+	}
+
+	return Record{Kind: kind, Mode: fileMode(uint32(rawMode)), Size: size, Name: bits[2]}, nil
+}
+
+// parseTime parses a T record, which holds the modification and access times
+// of the record that follows as seconds and microseconds since the epoch.
+func parseTime(l []byte) (Record, error) {
+	bits := strings.Fields(string(l[1:]))
+	if len(bits) != 4 {
+		return Record{}, fmt.Errorf("invalid T record; expected 4 fields but got %d", len(bits))
+	}
+
+	var v [4]int64
+	for i, bit := range bits {
+		var err error
+		if v[i], err = strconv.ParseInt(bit, 10, 64); err != nil {
+			return Record{}, fmt.Errorf("invalid T record; field %d is %q", i+1, bit)
+		}
+	}
+
+	return Record{Kind: 'T', ModTime: time.Unix(v[0], v[1]*1000), AccessTime: time.Unix(v[2], v[3]*1000)}, nil
+}
+
+// CheckName makes sure name is a single element of a path, which can't refer
+// to anything outside the directory it's used in, locally or remotely. It
+// also can't contain a newline, which would end the record it's sent in.
+func CheckName(name string) error {
+	if name == "" {
+		return ErrMissingFilename
+	}
+
+	if name == "." || name == ".." || strings.ContainsAny(name, "/\n") || strings.ContainsRune(name, filepath.Separator) {
+		return fmt.Errorf("%w: %q", ErrUnsafeFilename, name)
+	}
+
+	return nil
+}
+
+// Status is a warning or error sent in place of an acknowledgement.
+type Status struct {
+	// Severity is the status byte that introduced the message: either
+	// Warning or Error.
+	Severity byte
+	// Message is the text of the message, with surrounding whitespace
+	// removed and run through Sanitize, so it's safe to print.
+	Message string
+	// Raw is the message exactly as it was received, without the newline
+	// that terminated it.
+	Raw string
+}
+
+// ReadStatus reads a status byte and, if it's not OK, the message that
+// follows it. Nil is returned for OK.
+func ReadStatus(r *bufio.Reader) (*Status, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch b {
+	case OK:
+		return nil, nil
+	case Warning, Error:
+		msg, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		raw := strings.TrimSuffix(msg, "\n")
+
+		return &Status{Severity: b, Message: Sanitize(strings.TrimSpace(raw)), Raw: raw}, nil
+	}
+
+	return nil, fmt.Errorf("invalid response byte; expected 00, 01 or 02 but got %02x", b)
+}
+
+// Sanitize escapes any control characters in msg, so that things like a BEL
+// or a backspace in a message from the other side can't make it ring, rewrite
+// itself or mess up a terminal when it's printed. It also means the result
+// can be sent as a message without ending it early.
+func Sanitize(msg string) string {
+	var b strings.Builder
+
+	for _, r := range msg {
+		if unicode.IsControl(r) {
+			fmt.Fprintf(&b, "\\x%02x", r)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+
+	return b.String()
+}
+
+// modeBits converts m to the Unix permission bits used on the wire, including
+// the setuid, setgid and sticky bits, which os.FileMode keeps elsewhere.
+func modeBits(m os.FileMode) uint32 {
+	b := uint32(m.Perm())
+
+	if m&os.ModeSetuid != 0 {
+		b |= 04000
+	}
+	if m&os.ModeSetgid != 0 {
+		b |= 02000
+	}
+	if m&os.ModeSticky != 0 {
+		b |= 01000
+	}
+
+	return b
+}
+
+// fileMode is the inverse of modeBits.
+func fileMode(b uint32) os.FileMode {
+	m := os.FileMode(b) & os.ModePerm
+
+	if b&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if b&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if b&01000 != 0 {
+		m |= os.ModeSticky
+	}
+
+	return m
+}
@@ -0,0 +1,347 @@
+package scp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// receiver drives a remote scp running in "from" mode that may send any
+// number of files, handing them out one at a time and collecting any warnings
+// it sends along the way.
+type receiver struct {
+	o      *options
+	s      *ssh.Session
+	rw     *bufio.ReadWriter
+	stderr *stderrBuffer
+
+	// stop stops watching the transfer's context.
+	stop func()
+
+	// stack holds the names of the directories the remote side has
+	// descended into.
+	stack []string
+
+	// Times from a T record apply to the C or D record that follows it.
+	mtime, atime time.Time
+
+	// content is what's left of the content of the last file handed out,
+	// which is called path and has size bytes in all.
+	content *io.LimitedReader
+	path    string
+	size    int64
+
+	warnings []string
+	// firstWarning is the first of them as it was received.
+	firstWarning *ProtocolError
+}
+
+// startReceiver starts the remote scp with the given flags (e.g. "-qf" or
+// "-rqf") on path, a pattern if glob is true, and prompts it to start sending.
+func startReceiver(c *ssh.Client, o *options, flags, path string, glob bool) (r *receiver, err error) {
+	s, err := c.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	stop := o.watch(s)
+	stderr := newStderrBuffer(s)
+	defer func() {
+		if err != nil {
+			err = stderr.annotate(s, err)
+			s.Close()
+			stop()
+		}
+	}()
+
+	stdout, err := s.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stdin, err := s.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	var cmd string
+	if glob {
+		cmd, err = o.globCommand(o.sourceProgram(), flags, path)
+	} else {
+		cmd, err = o.command(o.sourceProgram(), flags, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.Start(cmd); err != nil {
+		return nil, err
+	}
+
+	r = &receiver{o: o, s: s, rw: o.readWriter(stdout, stdin), stderr: stderr, stop: stop}
+
+	if err := o.sendOK(r.rw.Writer); err != nil {
+		return nil, err
+	}
+
+	// As with Read, a zero byte announcing that the remote side is ready is
+	// skipped over if there is one.
+	if b, err := r.rw.Peek(1); err == nil && b[0] == 0 {
+		r.rw.Discard(1)
+		o.traceStatus("<", nil)
+	}
+
+	return r, nil
+}
+
+func (r *receiver) warn(name string, pe *ProtocolError) {
+	if r.firstWarning == nil {
+		r.firstWarning = pe
+	}
+	r.warnings = append(r.warnings, pe.Message)
+
+	r.o.emit(Event{Type: EventWarning, Name: name, Message: pe.Message})
+}
+
+// next finishes off the last file handed out, discarding whatever is left of
+// its content, and reads records until the next file, which it returns. Its
+// content streams straight off the session, so it's only valid until next is
+// called again. Once the remote side has nothing more to send, next returns
+// io.EOF.
+func (r *receiver) next() (*File, error) {
+	// A callback that panicked, perhaps while the last file's content was
+	// being read by a caller that ignored the error, ends the transfer.
+	if r.o.callbackErr != nil {
+		return nil, r.o.callbackErr
+	}
+
+	f, err := r.read()
+	if err != nil {
+		return nil, r.stderr.annotate(r.s, err)
+	}
+	if r.o.callbackErr != nil {
+		return nil, r.o.callbackErr
+	}
+
+	if f == nil {
+		// The remote scp exits with a non-zero status after sending any
+		// warning, which has already been reported as such.
+		if r.o.teardown == TeardownDrainWait {
+			if err := wait(r.s); err != nil && len(r.warnings) == 0 {
+				return nil, r.stderr.annotate(r.s, err)
+			}
+		}
+
+		return nil, io.EOF
+	}
+
+	return f, nil
+}
+
+// read does the work of next, returning nil with no error once the remote
+// side has finished.
+func (r *receiver) read() (*File, error) {
+	if err := r.finish(); err != nil {
+		return nil, err
+	}
+
+	for {
+		b, err := r.rw.ReadByte()
+		if err == io.EOF {
+			if len(r.stack) != 0 {
+				return nil, fmt.Errorf("remote scp exited inside %s", path.Join(r.stack...))
+			}
+
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		if err := r.rw.UnreadByte(); err != nil {
+			return nil, err
+		}
+
+		switch b {
+		case SeverityWarning, SeverityError:
+			pe, err := r.o.readResponse(r.rw.Reader)
+			if err != nil {
+				return nil, err
+			}
+
+			if pe.Severity == SeverityError {
+				return nil, pe
+			}
+
+			r.warn(path.Join(r.stack...), pe)
+
+			continue
+		}
+
+		l, err := r.o.readRecord(r.rw.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		switch b {
+		case 'T':
+			r.mtime, r.atime, err = parseTime(l)
+			if err != nil {
+				return nil, err
+			}
+		case 'D':
+			mode, _, name, err := parseRecord('D', l)
+			if err != nil {
+				return nil, err
+			}
+
+			if len(r.stack) >= r.o.depthLimit() {
+				return nil, fmt.Errorf("%w: %s is more than %d levels down", ErrTooDeep, path.Join(append(r.stack, name)...), r.o.depthLimit())
+			}
+
+			r.stack = append(r.stack, name)
+
+			if r.o.directories {
+				if err := r.o.sendOK(r.rw.Writer); err != nil {
+					return nil, err
+				}
+
+				return r.dir(mode, name), nil
+			}
+
+			r.mtime, r.atime = time.Time{}, time.Time{}
+		case 'E':
+			if len(r.stack) == 0 {
+				return nil, fmt.Errorf("unexpected E record at top level")
+			}
+
+			r.stack = r.stack[:len(r.stack)-1]
+		case 'C':
+			return r.file(l)
+		default:
+			return nil, fmt.Errorf("invalid record type; expected C, D, E or T but got %02x", b)
+		}
+
+		if err := r.o.sendOK(r.rw.Writer); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// file acknowledges the C record l and returns a File for the content that
+// follows it.
+func (r *receiver) file(l []byte) (*File, error) {
+	mode, size, name, err := parseCopy(l)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.o.sendOK(r.rw.Writer); err != nil {
+		return nil, err
+	}
+
+	p := path.Join(append(r.stack, name)...)
+
+	r.content = &io.LimitedReader{R: r.rw, N: size}
+	r.path = p
+	r.size = size
+
+	var read int64
+	f := NewFile(name, size, mode, &progressReader{r: shortReader{r.content}, fn: func(n int64) error {
+		r.o.emit(Event{Type: EventProgress, Name: p, Transferred: n, Total: size})
+		if r.o.callbackErr != nil {
+			return r.o.callbackErr
+		}
+
+		err := r.o.throttle(int(n - read))
+		read = n
+
+		return err
+	}})
+	f.path = p
+	f.mtime = r.mtime
+	f.atime = r.atime
+	f.transferID = r.o.transferID
+	r.mtime, r.atime = time.Time{}, time.Time{}
+
+	return f, nil
+}
+
+// shortReader reads from a LimitedReader, returning io.ErrUnexpectedEOF if the
+// reader beneath it runs out before the limit is reached.
+type shortReader struct {
+	*io.LimitedReader
+}
+
+func (r shortReader) Read(p []byte) (int, error) {
+	n, err := r.LimitedReader.Read(p)
+	if err == io.EOF && r.N > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
+
+// dir returns a File describing the directory the remote side has just
+// descended into, which is called name and has the given mode.
+func (r *receiver) dir(mode os.FileMode, name string) *File {
+	f := NewFile(name, 0, mode|os.ModeDir, strings.NewReader(""))
+	f.dir = true
+	f.path = path.Join(r.stack...)
+	f.mtime = r.mtime
+	f.atime = r.atime
+	f.transferID = r.o.transferID
+	r.mtime, r.atime = time.Time{}, time.Time{}
+
+	return f
+}
+
+// finish discards whatever is left of the content of the last file handed
+// out, and reads and acknowledges the status byte that follows it.
+func (r *receiver) finish() error {
+	lr := r.content
+	if lr == nil {
+		return nil
+	}
+	r.content = nil
+
+	if _, err := io.Copy(ioutil.Discard, lr); err != nil {
+		return err
+	}
+	if lr.N > 0 {
+		return fmt.Errorf("content of %s ended after %d of %d bytes", r.path, r.size-lr.N, r.size)
+	}
+
+	// The content is followed by a status byte saying whether the remote
+	// side managed to read all of it, unless it's one that doesn't send one.
+	if r.o.skipFinalStatus {
+		return r.o.sendOK(r.rw.Writer)
+	}
+
+	pe, err := r.o.readResponse(r.rw.Reader)
+	if err != nil {
+		return err
+	}
+
+	if pe != nil {
+		if pe.Severity == SeverityError {
+			return pe
+		}
+
+		r.warn(r.path, pe)
+	}
+
+	return r.o.sendOK(r.rw.Writer)
+}
+
+// close shuts the session down, whether or not the remote side had finished.
+func (r *receiver) close() {
+	r.s.Close()
+	r.stop()
+}
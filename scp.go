@@ -3,16 +3,18 @@ package scp
 
 import (
 	"bufio"
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/kballard/go-shellquote"
+	"fknsrs.biz/p/scp/protocol"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -23,11 +25,79 @@ import (
 type File struct {
 	io.Reader
 
-	name string
-	size int64
-	mode os.FileMode
+	name  string
+	path  string
+	dir   bool
+	size  int64
+	mode  os.FileMode
+	mtime time.Time
+	atime time.Time
+
+	transferID string
+	digest     *digest
+	result     *readResult
+
+	abort func()
+	close func() error
 }
 
+// ErrTruncated is returned by ReadLimit when the remote file was larger than
+// the requested limit and the rest of the transfer was abandoned.
+var ErrTruncated = errors.New("transfer truncated at limit")
+
+// ErrFilenameRejected is returned (wrapped) when the remote scp refuses a file
+// because of its name, as OpenSSH's does with one that isn't a single path
+// element.
+var ErrFilenameRejected = errors.New("filename rejected by remote scp")
+
+// ErrMissingFilename is returned when the remote side sends a control record
+// without a filename.
+var ErrMissingFilename = protocol.ErrMissingFilename
+
+// ErrUnsafeFilename is returned (wrapped) when the remote side sends a C or D
+// record whose name isn't a single path element, e.g. "../x" or "/etc/passwd".
+// A well-behaved scp never does that, and honouring the name could let a
+// malicious server write outside the directory a file was meant to be read
+// into.
+var ErrUnsafeFilename = protocol.ErrUnsafeFilename
+
+// ErrNotWritable is returned (wrapped) by CheckWritable, and by Write when
+// using WithWritableCheck, if files can't be created in the target directory.
+var ErrNotWritable = errors.New("remote directory is not writable")
+
+// ErrStalled is returned (wrapped) through the File's Reader when reading with
+// WithStallTimeout and the content stops arriving for longer than allowed.
+var ErrStalled = errors.New("content stalled")
+
+// ErrNotPlaced is returned (wrapped) by Write when using WithVerifyPlacement
+// and the file can't be found where it should have been written.
+var ErrNotPlaced = errors.New("file not found where it was written")
+
+// ErrSizeMismatch is returned (wrapped) through the File's Reader when reading
+// with WithVerifySize and the size of the remote file doesn't match what was
+// announced and received, which usually means it changed during the transfer.
+// ReadFile returns it (wrapped) with WithResume if the resumed copy doesn't
+// come out the same size as the remote file.
+var ErrSizeMismatch = errors.New("remote file size mismatch")
+
+// ErrChecksumMismatch is returned (wrapped) by Write when using WithChecksum
+// and the digest of the remote file doesn't match that of the content sent.
+var ErrChecksumMismatch = errors.New("remote file checksum mismatch")
+
+// ErrTooDeep is returned (wrapped) by the recursive transfers when a tree has
+// more levels of directories than WithMaxDepth allows.
+var ErrTooDeep = errors.New("directory tree too deep")
+
+// ErrDuplicateName is returned (wrapped) in the results of ReadMany for a file
+// whose base name is the same as that of an earlier one, and which would have
+// been read over it.
+var ErrDuplicateName = errors.New("duplicate file name")
+
+// ErrNoMatch is returned (wrapped) by Glob.Next when the pattern given to
+// ReadGlob matched nothing. It's wrapped in the ProtocolError the remote scp
+// sent to say so, which keeps its message.
+var ErrNoMatch = errors.New("pattern matched nothing")
+
 // NewFile constructs a new File object with the given parameters. The size must
 // be provided in advance because the remote host has to know how large the file
 // is, so it can reject it in advance if there's not enough space.
@@ -40,9 +110,25 @@ func NewFile(name string, size int64, mode os.FileMode, r io.Reader) *File {
 	}
 }
 
-// IsDir will always return false.
+// NewFileFromInfo constructs a new File object taking its name, size, mode and
+// modification time from info, which is useful when r comes from something
+// that already describes itself with an os.FileInfo. Directories can't be sent
+// this way, so an error is returned if info describes one.
+func NewFileFromInfo(info os.FileInfo, r io.Reader) (*File, error) {
+	if info.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", info.Name())
+	}
+
+	f := NewFile(info.Name(), info.Size(), info.Mode(), r)
+	f.mtime = info.ModTime()
+
+	return f, nil
+}
+
+// IsDir returns true only for the directories ReadDir reports when using
+// WithDirectories, which have no content.
 func (f File) IsDir() bool {
-	return false
+	return f.dir
 }
 
 // Name returns the name of the file. It does not include the full path.
@@ -50,6 +136,17 @@ func (f File) Name() string {
 	return f.name
 }
 
+// Path returns the slash-separated path of the file relative to the root of
+// the transfer. For a file received by ReadDir it includes the directories it
+// was found in; otherwise it's the same as Name.
+func (f File) Path() string {
+	if f.path == "" {
+		return f.name
+	}
+
+	return f.path
+}
+
 // Size returns the size of the file in bytes.
 func (f File) Size() int64 {
 	return f.size
@@ -60,10 +157,25 @@ func (f File) Mode() os.FileMode {
 	return f.mode
 }
 
-// ModTime returns the modification time of the file. It is currently not
-// implemented and returns a zero value.
+// ModTime returns the modification time of the file. It returns a zero value
+// unless the time was made available, e.g. by reading with WithPreserve or
+// WithStatModTime.
 func (f File) ModTime() time.Time {
-	return time.Time{}
+	return f.mtime
+}
+
+// AccessTime returns the access time of the file. It returns a zero value
+// unless the remote side sent it, i.e. when reading with WithPreserve.
+func (f File) AccessTime() time.Time {
+	return f.atime
+}
+
+// SetTimes sets the modification and access times of the file, which Write
+// sends to the remote side when using WithPreserve. A zero atime is sent as
+// mtime, and a zero mtime means no times are sent at all.
+func (f *File) SetTimes(mtime, atime time.Time) {
+	f.mtime = mtime
+	f.atime = atime
 }
 
 // Sys always returns nil.
@@ -71,6 +183,110 @@ func (f File) Sys() interface{} {
 	return nil
 }
 
+// TransferID returns the identifier of the transfer that produced the file, as
+// attached to its events. It's empty for files that weren't produced by Read.
+func (f File) TransferID() string {
+	return f.transferID
+}
+
+// Close releases any resources held on behalf of the file, such as the
+// temporary file behind one made by NewGzipFile. For a File returned by Read,
+// it abandons the transfer if it's still going, closing the session, and waits
+// for it to end, so that Err has the outcome; any further reads return
+// io.ErrClosedPipe. It's safe to call on any File, and does nothing if there's
+// nothing to release.
+func (f File) Close() error {
+	if f.close == nil {
+		return nil
+	}
+
+	return f.close()
+}
+
+// Err returns the error that ended the transfer behind a File returned by
+// Read, once it's over: after the Reader has returned io.EOF or an error, or
+// after Close. Until then, for a transfer that succeeded, and for a File that
+// didn't come from Read, it's nil.
+//
+// Read has no warnings to report apart from that: the only thing the remote
+// scp can warn about once it has started sending a single file is that its
+// content can't be trusted, so a warning ends the transfer, and Err returns it
+// as a *ProtocolError with SeverityWarning. If the File was closed before the
+// transfer ended, it was abandoned, and Err returns io.ErrClosedPipe.
+func (f File) Err() error {
+	if f.result == nil {
+		return nil
+	}
+
+	return f.result.get()
+}
+
+// readResult is the outcome of the transfer behind a File returned by Read.
+type readResult struct {
+	// done is closed once err has been set.
+	done chan struct{}
+	err  error
+
+	mu        sync.Mutex
+	abandoned bool
+}
+
+func (r *readResult) get() error {
+	select {
+	case <-r.done:
+	default:
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.abandoned && r.err != nil {
+		return io.ErrClosedPipe
+	}
+
+	return r.err
+}
+
+// abandon records that the transfer is being abandoned, if it isn't over yet.
+func (r *readResult) abandon() {
+	select {
+	case <-r.done:
+		return
+	default:
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.abandoned = true
+}
+
+// ReaderWithMode is an io.Reader that also knows the mode of the file its
+// content belongs to, so that code downstream of a transfer can set local
+// permissions without being handed the whole File. *File implements it.
+type ReaderWithMode interface {
+	io.Reader
+	Mode() os.FileMode
+}
+
+// NewReaderWithMode wraps r so that it reports the given mode. It's useful for
+// keeping hold of the mode when a File's content is wrapped in something else,
+// like a decompressor.
+func NewReaderWithMode(r io.Reader, mode os.FileMode) ReaderWithMode {
+	return modeReader{Reader: r, mode: mode}
+}
+
+type modeReader struct {
+	io.Reader
+
+	mode os.FileMode
+}
+
+func (r modeReader) Mode() os.FileMode {
+	return r.mode
+}
+
 // Read opens a session on the provided ssh.Client to run the scp program
 // remotely in "from" mode, and handles the SCP protocol to the degree required
 // to read the content of a single file.
@@ -78,219 +294,653 @@ func (f File) Sys() interface{} {
 // Errors that occur before the content is being read will be returned directly
 // from Read, while errors that occur during content reception will be returned
 // via the Reader (e.g. from Reader.Read).
-func Read(c *ssh.Client, file string) (*File, error) {
-	s, err := c.NewSession()
-	if err != nil {
-		return nil, err
-	}
+func Read(c *ssh.Client, file string, opts ...Option) (*File, error) {
+	return ReadContext(context.Background(), c, file, opts...)
+}
 
-	stdout, err := s.StdoutPipe()
+// ReadContext is like Read, but gives up when ctx is done, closing the session
+// and returning ctx.Err(). That applies to the content too: if ctx is done
+// before it has all been read, the File's Reader returns ctx.Err().
+func ReadContext(ctx context.Context, c *ssh.Client, file string, opts ...Option) (f *File, err error) {
+	o, err := newOptions(opts)
 	if err != nil {
 		return nil, err
 	}
 
-	stdin, err := s.StdinPipe()
-	if err != nil {
-		return nil, err
+	o.ctx = ctx
+
+	// Once the content is being received, it's up to the goroutine doing
+	// so to report that the transfer is done.
+	var receiving bool
+
+	o.emit(Event{Type: EventStart, Name: file})
+	defer func() {
+		if err != nil && !receiving {
+			o.emit(Event{Type: EventDone, Name: file, Err: err})
+		}
+	}()
+	if o.callbackErr != nil {
+		return nil, o.callbackErr
 	}
 
-	rw := bufio.NewReadWriter(bufio.NewReader(stdout), bufio.NewWriter(stdin))
+	var mtime time.Time
+	if o.statModTime {
+		t, err := remoteModTime(c, file)
+		if err != nil {
+			return nil, err
+		}
 
-	if err := s.Start(shellquote.Join("scp", "-qf", file)); err != nil {
-		return nil, err
+		mtime = t
 	}
 
-	if err := rw.WriteByte(0); err != nil {
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
-	if err := rw.Flush(); err != nil {
+
+	s, err := c.NewSession()
+	if err != nil {
 		return nil, err
 	}
 
-	b, err := rw.ReadByte()
+	stop := o.watch(s)
+	stderr := newStderrBuffer(s)
+	defer func() {
+		if err != nil {
+			err = o.contextErr(stderr.annotate(s, err))
+			s.Close()
+			stop()
+		}
+	}()
+
+	stdout, err := s.StdoutPipe()
 	if err != nil {
 		return nil, err
 	}
 
-	switch b {
-	case 0x01, 0x02:
-		l, err := rw.ReadBytes('\n')
-		if err != nil && err != io.EOF {
-			return nil, err
-		}
+	stdin, err := s.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
 
-		m := map[byte]string{
-			0x01: "warning",
-			0x02: "error",
-		}
+	rw := o.readWriter(stdout, stdin)
 
-		return nil, fmt.Errorf("%s: %q", m[b], string(bytes.TrimRight(l, "\n")))
+	flags := "-qf"
+	if o.preserve {
+		flags = "-pqf"
 	}
 
-	if err := rw.UnreadByte(); err != nil {
+	cmd, err := o.command(o.sourceProgram(), flags, file)
+	if err != nil {
 		return nil, err
 	}
 
-	l, err := rw.ReadBytes('\n')
-	if err != nil {
+	if err := s.Start(cmd); err != nil {
 		return nil, err
 	}
 
-	mode, size, name, err := parseCopy(l)
+	h, err := readHeader(o, rw)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := rw.WriteByte(0); err != nil {
-		return nil, err
+	mode, size, name := h.mode, h.size, h.name
+	if !h.mtime.IsZero() {
+		mtime = h.mtime
 	}
-	if err := rw.Flush(); err != nil {
-		return nil, err
+
+	if !o.skipHeaderAck {
+		if err := o.sendOK(rw.Writer); err != nil {
+			return nil, err
+		}
 	}
 
 	r, w := io.Pipe()
 
+	var d *digest
+	if o.newHash != nil {
+		d = &digest{h: o.newHash()}
+	}
+
+	res := &readResult{done: make(chan struct{})}
+
+	receiving = true
+
 	go func() {
 		defer s.Close()
+		defer stop()
+
+		var t int64
 
 		var err error
 
 		defer func() {
+			err = o.contextErr(err)
+
+			// The sum has to be stored before the pipe is closed, so that
+			// it's there by the time the reader sees EOF.
+			if err == nil && d != nil && t == size {
+				d.sum = d.h.Sum(nil)
+			}
+
+			// Likewise the outcome, for Err.
+			res.err = err
+			close(res.done)
+
 			if err != nil {
 				w.CloseWithError(err)
 			} else {
 				w.Close()
 			}
+
+			o.emit(Event{Type: EventDone, Name: file, RecordName: name, Transferred: t, Total: size, Err: err})
 		}()
 
 		err = func() error {
-			t := 0
+			// If the content stops arriving for too long, e.g. because the
+			// file was truncated underneath the remote scp, closing the
+			// session is the only way to unblock the read below. The timer
+			// only runs while waiting on the remote, so a slow consumer of
+			// the pipe doesn't count as a stall.
+			stalled := make(chan struct{})
+
+			var timer *time.Timer
+			if o.stallTimeout > 0 {
+				timer = time.AfterFunc(o.stallTimeout, func() {
+					close(stalled)
+					s.Close()
+				})
+				timer.Stop()
+			}
 
-			for {
-				b := make([]byte, min(1024, int(size)-t))
+			buf := make([]byte, o.chunkSize())
+
+			// An empty file has no content to wait for, just the status
+			// byte, so the loop is skipped entirely rather than relying on a
+			// zero-length read to end it.
+			for t < size {
+				b := buf[:min(int64(len(buf)), size-t)]
+
+				if timer != nil {
+					timer.Reset(o.stallTimeout)
+				}
+
+				// The header was read through rw, so some of the content
+				// may already be sitting in its buffer; reading stdout
+				// directly would skip over it.
+				n, err := rw.Read(b)
+				if timer != nil {
+					timer.Stop()
+				}
+				if err != nil {
+					select {
+					case <-stalled:
+						return fmt.Errorf("%w after %d of %d bytes", ErrStalled, t, size)
+					default:
+					}
+				}
 
-				n, err := stdout.Read(b)
 				if err == io.EOF {
-					break
+					return fmt.Errorf("content of %s ended after %d of %d bytes: %w", name, t, size, io.ErrUnexpectedEOF)
 				} else if err != nil {
 					return err
 				}
 
-				w.Write(b[0:n])
-				t += n
+				// The write only fails once the reader has been closed,
+				// i.e. the File has been closed or abandoned, so there's no
+				// point receiving any more.
+				if _, err := w.Write(b[0:n]); err != nil {
+					return err
+				}
+				t += int64(n)
+
+				if d != nil {
+					d.h.Write(b[0:n])
+				}
 
-				if int64(t) == size {
-					break
+				o.emit(Event{Type: EventProgress, Name: file, RecordName: name, Transferred: t, Total: size})
+				if o.callbackErr != nil {
+					return o.callbackErr
+				}
+
+				if err := o.throttle(n); err != nil {
+					return err
 				}
 			}
 
-			if err := rw.WriteByte(0); err != nil {
-				return err
+			// The content is followed by a status byte. Anything but a zero
+			// means the remote side couldn't read the whole file, e.g.
+			// because it shrank, and padded out what it sent, so the content
+			// can't be trusted even though it's the right length.
+			if !o.skipFinalStatus {
+				pe, err := o.readResponse(rw.Reader)
+				if err == io.EOF {
+					// The remote scp has gone, most likely having said why
+					// on stderr, which is only complete once it's exited.
+					wait(s)
+
+					return stderr.annotate(s, fmt.Errorf("no status after content of %s: %w", name, io.ErrUnexpectedEOF))
+				} else if err != nil {
+					return err
+				}
+				if pe != nil {
+					return pe
+				}
 			}
-			if err := rw.Flush(); err != nil {
+
+			if err := o.sendOK(rw.Writer); err != nil {
 				return err
 			}
 
-			if _, err = io.Copy(ioutil.Discard, rw); err == io.EOF {
-				return nil
-			} else if err != nil {
-				return err
+			if o.teardown == TeardownDrainWait {
+				if _, err := io.Copy(ioutil.Discard, rw); err != nil {
+					return err
+				}
+
+				if err := wait(s); err != nil {
+					return stderr.annotate(s, err)
+				}
+			}
+
+			if o.verifySize {
+				n, err := remoteSize(c, file)
+				if err != nil {
+					return err
+				}
+
+				if n != size || t != size {
+					return fmt.Errorf("%w: expected %d bytes, received %d, remote file now has %d", ErrSizeMismatch, size, t, n)
+				}
 			}
 
 			return nil
 		}()
 	}()
 
-	return NewFile(name, size, mode, r), nil
+	f = NewFile(name, size, mode, r)
+	f.mtime = mtime
+	f.atime = h.atime
+	f.transferID = o.transferID
+	f.digest = d
+	f.result = res
+	f.abort = func() {
+		r.Close()
+		s.Close()
+	}
+	f.close = func() error {
+		res.abandon()
+		f.abort()
+		<-res.done
+
+		return nil
+	}
+
+	if o.tempFile {
+		return spool(f, o.tempDir)
+	}
+
+	return f, nil
 }
 
-// Write writes the given File to the directory specified. It returns a list of
-// warnings and maybe an error on failure. Warnings are non-fatal, errors are
-// fatal. If there are warnings returned, they're probably important.
-func Write(c *ssh.Client, dir string, file *File) ([]string, error) {
-	s, err := c.NewSession()
-	if err != nil {
+// readHeader prompts the remote source to start, and reads everything it
+// sends ahead of the content of the file: an optional readiness byte, an
+// optional T record and the C record, which is left unacknowledged. The File
+// it returns has no Reader.
+func readHeader(o *options, rw *bufio.ReadWriter) (*File, error) {
+	if err := o.sendOK(rw.Writer); err != nil {
 		return nil, err
 	}
-	defer s.Close()
 
-	stdout, err := s.StdoutPipe()
+	b, err := rw.ReadByte()
 	if err != nil {
 		return nil, err
 	}
 
-	stdin, err := s.StdinPipe()
-	if err != nil {
-		return nil, err
+	// Some servers announce that they're ready with a zero byte of their
+	// own before sending anything else, as a sink would.
+	if b == 0 {
+		o.traceStatus("<", nil)
+
+		b, err = rw.ReadByte()
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	rw := bufio.NewReadWriter(bufio.NewReader(stdout), bufio.NewWriter(stdin))
+	// With -p, the times come in a record of their own ahead of the C
+	// record. Servers are free to leave it out, so it's only handled if it's
+	// there.
+	var mtime, atime time.Time
+	if b == 'T' {
+		if err := rw.UnreadByte(); err != nil {
+			return nil, err
+		}
 
-	if err := s.Start(shellquote.Join("scp", "-t", dir)); err != nil {
-		return nil, err
+		l, err := o.readRecord(rw.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		mtime, atime, err = parseTime(l)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := o.sendOK(rw.Writer); err != nil {
+			return nil, err
+		}
+
+		b, err = rw.ReadByte()
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	if _, err := rw.WriteString(fmt.Sprintf("C0%s %d %s\n", strconv.FormatUint(uint64(file.Mode()), 8), file.Size(), file.Name())); err != nil {
+	if err := rw.UnreadByte(); err != nil {
 		return nil, err
 	}
-	if err := rw.Flush(); err != nil {
-		return nil, err
+
+	// The remote side can refuse to send the file at all, e.g. because it
+	// doesn't exist, in which case there's a message in place of the header.
+	// Even a warning means there's nothing more to come.
+	if b == SeverityWarning || b == SeverityError {
+		pe, err := o.readResponse(rw.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, pe
 	}
 
-	if err := rw.WriteByte(0); err != nil {
+	l, err := o.readRecord(rw.Reader)
+	if err != nil {
 		return nil, err
 	}
-	if err := rw.Flush(); err != nil {
+
+	mode, size, name, err := parseCopy(l)
+	if err != nil {
 		return nil, err
 	}
 
-	var warnings []string
+	f := NewFile(name, size, mode, nil)
+	f.mtime = mtime
+	f.atime = atime
 
-	if b, err := rw.ReadByte(); err != nil {
-		return nil, err
-	} else if b == 1 || b == 2 {
-		msg, err := rw.ReadString('\n')
+	return f, nil
+}
+
+// ReadLimit reads the given remote file like Read, but copies at most n bytes
+// of its content to w. If the file is larger than n, the session is closed as
+// soon as the limit is reached and ErrTruncated is returned along with the
+// number of bytes written.
+func ReadLimit(c *ssh.Client, file string, w io.Writer, n int64, opts ...Option) (int64, error) {
+	if n < 0 {
+		return 0, fmt.Errorf("negative limit %d", n)
+	}
+
+	f, err := Read(c, file, opts...)
+	if err != nil {
+		return 0, err
+	}
+
+	if f.Size() <= n {
+		written, err := io.Copy(w, f)
 		if err != nil {
-			return nil, err
+			f.abort()
 		}
 
-		msg = strings.TrimSpace(msg)
+		return written, err
+	}
 
-		if b == 2 {
-			return nil, fmt.Errorf(msg)
-		}
+	written, err := io.CopyN(w, f, n)
+	f.abort()
+	if err != nil {
+		return written, err
+	}
 
-		warnings = append(warnings, msg)
+	return written, ErrTruncated
+}
+
+// ReadToWriterAt reads the given remote file like Read, writing its content to
+// w starting at off. This lets pieces of a file that are fetched separately
+// be assembled in place, and works just as well for a whole file at offset 0.
+// It returns the number of bytes written, and an error if that isn't the full
+// size announced by the remote side. If the content wouldn't fit between off
+// and the largest possible offset, the transfer is abandoned before anything is
+// written.
+func ReadToWriterAt(c *ssh.Client, file string, w io.WriterAt, off int64, opts ...Option) (int64, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
 	}
 
-	if _, err := io.Copy(rw, file); err != nil {
-		return warnings, err
+	f, err := Read(c, file, opts...)
+	if err != nil {
+		return 0, err
+	}
+
+	if f.Size() > math.MaxInt64-off {
+		f.abort()
+		return 0, fmt.Errorf("%d bytes of %s at offset %d would overflow", f.Size(), f.Name(), off)
+	}
+
+	n, err := io.Copy(&offsetWriter{w: w, off: off}, f)
+	if err != nil {
+		f.abort()
+		return n, err
+	}
+
+	if n != f.Size() {
+		f.abort()
+		return n, fmt.Errorf("received %d of %d bytes of %s", n, f.Size(), f.Name())
+	}
+
+	return n, nil
+}
+
+// offsetWriter writes sequentially to an io.WriterAt, starting at off.
+type offsetWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.w.WriteAt(p, w.off)
+	w.off += int64(n)
+
+	return n, err
+}
+
+// Write writes the given File to the directory specified. It returns a list of
+// warnings and maybe an error on failure. Warnings are non-fatal, errors are
+// fatal. If there are warnings returned, they're probably important. Any
+// message received before the content has been sent means the remote side
+// has refused the file, so it's returned as an error.
+//
+// The remote scp decides what dir means: if it names an existing directory,
+// the file is created inside it, and otherwise dir is taken to be the path of
+// the file itself, with the File's name ignored. Absolute and relative paths
+// are both fine; relative ones are resolved against the remote user's home
+// directory. WithVerifyPlacement can be used to make sure the file ended up
+// where it was expected.
+//
+// The content is streamed from the File's Reader as it's sent, through a
+// fixed-size buffer, and a read is only made once the previous chunk has been
+// accepted by the SSH channel. A slow producer simply slows the transfer down,
+// and a fast one is held back by the remote side's window, so memory use
+// stays bounded regardless of the size of the file.
+func Write(c *ssh.Client, dir string, file *File, opts ...Option) ([]string, error) {
+	return WriteContext(context.Background(), c, dir, file, opts...)
+}
+
+// WriteContext is like Write, but gives up when ctx is done, closing the
+// session and returning ctx.Err().
+func WriteContext(ctx context.Context, c *ssh.Client, dir string, file *File, opts ...Option) (warnings []string, err error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	o.ctx = ctx
+
+	o.emit(Event{Type: EventStart, Name: file.Name(), Total: file.Size()})
+	defer func() {
+		o.emit(Event{Type: EventDone, Name: file.Name(), Total: file.Size(), Err: err})
+	}()
+	defer func() {
+		err = o.contextErr(err)
+	}()
+	if o.callbackErr != nil {
+		return nil, o.callbackErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-	if err := rw.Flush(); err != nil {
+
+	// A single file has nothing to overlap with, and its warnings have to
+	// be returned from here.
+	o.pipelining = false
+
+	w, err := newWriter(c, dir, o)
+	if err != nil {
+		return nil, err
+	}
+
+	if warnings, err = w.write(file); err != nil {
+		// A failed check after the content was sent, like
+		// WithVerifyPlacement's, leaves the session open; Close shuts it down
+		// (and does nothing if the session is already gone).
+		w.Close()
+
 		return warnings, err
 	}
 
-	if b, err := rw.ReadByte(); err != nil {
+	return warnings, w.Close()
+}
+
+// The status bytes that introduce a message from the remote scp.
+const (
+	// SeverityWarning introduces a warning. Warnings sent after the content
+	// of a file are returned in the list of warnings from Write and friends;
+	// at any other point they stop the transfer.
+	SeverityWarning = protocol.Warning
+	// SeverityError introduces a fatal error.
+	SeverityError = protocol.Error
+)
+
+// ProtocolError is a warning or error message sent by the remote scp. Read and
+// Write return it when the remote side refuses a transfer, so errors.As can
+// be used to get at the severity and message, e.g. to decide whether to retry.
+type ProtocolError struct {
+	// Severity is the status byte that introduced the message: either
+	// SeverityWarning or SeverityError.
+	Severity byte
+	// Message is the text of the message, with surrounding whitespace
+	// removed and any control characters escaped, so it's safe to print.
+	Message string
+	// Raw is the message exactly as it was received, without the newline
+	// that terminated it.
+	Raw string
+
+	// noMatch is set on the warning a Glob returns for a pattern that
+	// matched nothing.
+	noMatch bool
+}
+
+// Error returns the sanitised message.
+func (e *ProtocolError) Error() string {
+	return e.Message
+}
+
+// Unwrap returns ErrFilenameRejected if the message is one of those OpenSSH
+// sends when it refuses a file because of its name, and ErrNoMatch if it's
+// the one a Glob returns for a pattern that matched nothing, so that
+// errors.Is can be used to detect those cases.
+func (e *ProtocolError) Unwrap() error {
+	if e.noMatch {
+		return ErrNoMatch
+	}
+	if isFilenameRejection(e.Raw) {
+		return ErrFilenameRejected
+	}
+
+	return nil
+}
+
+// readResponse reads the status byte the remote scp sends in response to each
+// step of a transfer. A zero byte means success, and nil is returned; a one or
+// a two is followed by a warning or error message, which is returned as a
+// ProtocolError.
+func readResponse(r *bufio.Reader) (*ProtocolError, error) {
+	st, err := protocol.NewDecoder(r).ReadStatus()
+	if st == nil || err != nil {
 		return nil, err
-	} else if b == 1 || b == 2 {
-		msg, err := rw.ReadString('\n')
-		if err != nil {
-			return nil, err
-		}
+	}
+
+	return &ProtocolError{Severity: st.Severity, Message: st.Message, Raw: st.Raw}, nil
+}
 
-		msg = strings.TrimSpace(msg)
+// isFilenameRejection reports whether msg is one of the messages OpenSSH's scp
+// sends when it refuses a file because of its name.
+func isFilenameRejection(msg string) bool {
+	return strings.Contains(msg, "filename does not match request") || strings.Contains(msg, "unexpected filename")
+}
 
-		if b == 2 {
-			return nil, fmt.Errorf(msg)
-		}
+// contentReader records any error returned by the underlying reader, so that
+// failures to produce content can be told apart from failures to send it.
+type contentReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *contentReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+
+	return n, err
+}
+
+// progressWriter calls fn with the running total of bytes written after each
+// write. If fn returns an error, the write fails with it.
+type progressWriter struct {
+	w  io.Writer
+	fn func(n int64) error
+	n  int64
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+
+	if ferr := w.fn(w.n); ferr != nil && err == nil {
+		err = ferr
+	}
+
+	return n, err
+}
+
+// progressReader calls fn with the running total of bytes read after each
+// read. If fn returns an error, the read fails with it.
+type progressReader struct {
+	r  io.Reader
+	fn func(n int64) error
+	n  int64
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.n += int64(n)
 
-		warnings = append(warnings, msg)
+		if ferr := r.fn(r.n); ferr != nil && err == nil {
+			err = ferr
+		}
 	}
 
-	return warnings, nil
+	return n, err
 }
 
-func min(a, b int) int {
+func min(a, b int64) int64 {
 	if a < b {
 		return a
 	}
@@ -299,22 +949,34 @@ func min(a, b int) int {
 }
 
 func parseCopy(l []byte) (os.FileMode, int64, string, error) {
-	if l[0] != 'C' {
-		return 0, 0, "", fmt.Errorf("invalid first byte; expected C but got %02x", l[0])
-	}
+	return parseRecord('C', l)
+}
 
-	bits := bytes.Split(bytes.TrimRight(l, "\n"), []byte(" "))
+// parseRecord parses a C or D record, which share the same format.
+func parseRecord(kind byte, l []byte) (os.FileMode, int64, string, error) {
+	if len(l) > 0 && l[0] != kind {
+		return 0, 0, "", fmt.Errorf("invalid first byte; expected %c but got %02x", kind, l[0])
+	}
 
-	rawMode, err := strconv.ParseUint(string(bits[0][1:]), 8, 32)
+	r, err := protocol.ParseRecord(l)
 	if err != nil {
 		return 0, 0, "", err
 	}
-	mode := os.FileMode(uint32(rawMode))
 
-	size, err := strconv.ParseInt(string(bits[1]), 10, 32)
+	return r.Mode, r.Size, r.Name, nil
+}
+
+// parseTime parses a T record, which holds the modification and access times
+// of the file that follows.
+func parseTime(l []byte) (mtime, atime time.Time, err error) {
+	if len(l) > 0 && l[0] != 'T' {
+		return mtime, atime, fmt.Errorf("invalid first byte; expected T but got %02x", l[0])
+	}
+
+	r, err := protocol.ParseRecord(l)
 	if err != nil {
-		return 0, 0, "", err
+		return mtime, atime, err
 	}
 
-	return mode, size, string(bits[2]), nil
+	return r.ModTime, r.AccessTime, nil
 }
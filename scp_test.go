@@ -0,0 +1,1722 @@
+package scp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"fknsrs.biz/p/scp/protocol"
+	"github.com/kballard/go-shellquote"
+	"golang.org/x/crypto/ssh"
+)
+
+// scpHelperEnv is set in the environment of commands run by the test server.
+// When the test binary finds it set, it acts as scp instead of running the
+// tests.
+const scpHelperEnv = "SCP_TEST_HELPER"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(scpHelperEnv) != "" {
+		os.Exit(scpHelper(os.Args[1:]))
+	}
+
+	os.Exit(m.Run())
+}
+
+// scpHelper serves the scp command line made of args with ServeCommand over
+// stdin and stdout, treating paths as local ones, and returns the exit
+// status.
+func scpHelper(args []string) int {
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}
+
+	if _, err := ServeCommand(rw, shellquote.Join(append([]string{"scp"}, args...)...), "/"); err != nil {
+		fmt.Fprintf(os.Stderr, "scp: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// testHandler runs the command an exec request asks for on ch, and returns
+// its exit status.
+type testHandler func(cmd string, ch ssh.Channel) int
+
+// newTestClient starts an SSH server on the loopback interface that runs
+// every command it's given with `sh -c`, with the test binary standing in for
+// scp, and returns a client connected to it.
+func newTestClient(t testing.TB) *ssh.Client {
+	t.Helper()
+
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh to run commands with")
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bin := t.TempDir()
+	if err := os.Symlink(exe, filepath.Join(bin, "scp")); err != nil {
+		t.Fatal(err)
+	}
+
+	env := append(os.Environ(), scpHelperEnv+"=1", "PATH="+bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	return newFakeClient(t, func(cmd string, ch ssh.Channel) int {
+		c := exec.Command("sh", "-c", cmd)
+		c.Env = env
+		c.Stdout = ch
+		c.Stderr = ch.Stderr()
+
+		in, err := c.StdinPipe()
+		if err != nil {
+			return 127
+		}
+		go func() {
+			io.Copy(in, ch)
+			in.Close()
+		}()
+
+		if err := c.Run(); err != nil {
+			if ee, ok := err.(*exec.ExitError); ok {
+				return ee.ExitCode()
+			}
+
+			return 127
+		}
+
+		return 0
+	})
+}
+
+// newFakeClient is like newTestClient, but the server hands each command to
+// h, which plays the part of the remote side itself.
+func newFakeClient(t testing.TB, h testHandler) *ssh.Client {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &ssh.ServerConfig{NoClientAuth: true}
+	cfg.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go serveTestConn(conn, cfg, h)
+		}
+	}()
+
+	c, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	return c
+}
+
+func serveTestConn(conn net.Conn, cfg *ssh.ServerConfig, h testHandler) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "sessions only")
+			continue
+		}
+
+		ch, creqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+
+		go func() {
+			for r := range creqs {
+				if r.Type != "exec" || len(r.Payload) < 4 {
+					r.Reply(false, nil)
+					continue
+				}
+
+				n := binary.BigEndian.Uint32(r.Payload)
+				if int(n) > len(r.Payload)-4 {
+					r.Reply(false, nil)
+					continue
+				}
+				cmd := string(r.Payload[4 : 4+n])
+				r.Reply(true, nil)
+
+				go func() {
+					status := make([]byte, 4)
+					binary.BigEndian.PutUint32(status, uint32(h(cmd, ch)))
+
+					ch.SendRequest("exit-status", false, status)
+					ch.Close()
+				}()
+			}
+		}()
+	}
+}
+
+// fakeSource returns a handler that plays a scripted `scp -f`: each step is
+// sent once the client has sent a byte (an acknowledgement, or the zero byte
+// that starts things off), and the handler exits with exit once the client
+// has acknowledged the last step or gone away.
+func fakeSource(exit int, steps ...string) testHandler {
+	return func(cmd string, ch ssh.Channel) int {
+		b := make([]byte, 1)
+
+		for _, step := range steps {
+			if _, err := io.ReadFull(ch, b); err != nil {
+				return exit
+			}
+
+			io.WriteString(ch, step)
+		}
+
+		io.ReadFull(ch, b)
+
+		return exit
+	}
+}
+
+// fakeSink returns a handler that plays `scp -t` for a single file, replying
+// to its C record with header and, if that's an acknowledgement, to its
+// content with final. It then waits for the client to close its side and
+// exits with exit.
+func fakeSink(header, final string, exit int) testHandler {
+	return func(cmd string, ch ssh.Channel) int {
+		r := bufio.NewReader(ch)
+
+		io.WriteString(ch, "\x00")
+
+		l, err := r.ReadString('\n')
+		if err != nil {
+			return exit
+		}
+
+		io.WriteString(ch, header)
+
+		if header == "\x00" {
+			rec, err := protocol.ParseRecord([]byte(l))
+			if err != nil {
+				return exit
+			}
+
+			// The content is followed by a zero byte.
+			if _, err := io.CopyN(ioutil.Discard, r, rec.Size+1); err != nil {
+				return exit
+			}
+
+			io.WriteString(ch, final)
+		}
+
+		io.Copy(ioutil.Discard, r)
+
+		return exit
+	}
+}
+
+// withCommand returns a handler that runs h for scp and answers every other
+// command with output and exit, for faking the helper commands some options
+// run alongside a transfer.
+func withCommand(h testHandler, output string, exit int) testHandler {
+	return func(cmd string, ch ssh.Channel) int {
+		if strings.HasPrefix(cmd, "scp ") {
+			return h(cmd, ch)
+		}
+
+		io.WriteString(ch, output)
+
+		return exit
+	}
+}
+
+// notifyClosed wraps h, closing the returned channel once it returns. The
+// fakes only return once the client has closed its side, so a test can use it
+// to check that a failed transfer doesn't leave its session open.
+func notifyClosed(h testHandler) (testHandler, <-chan struct{}) {
+	done := make(chan struct{})
+
+	return func(cmd string, ch ssh.Channel) int {
+		defer close(done)
+		return h(cmd, ch)
+	}, done
+}
+
+// waitClosed fails the test if done isn't closed soon.
+func waitClosed(t testing.TB, done <-chan struct{}, what string) {
+	t.Helper()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("session left open after %s", what)
+	}
+}
+
+// writeLocal creates a file called name in dir with the given content, and
+// returns its path.
+func writeLocal(t testing.TB, dir, name, content string) string {
+	t.Helper()
+
+	p := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+// readAll reads the content of f.
+func readAll(t testing.TB, f *File) string {
+	t.Helper()
+
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("reading content of %s: %v", f.Name(), err)
+	}
+
+	return string(b)
+}
+
+func TestWriteRead(t *testing.T) {
+	c := newTestClient(t)
+	dir := t.TempDir()
+
+	content := []byte("hello, world\n")
+
+	warnings, err := Write(c, dir, NewFile("hello.txt", int64(len(content)), 0640, bytes.NewReader(content)))
+	if err != nil {
+		t.Fatalf("Write: %v (warnings %q)", err, warnings)
+	}
+
+	got, err := ioutil.ReadFile(filepath.Join(dir, "hello.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatalf("remote file has %q; expected %q", got, content)
+	}
+
+	f, err := Read(c, filepath.Join(dir, "hello.txt"))
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	defer f.Close()
+
+	if f.Name() != "hello.txt" || f.Size() != int64(len(content)) {
+		t.Errorf("Read gave name %q and size %d; expected %q and %d", f.Name(), f.Size(), "hello.txt", len(content))
+	}
+
+	got, err = ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("reading content: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("Read gave %q; expected %q", got, content)
+	}
+}
+
+func TestReadMissing(t *testing.T) {
+	c := newTestClient(t)
+
+	_, err := Read(c, filepath.Join(t.TempDir(), "missing"))
+
+	var pe *ProtocolError
+	if !errors.As(err, &pe) {
+		t.Fatalf("Read of a missing file gave %v; expected a ProtocolError", err)
+	}
+}
+
+func TestWithSCPPath(t *testing.T) {
+	c := newTestClient(t)
+	dir := t.TempDir()
+
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Write(c, dir, NewFile("a", 1, 0644, bytes.NewReader([]byte("a"))), WithSCPPath(exe)); err != nil {
+		t.Fatalf("Write with the test binary as scp: %v", err)
+	}
+
+	if _, err := Read(c, filepath.Join(dir, "a"), WithSCPPath(exe), WithSourceSCPPath(filepath.Join(dir, "no-such-scp"))); err == nil {
+		t.Fatal("Read ran the wrong program; expected WithSourceSCPPath to take precedence")
+	}
+
+	f, err := Read(c, filepath.Join(dir, "a"), WithSCPPath(exe))
+	if err != nil {
+		t.Fatalf("Read with the test binary as scp: %v", err)
+	}
+	defer f.Close()
+
+	if b, err := ioutil.ReadAll(f); err != nil || string(b) != "a" {
+		t.Fatalf("Read gave %q, %v; expected %q", b, err, "a")
+	}
+}
+
+func TestParseCopy(t *testing.T) {
+	tests := []struct {
+		in   string
+		mode os.FileMode
+		size int64
+		name string
+		err  error
+	}{
+		{in: "C0644 5 a.txt\n", mode: 0644, size: 5, name: "a.txt"},
+		{in: "C0644 5 a.txt\r\n", mode: 0644, size: 5, name: "a.txt"},
+		{in: "C0644 5 a.txt", mode: 0644, size: 5, name: "a.txt"},
+		{in: "C0755 0 empty\n", mode: 0755, name: "empty"},
+		{in: "C4755 1 suid\n", mode: os.ModeSetuid | 0755, size: 1, name: "suid"},
+		{in: "C644 1 short\n", mode: 0644, size: 1, name: "short"},
+		{in: "C0644 5000000000 big\n", mode: 0644, size: 5000000000, name: "big"},
+		{in: "C0644 9223372036854775807 huge\n", mode: 0644, size: 9223372036854775807, name: "huge"},
+		{in: "C0644 5 my file.txt\n", mode: 0644, size: 5, name: "my file.txt"},
+		{in: "C0644 5 trailing \n", mode: 0644, size: 5, name: "trailing "},
+		{in: "C0644 5  leading\n", mode: 0644, size: 5, name: " leading"},
+		{in: "C0644 5 \n", err: ErrMissingFilename},
+		{in: "C0644 5\n", err: ErrMissingFilename},
+		{in: "C0644 5 ../evil\n", err: ErrUnsafeFilename},
+		{in: "C0644 5 /etc/passwd\n", err: ErrUnsafeFilename},
+		{in: "C0644 5 ..\n", err: ErrUnsafeFilename},
+		{in: "C0644\n"},
+		{in: "C0644 -1 a\n"},
+		{in: "C0644 5x a\n"},
+		{in: "C0644 9223372036854775808 a\n"},
+		{in: "C0999 5 a\n"},
+		{in: "Cxyz 5 a\n"},
+		{in: "C 5 a\n"},
+		{in: "D0755 0 a\n"},
+		{in: "\n"},
+		{in: ""},
+	}
+
+	for _, tt := range tests {
+		mode, size, name, err := parseCopy([]byte(tt.in))
+
+		valid := tt.name != ""
+		if !valid {
+			if err == nil {
+				t.Errorf("parseCopy(%q) gave %v, %d, %q; expected an error", tt.in, mode, size, name)
+			} else if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Errorf("parseCopy(%q) gave error %v; expected %v", tt.in, err, tt.err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("parseCopy(%q) gave error %v", tt.in, err)
+			continue
+		}
+
+		if mode != tt.mode || size != tt.size || name != tt.name {
+			t.Errorf("parseCopy(%q) gave %v, %d, %q; expected %v, %d, %q", tt.in, mode, size, name, tt.mode, tt.size, tt.name)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	mtime, atime, err := parseTime([]byte("T1700000000 250000 1600000000 0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !mtime.Equal(time.Unix(1700000000, 250000000)) || !atime.Equal(time.Unix(1600000000, 0)) {
+		t.Errorf("parseTime gave %v and %v", mtime, atime)
+	}
+
+	for _, in := range []string{"T1 0 2\n", "T1 0 2 0 3\n", "Tx 0 2 0\n", "C1 0 2 0\n", ""} {
+		if _, _, err := parseTime([]byte(in)); err == nil {
+			t.Errorf("parseTime(%q) succeeded; expected an error", in)
+		}
+	}
+}
+
+func TestReadLimit(t *testing.T) {
+	c := newTestClient(t)
+	dir := t.TempDir()
+
+	content := strings.Repeat("0123456789", 10)
+	p := writeLocal(t, dir, "f", content)
+
+	var buf bytes.Buffer
+
+	n, err := ReadLimit(c, p, &buf, 25)
+	if !errors.Is(err, ErrTruncated) {
+		t.Fatalf("ReadLimit below the size gave %v; expected ErrTruncated", err)
+	}
+	if n != 25 || buf.String() != content[:25] {
+		t.Fatalf("ReadLimit below the size gave %d bytes %q; expected %q", n, buf.String(), content[:25])
+	}
+
+	buf.Reset()
+
+	n, err = ReadLimit(c, p, &buf, int64(len(content)))
+	if err != nil || n != int64(len(content)) || buf.String() != content {
+		t.Fatalf("ReadLimit at the size gave %d, %v; expected all %d bytes", n, err, len(content))
+	}
+
+	if _, err := ReadLimit(c, p, &buf, -1); err == nil {
+		t.Fatal("ReadLimit with a negative limit succeeded")
+	}
+}
+
+func TestReadLimitWriterFails(t *testing.T) {
+	// More content than io.Copy reads at once, so that the rest is still
+	// on its way when the writer fails.
+	content := strings.Repeat("x", 100000)
+	h, done := notifyClosed(fakeSource(0, fmt.Sprintf("C0644 %d f\n", len(content)), content+"\x00"))
+	c := newFakeClient(t, h)
+
+	boom := errors.New("boom")
+	if _, err := ReadLimit(c, "f", &failingWriter{err: boom}, int64(len(content))); err != boom {
+		t.Fatalf("ReadLimit to a failing writer gave %v; expected its error", err)
+	}
+
+	waitClosed(t, done, "the writer failed")
+}
+
+// failingWriter accepts n bytes and then fails with err.
+type failingWriter struct {
+	n   int
+	err error
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		n := w.n
+		w.n = 0
+		return n, w.err
+	}
+
+	w.n -= len(p)
+
+	return len(p), nil
+}
+
+func TestReadToWriterAt(t *testing.T) {
+	c := newTestClient(t)
+	dir := t.TempDir()
+
+	parts := []string{"hello, ", "world"}
+	var paths []string
+	for i, part := range parts {
+		paths = append(paths, writeLocal(t, dir, fmt.Sprintf("part%d", i), part))
+	}
+
+	fd, err := os.Create(filepath.Join(dir, "assembled"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+
+	// The second part is fetched first, and both at once, as they would be by
+	// a parallel download.
+	offsets := []int64{0, int64(len(parts[0]))}
+	errs := make(chan error, len(parts))
+	for i := len(parts) - 1; i >= 0; i-- {
+		go func(i int) {
+			n, err := ReadToWriterAt(c, paths[i], fd, offsets[i])
+			if err == nil && n != int64(len(parts[i])) {
+				err = fmt.Errorf("ReadToWriterAt of part %d wrote %d bytes", i, n)
+			}
+			errs <- err
+		}(i)
+	}
+	for range parts {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if b, err := ioutil.ReadFile(fd.Name()); err != nil || string(b) != strings.Join(parts, "") {
+		t.Fatalf("assembled file has %q, %v", b, err)
+	}
+
+	if _, err := ReadToWriterAt(c, paths[0], fd, -1); err == nil {
+		t.Fatal("ReadToWriterAt with a negative offset succeeded")
+	}
+}
+
+func TestReadToWriterAtFails(t *testing.T) {
+	content := strings.Repeat("x", 100000)
+	h, done := notifyClosed(fakeSource(0, fmt.Sprintf("C0644 %d f\n", len(content)), content+"\x00"))
+	c := newFakeClient(t, h)
+
+	boom := errors.New("boom")
+	if _, err := ReadToWriterAt(c, "f", &failingWriterAt{err: boom}, 0); err != boom {
+		t.Fatalf("ReadToWriterAt to a failing WriterAt gave %v; expected its error", err)
+	}
+
+	waitClosed(t, done, "the WriterAt failed")
+}
+
+func TestOffsetsAndLimits(t *testing.T) {
+	// The source announces size but only sends five bytes of it, and then
+	// exits, so that sizes too large to send can still be announced.
+	announce := func(size int64) *ssh.Client {
+		if size == 5 {
+			return newFakeClient(t, fakeSource(0, "C0644 5 f\n", "hello\x00"))
+		}
+
+		return newFakeClient(t, func(cmd string, ch ssh.Channel) int {
+			b := make([]byte, 1)
+			for _, step := range []string{fmt.Sprintf("C0644 %d f\n", size), "hello"} {
+				if _, err := io.ReadFull(ch, b); err != nil {
+					return 1
+				}
+				io.WriteString(ch, step)
+			}
+
+			return 1
+		})
+	}
+
+	offsets := []struct {
+		off, size int64
+		overflow  bool
+	}{
+		{off: math.MaxInt32 - 2, size: 5},
+		{off: math.MaxInt32, size: 5},
+		{off: math.MaxInt32 + 1, size: 5},
+		{off: 1<<32 - 1, size: 5},
+		{off: 0, size: math.MaxInt32 + 1},
+		{off: math.MaxInt32, size: math.MaxInt32},
+		{off: math.MaxInt64 - 5, size: 5},
+		{off: math.MaxInt64 - 4, size: 5, overflow: true},
+		{off: math.MaxInt64 - math.MaxInt32, size: math.MaxInt32},
+		{off: math.MaxInt64 - math.MaxInt32, size: math.MaxInt32 + 1, overflow: true},
+		{off: 0, size: math.MaxInt64},
+		{off: 1, size: math.MaxInt64, overflow: true},
+	}
+
+	for _, tt := range offsets {
+		w := &recordingWriterAt{off: -1}
+		n, err := ReadToWriterAt(announce(tt.size), "f", w, tt.off)
+
+		switch {
+		case tt.overflow:
+			if err == nil || !strings.Contains(err.Error(), "would overflow") || n != 0 || w.off != -1 {
+				t.Errorf("ReadToWriterAt of %d bytes at %d gave %d, %v and wrote at %d; expected an overflow before writing", tt.size, tt.off, n, err, w.off)
+			}
+		case tt.size == 5:
+			if err != nil || n != 5 || w.off != tt.off || w.buf.String() != "hello" {
+				t.Errorf("ReadToWriterAt of %d bytes at %d gave %d, %v and wrote %q at %d", tt.size, tt.off, n, err, w.buf.String(), w.off)
+			}
+		default:
+			// The content is cut short, but only after it has started
+			// arriving at the right place.
+			if err == nil || strings.Contains(err.Error(), "would overflow") || w.off != tt.off || w.buf.String() != "hello" {
+				t.Errorf("ReadToWriterAt of %d bytes at %d gave %v and wrote %q at %d; expected it to start writing", tt.size, tt.off, err, w.buf.String(), w.off)
+			}
+		}
+	}
+
+	limits := []struct {
+		size, limit int64
+		truncated   bool
+	}{
+		{size: 5, limit: math.MaxInt32},
+		{size: 5, limit: math.MaxInt32 + 1},
+		{size: 5, limit: math.MaxInt64},
+		{size: math.MaxInt32 + 1, limit: 5, truncated: true},
+		{size: math.MaxInt64, limit: 5, truncated: true},
+	}
+
+	for _, tt := range limits {
+		var buf bytes.Buffer
+		n, err := ReadLimit(announce(tt.size), "f", &buf, tt.limit)
+
+		if tt.truncated && !errors.Is(err, ErrTruncated) || !tt.truncated && err != nil || n != 5 || buf.String() != "hello" {
+			t.Errorf("ReadLimit of %d bytes to %d gave %d, %v and %q", tt.size, tt.limit, n, err, buf.String())
+		}
+	}
+}
+
+// recordingWriterAt keeps what's written to it, and the offset of the first
+// write.
+type recordingWriterAt struct {
+	off int64
+	buf bytes.Buffer
+}
+
+func (w *recordingWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if w.off == -1 {
+		w.off = off
+	}
+
+	return w.buf.Write(p)
+}
+
+// failingWriterAt fails every write with err.
+type failingWriterAt struct {
+	err error
+}
+
+func (w *failingWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	return 0, w.err
+}
+
+// failingReader returns n bytes of content and then err.
+type failingReader struct {
+	n   int
+	err error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, r.err
+	}
+
+	if len(p) > r.n {
+		p = p[:r.n]
+	}
+	for i := range p {
+		p[i] = 'x'
+	}
+	r.n -= len(p)
+
+	return len(p), nil
+}
+
+func TestWriteFailingReader(t *testing.T) {
+	c := newTestClient(t)
+	dir := t.TempDir()
+
+	boom := errors.New("boom")
+
+	for _, n := range []int{0, 5} {
+		_, err := Write(c, dir, NewFile("f", 10, 0644, &failingReader{n: n, err: boom}))
+		if err == nil || !strings.Contains(err.Error(), "boom") {
+			t.Errorf("Write with a reader failing after %d bytes gave %v; expected it to mention the reader's error", n, err)
+		}
+	}
+
+	_, err := Write(c, dir, NewFile("f", 10, 0644, strings.NewReader("short")))
+	if err == nil || !strings.Contains(err.Error(), "ended after 5 of 10 bytes") {
+		t.Errorf("Write with short content gave %v", err)
+	}
+}
+
+func TestWithoutHeaderAck(t *testing.T) {
+	c := newFakeClient(t, fakeSource(0, "C0644 5 a\nhello\x00"))
+
+	f, err := Read(c, "a", WithoutHeaderAck())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if got := readAll(t, f); got != "hello" {
+		t.Fatalf("Read gave %q; expected %q", got, "hello")
+	}
+}
+
+func TestLeadingReadyByte(t *testing.T) {
+	c := newFakeClient(t, fakeSource(0, "\x00C0644 5 a\n", "hello\x00"))
+
+	f, err := Read(c, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if got := readAll(t, f); got != "hello" {
+		t.Fatalf("Read gave %q; expected %q", got, "hello")
+	}
+}
+
+func TestReadUnsafeName(t *testing.T) {
+	c := newFakeClient(t, fakeSource(0, "C0644 5 ../evil\n"))
+
+	if _, err := Read(c, "evil"); !errors.Is(err, ErrUnsafeFilename) {
+		t.Fatalf("Read of a file called ../evil gave %v; expected ErrUnsafeFilename", err)
+	}
+}
+
+func TestReadClosesSession(t *testing.T) {
+	// A source that only finishes once the session it ran in is closed.
+	done := make(chan struct{})
+	c := newFakeClient(t, func(cmd string, ch ssh.Channel) int {
+		defer close(done)
+
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(ch, b); err != nil {
+			return 1
+		}
+		io.WriteString(ch, "C0644 5 ../evil\n")
+		io.Copy(ioutil.Discard, ch)
+
+		return 0
+	})
+
+	if _, err := Read(c, "evil"); !errors.Is(err, ErrUnsafeFilename) {
+		t.Fatalf("Read of a file called ../evil gave %v; expected ErrUnsafeFilename", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session left open after Read failed")
+	}
+}
+
+func TestReadMissingName(t *testing.T) {
+	c := newFakeClient(t, fakeSource(0, "C0644 5 \n"))
+
+	if _, err := Read(c, "a"); !errors.Is(err, ErrMissingFilename) {
+		t.Fatalf("Read of a file with no name gave %v; expected ErrMissingFilename", err)
+	}
+}
+
+func TestFilenameRejected(t *testing.T) {
+	c := newFakeClient(t, fakeSink("\x01scp: error: unexpected filename: a\n", "", 1))
+
+	_, err := Write(c, "/tmp", NewFile("a", 1, 0644, strings.NewReader("a")))
+	if !errors.Is(err, ErrFilenameRejected) {
+		t.Fatalf("Write gave %v; expected ErrFilenameRejected", err)
+	}
+}
+
+func TestWriteUnsafeName(t *testing.T) {
+	c := newTestClient(t)
+	dir := t.TempDir()
+
+	for _, name := range []string{"a\nC0644 1 b", "../escaped", ""} {
+		_, err := Write(c, dir, NewFile(name, 1, 0644, strings.NewReader("x")), WithPreserve())
+		if !errors.Is(err, protocol.ErrUnsafeFilename) && !errors.Is(err, protocol.ErrMissingFilename) {
+			t.Errorf("Write of %q gave %v; expected it to be refused", name, err)
+		}
+	}
+
+	// A name with a newline in it is fine on disk, but can't be sent.
+	root := filepath.Join(t.TempDir(), "tree")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeLocal(t, root, "a\nb", "x")
+
+	if _, err := WriteDir(c, dir, root); !errors.Is(err, protocol.ErrUnsafeFilename) {
+		t.Errorf("WriteDir of a file with a newline in its name gave %v; expected ErrUnsafeFilename", err)
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Dir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() == "escaped" {
+			t.Error("Write created a file outside its directory")
+		}
+	}
+}
+
+func TestWriteClosesStdin(t *testing.T) {
+	// The sink only exits once it has read to the end of its stdin, and a
+	// transfer waits for it to exit, so a successful one can only return if
+	// it closed stdin first.
+	eof := make(chan struct{}, 2)
+	c := newFakeClient(t, func(cmd string, ch ssh.Channel) int {
+		fakeSink("\x00", "\x00", 0)(cmd, ch)
+		eof <- struct{}{}
+		return 0
+	})
+
+	write := map[string]func() error{
+		"Write": func() error {
+			_, err := Write(c, "/tmp", NewFile("a", 1, 0644, strings.NewReader("a")))
+			return err
+		},
+		"Writer": func() error {
+			w, err := NewWriter(c, "/tmp")
+			if err != nil {
+				return err
+			}
+
+			if _, err := w.WriteFile(NewFile("a", 1, 0644, strings.NewReader("a"))); err != nil {
+				return err
+			}
+
+			return w.Close()
+		},
+	}
+
+	for what, fn := range write {
+		errs := make(chan error, 1)
+		go func() { errs <- fn() }()
+
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Fatalf("%s gave %v", what, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s waited for a sink that was never sent the end of its stdin", what)
+		}
+
+		select {
+		case <-eof:
+		default:
+			t.Fatalf("%s returned before the sink reached the end of its stdin", what)
+		}
+	}
+}
+
+func TestRecordsSplitAcrossReads(t *testing.T) {
+	mtime := time.Unix(1500000000, 0)
+
+	c := newFakeClient(t, byteByByte(fakeSource(0, "T1500000000 0 1500000000 0\n", "C0644 5 a\n", "hello\x00")))
+	f, err := Read(c, "a", WithPreserve())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, f); got != "hello" || f.Name() != "a" || !f.ModTime().Equal(mtime) {
+		t.Fatalf("Read gave %q for %s, modified %v", got, f.Name(), f.ModTime())
+	}
+
+	c = newFakeClient(t, byteByByte(fakeSource(0, "D0755 0 d\n", "C0644 5 a\n", "hello\x01scp: d/a: warning\n", "E\n")))
+	got := map[string]string{}
+	warnings, err := ReadDir(c, "d", func(f *File) error {
+		got[f.Path()] = readAll(t, f)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameTree(got, map[string]string{"d/a": "hello"}) || len(warnings) != 1 || warnings[0] != "scp: d/a: warning" {
+		t.Fatalf("ReadDir gave %q and warnings %q", got, warnings)
+	}
+
+	c = newFakeClient(t, byteByByte(fakeSink("\x00", "\x01scp: a: set times: Operation not permitted\n", 0)))
+	warnings, err = Write(c, "/tmp", NewFile("a", 1, 0644, strings.NewReader("a")))
+	if err != nil || len(warnings) != 1 || warnings[0] != "scp: a: set times: Operation not permitted" {
+		t.Fatalf("Write gave %v and warnings %q", err, warnings)
+	}
+}
+
+// byteByByte wraps h so that everything it sends goes one byte at a time,
+// each in a packet of its own after a short pause, so that records and status
+// bytes reach the client split across any number of reads.
+func byteByByte(h testHandler) testHandler {
+	return func(cmd string, ch ssh.Channel) int {
+		return h(cmd, oneByteChannel{ch})
+	}
+}
+
+type oneByteChannel struct {
+	ssh.Channel
+}
+
+func (ch oneByteChannel) Write(p []byte) (int, error) {
+	r := iotest.OneByteReader(bytes.NewReader(p))
+	b := make([]byte, 1)
+
+	for n := 0; ; n++ {
+		if _, err := r.Read(b); err == io.EOF {
+			return n, nil
+		}
+
+		time.Sleep(time.Millisecond)
+
+		if _, err := ch.Channel.Write(b); err != nil {
+			return n, err
+		}
+	}
+}
+
+func TestWriteRefused(t *testing.T) {
+	c := newFakeClient(t, fakeSink("\x01scp: /nowhere: No such file or directory\n", "", 1))
+
+	_, err := Write(c, "/nowhere", NewFile("a", 1, 0644, strings.NewReader("a")))
+
+	var pe *ProtocolError
+	if !errors.As(err, &pe) || pe.Severity != SeverityWarning {
+		t.Fatalf("Write gave %v; expected a warning refusing the file", err)
+	}
+	if pe.Message != "scp: /nowhere: No such file or directory" {
+		t.Errorf("Write gave message %q", pe.Message)
+	}
+}
+
+func TestWriteWarning(t *testing.T) {
+	c := newFakeClient(t, fakeSink("\x00", "\x01scp: a: set times: Operation not permitted\n", 0))
+
+	warnings, err := Write(c, "/tmp", NewFile("a", 1, 0644, strings.NewReader("a")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(warnings) != 1 || warnings[0] != "scp: a: set times: Operation not permitted" {
+		t.Fatalf("Write gave warnings %q", warnings)
+	}
+}
+
+func TestMessageSanitized(t *testing.T) {
+	c := newFakeClient(t, fakeSink("\x02scp: bad\x07name\x1b[2J\bx\n", "", 1))
+
+	_, err := Write(c, "/tmp", NewFile("a", 1, 0644, strings.NewReader("a")))
+
+	var pe *ProtocolError
+	if !errors.As(err, &pe) || pe.Severity != SeverityError {
+		t.Fatalf("Write gave %v; expected an error from the remote side", err)
+	}
+
+	if pe.Message != `scp: bad\x07name\x1b[2J\x08x` {
+		t.Errorf("Message is %q; expected control characters escaped", pe.Message)
+	}
+	if pe.Raw != "scp: bad\x07name\x1b[2J\bx" {
+		t.Errorf("Raw is %q; expected the message as sent", pe.Raw)
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	c := newFakeClient(t, fakeSink("\x00", "\x00", 1))
+
+	_, err := Write(c, "/tmp", NewFile("a", 1, 0644, strings.NewReader("a")))
+
+	var ee *ssh.ExitError
+	if !errors.As(err, &ee) || ee.ExitStatus() != 1 {
+		t.Fatalf("Write to an scp exiting with 1 gave %v; expected an ExitError", err)
+	}
+
+	c = newFakeClient(t, fakeSource(1, "C0644 5 a\n", "hello\x00"))
+
+	f, err := Read(c, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := ioutil.ReadAll(f); !errors.As(err, &ee) || ee.ExitStatus() != 1 {
+		t.Fatalf("Read from an scp exiting with 1 gave %v; expected an ExitError", err)
+	}
+}
+
+func TestTrailingWarning(t *testing.T) {
+	c := newFakeClient(t, fakeSource(1, "C0644 5 a\n", "hello\x01scp: a: file changed as we read it\n"))
+
+	f, err := Read(c, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	_, err = ioutil.ReadAll(f)
+
+	var pe *ProtocolError
+	if !errors.As(err, &pe) || pe.Severity != SeverityWarning {
+		t.Fatalf("Read gave %v; expected the warning sent after the content", err)
+	}
+}
+
+func TestMissingTrailingStatus(t *testing.T) {
+	c := newFakeClient(t, func(cmd string, ch ssh.Channel) int {
+		io.ReadFull(ch, make([]byte, 1))
+		io.WriteString(ch, "C0644 5 a\n")
+		io.ReadFull(ch, make([]byte, 1))
+		io.WriteString(ch, "hello")
+		io.WriteString(ch.Stderr(), "scp: a: lost\n")
+
+		return 1
+	})
+
+	f, err := Read(c, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	_, err = ioutil.ReadAll(f)
+	if !errors.Is(err, io.ErrUnexpectedEOF) || !strings.Contains(err.Error(), "no status") || !strings.Contains(err.Error(), "scp: a: lost") {
+		t.Fatalf("Read with no status after the content gave %v; expected an unexpected EOF with the remote's stderr", err)
+	}
+}
+
+func TestStderrFlood(t *testing.T) {
+	// The remote side's stderr is only kept up to a point, and the rest is
+	// thrown away rather than left for the transfer to wait on.
+	flood := strings.Repeat("scp: noise\n", 100000)
+
+	c := newFakeClient(t, func(cmd string, ch ssh.Channel) int {
+		io.WriteString(ch.Stderr(), flood)
+
+		return fakeSink("\x00", "\x00", 0)(cmd, ch)
+	})
+
+	if _, err := Write(c, "/", NewFile("a", 5, 0644, strings.NewReader("hello"))); err != nil {
+		t.Fatalf("Write to a remote side flooding its stderr gave %v", err)
+	}
+
+	c = newFakeClient(t, func(cmd string, ch ssh.Channel) int {
+		io.WriteString(ch.Stderr(), flood)
+
+		return fakeSource(0, "C0644 5 a\n", "hello\x00")(cmd, ch)
+	})
+
+	f, err := Read(c, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if b, err := ioutil.ReadAll(f); err != nil || string(b) != "hello" {
+		t.Fatalf("Read from a remote side flooding its stderr gave %q, %v", b, err)
+	}
+}
+
+func TestLargeFile(t *testing.T) {
+	c := newFakeClient(t, fakeSource(0, "C0644 5000000000 big\n", strings.Repeat("x", 4096)))
+
+	var buf bytes.Buffer
+
+	n, err := ReadLimit(c, "big", &buf, 10)
+	if !errors.Is(err, ErrTruncated) || n != 10 {
+		t.Fatalf("ReadLimit gave %d, %v; expected 10 bytes and ErrTruncated", n, err)
+	}
+
+	f, err := Stat(c, "big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Size() != 5000000000 {
+		t.Fatalf("Stat gave size %d; expected 5000000000", f.Size())
+	}
+}
+
+// TestHugeFile pushes more than 4GB over SSH, so it only runs when
+// SCP_TEST_HUGE is set. TestHugeFileSink covers the same sizes without moving
+// the content anywhere.
+func TestHugeFile(t *testing.T) {
+	if os.Getenv("SCP_TEST_HUGE") == "" {
+		t.Skip("streams more than 4GB; set SCP_TEST_HUGE to run it")
+	}
+
+	// Just over 2^32 bytes, generated on the fly, so that any count kept in
+	// 32 bits would have wrapped around.
+	const size = 1<<32 + 5
+
+	c := newFakeClient(t, func(cmd string, ch ssh.Channel) int {
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(ch, b); err != nil {
+			return 1
+		}
+		fmt.Fprintf(ch, "C0644 %d huge\n", int64(size))
+		if _, err := io.ReadFull(ch, b); err != nil {
+			return 1
+		}
+
+		if _, err := io.CopyBuffer(ch, io.LimitReader(zeroes{}, size), make([]byte, 1<<20)); err != nil {
+			return 1
+		}
+		io.WriteString(ch, "\x00")
+
+		io.ReadFull(ch, b)
+
+		return 0
+	})
+
+	var transferred, total int64
+	f, err := Read(c, "huge", WithBufferSize(1<<20), WithProgress(func(n, of int64) {
+		transferred, total = n, of
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := io.Copy(ioutil.Discard, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f.Size() != size || n != size || transferred != size || total != size {
+		t.Fatalf("Read of %d bytes gave size %d, read %d and reported %d of %d", int64(size), f.Size(), n, transferred, total)
+	}
+}
+
+func TestHugeFileSink(t *testing.T) {
+	// Just over 2^32 bytes, as for TestHugeFile.
+	const size = 1<<32 + 5
+
+	var n int64
+	s, err := NewSinkFunc(func(f *File) error {
+		if f.Size() != size {
+			return fmt.Errorf("size is %d", f.Size())
+		}
+
+		var err error
+		n, err = io.Copy(ioutil.Discard, f)
+
+		return err
+	}, WithBufferSize(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rw := &hugeStream{header: fmt.Sprintf("C0644 %d huge\n", int64(size)), size: size}
+	if _, err := s.Serve(rw); err != nil {
+		t.Fatal(err)
+	}
+
+	if n != size || rw.sent != size {
+		t.Fatalf("sink of %d bytes was given %d of %d sent", int64(size), n, rw.sent)
+	}
+}
+
+// hugeStream plays a client sending a single file of the given size to a
+// sink, without the cost of producing the content: it reports each read as
+// filled without writing anything into it. Everything written to it is
+// discarded.
+type hugeStream struct {
+	header     string
+	size, sent int64
+	trailer    bool
+}
+
+func (h *hugeStream) Read(p []byte) (int, error) {
+	switch {
+	case h.header != "":
+		n := copy(p, h.header)
+		h.header = h.header[n:]
+
+		return n, nil
+	case h.sent < h.size:
+		n := int64(len(p))
+		if left := h.size - h.sent; n > left {
+			n = left
+		}
+		h.sent += n
+
+		return int(n), nil
+	case !h.trailer:
+		h.trailer = true
+		p[0] = 0
+
+		return 1, nil
+	}
+
+	return 0, io.EOF
+}
+
+func (h *hugeStream) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// zeroes is an endless source of zero bytes.
+type zeroes struct{}
+
+func (zeroes) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+
+	return len(p), nil
+}
+
+func TestEmptyFile(t *testing.T) {
+	c := newTestClient(t)
+	dir := t.TempDir()
+
+	var calls [][2]int64
+	progress := WithProgress(func(transferred, total int64) {
+		calls = append(calls, [2]int64{transferred, total})
+	})
+
+	if _, err := Write(c, dir, NewFile("empty", 0, 0644, nil), progress); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "empty"))
+	if err != nil || info.Size() != 0 {
+		t.Fatalf("remote file is %v, %v; expected it to be empty", info, err)
+	}
+
+	f, err := Read(c, filepath.Join(dir, "empty"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if got := readAll(t, f); got != "" {
+		t.Fatalf("Read gave %q; expected nothing", got)
+	}
+
+	if len(calls) != 1 || calls[0] != [2]int64{0, 0} {
+		t.Fatalf("progress calls for an empty Write were %v; expected just (0, 0)", calls)
+	}
+}
+
+func TestSpacesInName(t *testing.T) {
+	c := newTestClient(t)
+	dir := t.TempDir()
+
+	for _, name := range []string{"with spaces.txt", "trailing space ", " leading space"} {
+		if _, err := Write(c, dir, NewFile(name, 1, 0644, strings.NewReader("x"))); err != nil {
+			t.Fatalf("Write of %q: %v", name, err)
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatalf("Write of %q: %v", name, err)
+		}
+
+		f, err := Read(c, filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("Read of %q: %v", name, err)
+		}
+		readAll(t, f)
+
+		if f.Name() != name {
+			t.Errorf("Read of %q gave the name %q", name, f.Name())
+		}
+	}
+}
+
+func TestWithVerifySize(t *testing.T) {
+	c := newTestClient(t)
+	p := writeLocal(t, t.TempDir(), "f", "hello")
+
+	f, err := Read(c, p, WithVerifySize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, f); got != "hello" {
+		t.Fatalf("Read gave %q", got)
+	}
+
+	c = newFakeClient(t, withCommand(fakeSource(0, "C0644 5 f\n", "hello\x00"), "999\n", 0))
+
+	f, err = Read(c, "f", WithVerifySize())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ioutil.ReadAll(f); !errors.Is(err, ErrSizeMismatch) {
+		t.Fatalf("Read of a file that changed size gave %v; expected ErrSizeMismatch", err)
+	}
+}
+
+func TestWithStallTimeout(t *testing.T) {
+	c := newFakeClient(t, fakeSource(0, "C0644 10 a\n", "abc"))
+
+	f, err := Read(c, "a", WithStallTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := ioutil.ReadAll(f); !errors.Is(err, ErrStalled) {
+		t.Fatalf("Read of stalled content gave %v; expected ErrStalled", err)
+	}
+}
+
+func TestFileClose(t *testing.T) {
+	c := newFakeClient(t, fakeSource(0, "C0644 10 a\n", "abc"))
+
+	f, err := Read(c, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ioutil.ReadAll(f); err != io.ErrClosedPipe {
+		t.Fatalf("reading a closed File gave %v; expected io.ErrClosedPipe", err)
+	}
+}
+
+func TestFileErr(t *testing.T) {
+	c := newFakeClient(t, fakeSource(0, "C0644 5 a\n", "hello\x00"))
+
+	f, err := Read(c, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, f)
+	if err := f.Close(); err != nil || f.Err() != nil {
+		t.Fatalf("File read in full gave %v from Close and %v from Err", err, f.Err())
+	}
+
+	// A warning after the content is there after Close, even for a caller
+	// that didn't look at the error from reading it.
+	c = newFakeClient(t, fakeSource(1, "C0644 5 a\n", "hello\x01scp: a: file changed as we read it\n"))
+
+	f, err = Read(c, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(ioutil.Discard, f)
+	f.Close()
+
+	var pe *ProtocolError
+	if err := f.Err(); !errors.As(err, &pe) || pe.Severity != SeverityWarning || !strings.Contains(pe.Message, "file changed") {
+		t.Fatalf("Err gave %v; expected the warning sent after the content", err)
+	}
+
+	// A File closed part way through was abandoned.
+	c = newFakeClient(t, fakeSource(0, "C0644 10 a\n", "abc"))
+
+	f, err = Read(c, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Err(); err != nil {
+		t.Fatalf("Err gave %v before the transfer was over", err)
+	}
+	f.Close()
+
+	if err := f.Err(); err != io.ErrClosedPipe {
+		t.Fatalf("Err gave %v after Close; expected io.ErrClosedPipe", err)
+	}
+}
+
+func TestWithTeardownClose(t *testing.T) {
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+
+	// Neither of these ever exits, so only TeardownClose lets the transfer
+	// return.
+	hang := func(h testHandler) testHandler {
+		return func(cmd string, ch ssh.Channel) int {
+			h(cmd, ch)
+			<-release
+
+			return 0
+		}
+	}
+
+	sink := newFakeClient(t, hang(fakeSink("\x00", "\x00", 0)))
+	source := newFakeClient(t, hang(fakeSource(0, "C0644 5 a\n", "hello\x00")))
+
+	done := make(chan error, 2)
+
+	go func() {
+		_, err := Write(sink, "/tmp", NewFile("a", 1, 0644, strings.NewReader("a")), WithTeardown(TeardownClose))
+		done <- err
+	}()
+
+	go func() {
+		f, err := Read(source, "a", WithTeardown(TeardownClose))
+		if err == nil {
+			_, err = ioutil.ReadAll(f)
+		}
+		done <- err
+	}()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("transfer with TeardownClose waited for the remote scp to exit")
+		}
+	}
+}
+
+func TestWithTeardownDrainWait(t *testing.T) {
+	// After the transfer, both fakes send more than fits in the channel's
+	// window, so they can only exit once it has been drained, and their
+	// exit status is only seen by waiting for them.
+	junk := strings.Repeat("x", 4<<20)
+	trailing := func(h testHandler) testHandler {
+		return func(cmd string, ch ssh.Channel) int {
+			h(cmd, ch)
+			io.WriteString(ch, junk)
+			return 3
+		}
+	}
+
+	sink := newFakeClient(t, trailing(fakeSink("\x00", "\x00", 0)))
+	source := newFakeClient(t, trailing(fakeSource(0, "C0644 5 a\n", "hello\x00")))
+
+	for _, tt := range []struct {
+		opts []Option
+		wait bool
+	}{
+		{wait: true},
+		{opts: []Option{WithTeardown(TeardownDrainWait)}, wait: true},
+		{opts: []Option{WithTeardown(TeardownClose)}},
+	} {
+		_, werr := Write(sink, "/tmp", NewFile("a", 1, 0644, strings.NewReader("a")), tt.opts...)
+
+		f, rerr := Read(source, "a", tt.opts...)
+		if rerr == nil {
+			_, rerr = ioutil.ReadAll(f)
+		}
+
+		for what, err := range map[string]error{"Write": werr, "Read": rerr} {
+			var ee *ssh.ExitError
+			if tt.wait && (!errors.As(err, &ee) || ee.ExitStatus() != 3) {
+				t.Errorf("%s waiting for the remote scp gave %v; expected its exit status", what, err)
+			} else if !tt.wait && err != nil {
+				t.Errorf("%s with TeardownClose gave %v", what, err)
+			}
+		}
+	}
+}
+
+func TestNewFileFromInfo(t *testing.T) {
+	dir := t.TempDir()
+	p := writeLocal(t, dir, "f", "hello")
+
+	mtime := time.Unix(1500000000, 0)
+	if err := os.Chtimes(p, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := NewFileFromInfo(info, strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f.Name() != "f" || f.Size() != 5 || f.Mode() != info.Mode() || !f.ModTime().Equal(mtime) {
+		t.Errorf("NewFileFromInfo gave %q, %d, %v, %v", f.Name(), f.Size(), f.Mode(), f.ModTime())
+	}
+
+	info, err = os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewFileFromInfo(info, nil); err == nil {
+		t.Error("NewFileFromInfo accepted a directory")
+	}
+}
+
+func TestWriteModes(t *testing.T) {
+	c := newTestClient(t)
+	dir := t.TempDir()
+
+	for mode, bits := range map[os.FileMode]string{0644: "0644", 0755: "0755", 0600: "0600", os.ModeSetuid | 0755: "4755"} {
+		name := "m" + bits
+
+		var trace bytes.Buffer
+		if _, err := Write(c, dir, NewFile(name, 1, mode, strings.NewReader("x")), WithPreserve(), WithTrace(&trace)); err != nil {
+			t.Fatal(err)
+		}
+
+		record := "> C" + bits + " 1 " + name + "\n"
+		if !strings.Contains(trace.String(), record) {
+			t.Errorf("Write of a file with mode %v sent %q; expected %q", mode, trace.String(), record)
+		}
+
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.Mode() & (os.ModePerm | os.ModeSetuid); got != mode {
+			t.Errorf("Write with WithPreserve of a file with mode %v created one with mode %v", mode, got)
+		}
+	}
+
+	var trace bytes.Buffer
+	if _, err := Write(c, dir, NewFile("forced", 1, 0755, strings.NewReader("x")), WithMode(0600), WithTrace(&trace)); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(trace.String(), "> C0600 1 forced\n") {
+		t.Errorf("Write with WithMode(0600) sent %q", trace.String())
+	}
+}
+
+func TestWithTempFile(t *testing.T) {
+	c := newTestClient(t)
+	p := writeLocal(t, t.TempDir(), "f", "hello")
+	tmp := t.TempDir()
+
+	f, err := Read(c, p, WithTempFile(tmp))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs, ok := f.Reader.(io.ReadSeeker)
+	if !ok {
+		t.Fatalf("Read with WithTempFile gave a %T; expected an io.ReadSeeker", f.Reader)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := rs.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		if got := readAll(t, f); got != "hello" {
+			t.Fatalf("Read gave %q", got)
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if entries, err := ioutil.ReadDir(tmp); err != nil || len(entries) != 0 {
+		t.Fatalf("temporary directory has %v, %v after Close; expected it to be empty", entries, err)
+	}
+}
+
+func TestReaderWithMode(t *testing.T) {
+	var r ReaderWithMode = NewFile("a", 0, 0600, nil)
+	if r.Mode() != 0600 {
+		t.Errorf("File reports mode %v", r.Mode())
+	}
+
+	r = NewReaderWithMode(strings.NewReader("x"), 0755)
+	if r.Mode() != 0755 {
+		t.Errorf("NewReaderWithMode reports mode %v", r.Mode())
+	}
+}
+
+// slowReader produces n bytes, chunk at a time, waiting delay before each
+// chunk and calling sample afterwards.
+type slowReader struct {
+	n, chunk int
+	delay    time.Duration
+	sample   func()
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, io.EOF
+	}
+
+	time.Sleep(r.delay)
+
+	if len(p) > r.chunk {
+		p = p[:r.chunk]
+	}
+	if len(p) > r.n {
+		p = p[:r.n]
+	}
+	for i := range p {
+		p[i] = 'x'
+	}
+	r.n -= len(p)
+
+	r.sample()
+
+	return len(p), nil
+}
+
+func TestWriteBoundedMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("slow")
+	}
+
+	const size = 64 << 20
+
+	c := newFakeClient(t, fakeSink("\x00", "\x00", 0))
+
+	var before, now runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	// The live heap is checked every 4MB. If Write held on to what it had
+	// read, it would grow by about that much each time.
+	var read, peak uint64
+	r := &slowReader{n: size, chunk: 32 << 10, delay: 100 * time.Microsecond, sample: func() {
+		if read += 32 << 10; read%(4<<20) != 0 {
+			return
+		}
+
+		runtime.GC()
+		runtime.ReadMemStats(&now)
+
+		if now.HeapAlloc > before.HeapAlloc && now.HeapAlloc-before.HeapAlloc > peak {
+			peak = now.HeapAlloc - before.HeapAlloc
+		}
+	}}
+
+	if _, err := Write(c, "/", NewFile("big", size, 0644, r)); err != nil {
+		t.Fatal(err)
+	}
+
+	if peak > 16<<20 {
+		t.Errorf("heap grew by %d bytes while writing %d", peak, size)
+	}
+}
+
+// benchmarkRead reads a 1MB file over and over with opts.
+func benchmarkRead(b *testing.B, opts ...Option) {
+	c := newTestClient(b)
+	p := writeLocal(b, b.TempDir(), "f", strings.Repeat("x", 1<<20))
+
+	b.SetBytes(1 << 20)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		f, err := Read(c, p, opts...)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if _, err := io.Copy(ioutil.Discard, f); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadBufferSize(b *testing.B) {
+	for _, n := range []int{4 << 10, 32 << 10, 256 << 10} {
+		b.Run(fmt.Sprintf("%dK", n>>10), func(b *testing.B) {
+			benchmarkRead(b, WithBufferSize(n))
+		})
+	}
+}
+
+func BenchmarkReadPipeBufferSize(b *testing.B) {
+	for _, n := range []int{4 << 10, 32 << 10, 256 << 10} {
+		b.Run(fmt.Sprintf("%dK", n>>10), func(b *testing.B) {
+			benchmarkRead(b, WithPipeBufferSize(n))
+		})
+	}
+}
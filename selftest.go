@@ -0,0 +1,65 @@
+package scp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"path"
+
+	"github.com/kballard/go-shellquote"
+	"golang.org/x/crypto/ssh"
+)
+
+// SelfTest checks that the whole scp path to a host works, by writing a small
+// random file into dir, reading it back, comparing the two and then removing
+// the file. The error it returns says which of those steps failed.
+func SelfTest(c *ssh.Client, dir string) error {
+	payload := make([]byte, 1024)
+	if _, err := rand.Read(payload); err != nil {
+		return fmt.Errorf("self test: generating payload: %w", err)
+	}
+
+	name := ".scp-selftest-" + newTransferID()
+	remote := path.Join(dir, name)
+
+	if _, err := Write(c, dir, NewFile(name, int64(len(payload)), 0600, bytes.NewReader(payload))); err != nil {
+		return fmt.Errorf("self test: writing %s: %w", remote, err)
+	}
+
+	// Whatever happens while reading, the file should be cleaned up, but a
+	// failure to read is more interesting than a failure to clean up.
+	verr := func() error {
+		f, err := Read(c, remote)
+		if err != nil {
+			return fmt.Errorf("self test: reading %s: %w", remote, err)
+		}
+
+		got, err := ioutil.ReadAll(f)
+		if err != nil {
+			return fmt.Errorf("self test: reading content of %s: %w", remote, err)
+		}
+
+		if !bytes.Equal(got, payload) {
+			return fmt.Errorf("self test: comparing %s: content doesn't match what was written", remote)
+		}
+
+		return nil
+	}()
+
+	s, err := c.NewSession()
+	if err != nil {
+		if verr != nil {
+			return verr
+		}
+
+		return fmt.Errorf("self test: removing %s: %w", remote, err)
+	}
+	defer s.Close()
+
+	if err := s.Run(shellquote.Join("rm", "-f", remote)); err != nil && verr == nil {
+		return fmt.Errorf("self test: removing %s: %w", remote, err)
+	}
+
+	return verr
+}
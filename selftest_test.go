@@ -0,0 +1,61 @@
+package scp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSelfTest(t *testing.T) {
+	c := newTestClient(t)
+	dir := t.TempDir()
+
+	if err := SelfTest(c, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if entries, err := ioutil.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Fatalf("SelfTest left %v, %v behind", entries, err)
+	}
+
+	if err := SelfTest(c, filepath.Join(dir, "missing", "dir")); err == nil {
+		t.Fatal("SelfTest in a missing directory succeeded")
+	}
+}
+
+func TestSelfTestCorrupted(t *testing.T) {
+	root := t.TempDir()
+
+	// A remote side that loses the second half of every file it's sent, and
+	// ignores anything other than scp.
+	c := newFakeClient(t, func(cmd string, ch ssh.Channel) int {
+		if !strings.HasPrefix(cmd, "scp ") {
+			return 0
+		}
+
+		if _, err := ServeCommand(ch, cmd, root); err != nil {
+			return 1
+		}
+
+		entries, err := ioutil.ReadDir(root)
+		if err != nil {
+			return 1
+		}
+		for _, e := range entries {
+			if err := os.Truncate(filepath.Join(root, e.Name()), e.Size()/2); err != nil {
+				return 1
+			}
+		}
+
+		return 0
+	})
+
+	err := SelfTest(c, "/")
+	if err == nil || !strings.Contains(err.Error(), "comparing") {
+		t.Fatalf("SelfTest against a remote side that truncates files gave %v; expected it to fail comparing them", err)
+	}
+}
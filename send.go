@@ -0,0 +1,404 @@
+package scp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"fknsrs.biz/p/scp/protocol"
+	"golang.org/x/crypto/ssh"
+)
+
+// sender drives a remote scp running in "to" mode, sending it records and
+// file content and collecting any warnings it sends back. A Source uses one to
+// play the same part towards an scp client, in which case there's no session
+// and c, s, stdin, stop and stderr are all nil.
+type sender struct {
+	o     *options
+	c     *ssh.Client
+	s     *ssh.Session
+	stdin io.WriteCloser
+	rw    *bufio.ReadWriter
+
+	// stop stops watching the transfer's context.
+	stop func()
+
+	// buf is used to copy the content of every file sent.
+	buf []byte
+
+	// dirs holds the local directories being sent, from the top down.
+	dirs []os.FileInfo
+
+	// fsys is where the files being sent are, for a Source made with
+	// NewSourceFS. Without one, they're on the local filesystem.
+	fsys fs.FS
+
+	stderr *stderrBuffer
+
+	warnings []string
+
+	// sent and failed record the files sent in a batch written with
+	// WithContinueOnError, and those that were skipped.
+	sent   []string
+	failed []*FileError
+
+	// pending is the name of the last file sent, with WithPipelining, if
+	// the response to its content hasn't been read yet, and settled records
+	// it as sent once the response has arrived.
+	pending string
+	settled func()
+
+	// listedSizes holds the sizes of the files in WithResumeFrom's
+	// manifest, by path.
+	listedSizes map[string]int64
+}
+
+// stat, readDir, open, readlink and join are how the sender gets at the files
+// it sends, in k.fsys or on the local filesystem. As with os.Stat and
+// ioutil.ReadDir, stat follows a symbolic link and readDir doesn't.
+
+func (k *sender) stat(name string) (os.FileInfo, error) {
+	if k.fsys == nil {
+		return os.Stat(name)
+	}
+
+	return fs.Stat(k.fsys, name)
+}
+
+func (k *sender) readDir(name string) ([]os.FileInfo, error) {
+	if k.fsys == nil {
+		return ioutil.ReadDir(name)
+	}
+
+	entries, err := fs.ReadDir(k.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
+func (k *sender) open(name string) (io.ReadCloser, error) {
+	if k.fsys == nil {
+		return os.Open(name)
+	}
+
+	return k.fsys.Open(name)
+}
+
+func (k *sender) readlink(name string) (string, error) {
+	if k.fsys == nil {
+		return os.Readlink(name)
+	}
+
+	if rl, ok := k.fsys.(interface {
+		ReadLink(name string) (string, error)
+	}); ok {
+		return rl.ReadLink(name)
+	}
+
+	return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+}
+
+func (k *sender) join(dir, name string) string {
+	if k.fsys == nil {
+		return filepath.Join(dir, name)
+	}
+
+	return path.Join(dir, name)
+}
+
+// startSender starts the remote scp with the given flags (e.g. "-t" or "-rt")
+// on dir, and waits for it to announce that it's ready.
+func startSender(c *ssh.Client, o *options, flags, dir string) (k *sender, err error) {
+	s, err := c.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	stop := o.watch(s)
+	defer func() {
+		if err != nil {
+			stop()
+		}
+	}()
+
+	stdout, err := s.StdoutPipe()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	stdin, err := s.StdinPipe()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	stderr := newStderrBuffer(s)
+
+	cmd, err := o.command(o.sinkProgram(), flags, dir)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	if err := s.Start(cmd); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	k = &sender{o: o, c: c, s: s, stdin: stdin, rw: o.readWriter(stdout, stdin), stop: stop, stderr: stderr}
+
+	if err := k.ack(false, dir); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// ack reads the response to the last step of the exchange.
+//
+// Until the content of a file has been sent, even a warning means the remote
+// has refused to go any further (OpenSSH uses them for things like a target
+// directory that doesn't exist) and is no longer expecting what would have
+// come next. Once the content has been sent (final is true), it means the
+// content arrived but something else went wrong, like setting the file's
+// mode, so it's recorded as a warning instead.
+func (k *sender) ack(final bool, name string) error {
+	pe, err := k.o.readResponse(k.rw.Reader)
+	if err == io.EOF && k.s != nil {
+		// If the remote scp gave up without managing to say why, the
+		// response never arrives and the pipe is simply closed. In that case
+		// its exit status and stderr are the only explanation available.
+		return fmt.Errorf("no response to %s from remote scp: %w", name, k.stderr.annotate(k.s, err))
+	} else if err != nil {
+		return err
+	}
+
+	if pe == nil {
+		return nil
+	}
+
+	if !final || pe.Severity == SeverityError {
+		return pe
+	}
+
+	k.warnings = append(k.warnings, pe.Message)
+
+	k.o.emit(Event{Type: EventWarning, Name: name, Message: pe.Message})
+
+	return nil
+}
+
+// record sends a single protocol record and reads the response to it, after
+// any response still outstanding for the last file's content.
+func (k *sender) record(r protocol.Record, name string, total int64) error {
+	if err := k.o.sendRecord(k.rw.Writer, r); err != nil {
+		return err
+	}
+
+	k.o.emit(Event{Type: EventRecordSent, Name: name, Record: r.String(), Total: total})
+
+	if err := k.settle(); err != nil {
+		return err
+	}
+
+	return k.ack(false, name)
+}
+
+// settle reads the response to the content of the last file sent, if
+// WithPipelining left it outstanding.
+func (k *sender) settle() error {
+	if k.pending == "" {
+		return nil
+	}
+
+	name, settled := k.pending, k.settled
+	k.pending, k.settled = "", nil
+
+	if err := k.ack(true, name); err != nil {
+		return err
+	}
+
+	if settled != nil {
+		settled()
+	}
+
+	return nil
+}
+
+// times sends a T record with the given times for the record that follows it,
+// if times are being preserved and there are any to send. A missing access
+// time is sent as the modification time.
+func (k *sender) times(name string, mtime, atime time.Time) error {
+	if !k.o.preserve || mtime.IsZero() {
+		return nil
+	}
+
+	if atime.IsZero() {
+		atime = mtime
+	}
+
+	return k.record(protocol.Record{Kind: 'T', ModTime: mtime, AccessTime: atime}, name, 0)
+}
+
+// file sends a C record for file followed by its content. The name must
+// already have been checked with protocol.CheckName, since a T record has to
+// be followed by a C record.
+func (k *sender) file(file *File) error {
+	mode := file.Mode()
+	if k.o.forceMode {
+		mode = k.o.mode
+	}
+
+	c := protocol.Record{Kind: 'C', Mode: mode, Size: file.Size(), Name: file.Name()}
+
+	if err := k.times(file.Name(), file.ModTime(), file.AccessTime()); err != nil {
+		return err
+	}
+
+	if err := k.record(c, file.Name(), file.Size()); err != nil {
+		return err
+	}
+
+	// An empty file has no content at all, just the terminating zero byte,
+	// so there's no need to touch its reader.
+	if file.Size() > 0 {
+		// The remote side has already been told how many bytes to expect,
+		// so if the content can't be produced in full, the only way to stop
+		// it from waiting forever is to close its stdin.
+		cr := &contentReader{r: file}
+		var sent int64
+		pw := &progressWriter{w: k.rw, fn: func(n int64) error {
+			k.o.emit(Event{Type: EventProgress, Name: file.Name(), Transferred: n, Total: file.Size()})
+			if k.o.callbackErr != nil {
+				return k.o.callbackErr
+			}
+
+			err := k.o.throttle(int(n - sent))
+			sent = n
+
+			return err
+		}}
+		if k.buf == nil {
+			k.buf = make([]byte, k.o.chunkSize())
+		}
+
+		if n, err := copyN(pw, cr, file.Size(), k.buf); err != nil {
+			if k.stdin != nil {
+				k.stdin.Close()
+			}
+
+			if cr.err != nil {
+				return fmt.Errorf("couldn't read content of %s after %d of %d bytes: %v", file.Name(), n, file.Size(), cr.err)
+			}
+			if err == io.EOF {
+				return fmt.Errorf("content of %s ended after %d of %d bytes", file.Name(), n, file.Size())
+			}
+
+			return err
+		}
+	}
+
+	if err := k.o.sendOK(k.rw.Writer); err != nil {
+		return err
+	}
+
+	// The remote scp reads the next record once it has dealt with this
+	// file, and responds to the two in order, so there's no need to wait.
+	if k.o.pipelining && !k.o.barrier {
+		k.pending = file.Name()
+		return nil
+	}
+
+	if err := k.ack(true, file.Name()); err != nil {
+		return err
+	}
+
+	if k.o.barrierSync && k.c != nil {
+		if _, err := runOutput(k.c, "sync"); err != nil {
+			return fmt.Errorf("couldn't sync after %s: %w", file.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+// close tells the remote scp there's nothing more to come, by closing its
+// stdin, and shuts the session down.
+func (k *sender) close() error {
+	defer k.stop()
+	defer k.s.Close()
+
+	if err := k.settle(); err != nil {
+		return err
+	}
+
+	// Closing stdin lets the remote scp finish up and exit rather than
+	// waiting for the session to be torn down underneath it.
+	if err := k.stdin.Close(); err != nil {
+		return err
+	}
+
+	if k.o.teardown == TeardownDrainWait {
+		if _, err := io.Copy(ioutil.Discard, k.rw); err != nil {
+			return err
+		}
+
+		if err := wait(k.s); err != nil {
+			return k.stderr.annotate(k.s, err)
+		}
+	}
+
+	return nil
+}
+
+// abandon shuts the session down straight away, after something has gone
+// wrong part way through the transfer.
+func (k *sender) abandon() {
+	k.s.Close()
+	k.stop()
+}
+
+// wait waits for the remote scp to exit. A non-zero exit status is an error
+// even if the remote side never sent a message to go with it, since exiting
+// is sometimes the only sign it gives of a problem found late (like a full
+// disk). The error wraps the underlying *ssh.ExitError.
+func wait(s *ssh.Session) error {
+	err := s.Wait()
+	if _, ok := err.(*ssh.ExitError); ok {
+		return fmt.Errorf("remote scp exited uncleanly: %w", err)
+	}
+
+	return err
+}
+
+// copyN is like io.CopyN, but copies through buf. An error is returned even if
+// it came with the last of the content, since dst may be a progressWriter
+// reporting that the transfer has been aborted.
+func copyN(dst io.Writer, src io.Reader, n int64, buf []byte) (int64, error) {
+	written, err := io.CopyBuffer(dst, io.LimitReader(src, n), buf)
+	if err == nil && written < n {
+		err = io.EOF
+	}
+
+	return written, err
+}
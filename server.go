@@ -0,0 +1,188 @@
+package scp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/kballard/go-shellquote"
+)
+
+// ServeCommand handles an scp client's request to run command, the command
+// line it sent (e.g. "scp -r -t /upload"), over rw, using a Sink or Source as
+// the command asks. It's meant for an SSH server's exec handler, so that all
+// it has to do is pass along the command and the channel and then send the
+// exit status: 0 if ServeCommand returns no error, 1 otherwise.
+//
+// The path in the command is taken to be inside root, whether it's relative
+// or absolute, and can't refer to anything outside it with "..". (Symbolic
+// links inside root are followed, though, so root shouldn't contain any that
+// point outside it.) Of the flags a client sends, -t, -f, -r, -p and -d are
+// honoured, with -p adding WithPreserve to opts, and the ones that only affect
+// output (-q and -v) are accepted and ignored. Anything else is refused, and
+// the client is told why. So is a directory sent by a client that didn't ask
+// for -r.
+func ServeCommand(rw io.ReadWriter, command, root string, opts ...Option) ([]string, error) {
+	c, err := parseCommand(command)
+	if err != nil {
+		return nil, refuse(rw, err)
+	}
+
+	target := filepath.Join(root, filepath.FromSlash(c.clean()))
+
+	if c.sink && c.dirOnly {
+		if info, err := os.Stat(target); err != nil || !info.IsDir() {
+			return nil, refuse(rw, fmt.Errorf("%s: not a directory", c.path))
+		}
+	}
+
+	return c.serve(rw, func(opts ...Option) (*Sink, error) {
+		return NewSink(target, opts...)
+	}, func(opts ...Option) (*Source, error) {
+		return NewSource(target, opts...)
+	}, opts)
+}
+
+// ServeCommandWith is like ServeCommand, for servers whose files are somewhere
+// other than the local filesystem: it leaves it to newSink or newSource, as
+// the command asks, to make the Sink or Source for the path in it, which is
+// usually done with NewSinkFunc or NewSourceFS. They're given the options to
+// use, including WithPreserve for -p, and the path cleaned as ServeCommand
+// does, but relative and slash-separated as an fs.FS expects, so it's "." for
+// the root. Either can be nil to refuse that direction altogether. Since
+// there's no local directory to check, -d is accepted but has no effect.
+func ServeCommandWith(rw io.ReadWriter, command string, newSink func(path string, opts ...Option) (*Sink, error), newSource func(path string, opts ...Option) (*Source, error), opts ...Option) ([]string, error) {
+	c, err := parseCommand(command)
+	if err != nil {
+		return nil, refuse(rw, err)
+	}
+
+	p := strings.TrimPrefix(c.clean(), "/")
+	if p == "" {
+		p = "."
+	}
+
+	return c.serve(rw, func(opts ...Option) (*Sink, error) {
+		if newSink == nil {
+			return nil, refuse(rw, fmt.Errorf("uploads not supported"))
+		}
+
+		return newSink(p, opts...)
+	}, func(opts ...Option) (*Source, error) {
+		if newSource == nil {
+			return nil, refuse(rw, fmt.Errorf("downloads not supported"))
+		}
+
+		return newSource(p, opts...)
+	}, opts)
+}
+
+// serve runs the exchange the command asks for, with a Sink or Source from
+// newSink or newSource.
+func (c *scpCommand) serve(rw io.ReadWriter, newSink func(...Option) (*Sink, error), newSource func(...Option) (*Source, error), opts []Option) ([]string, error) {
+	if c.preserve {
+		opts = append(opts[:len(opts):len(opts)], WithPreserve())
+	}
+
+	if c.sink {
+		s, err := newSink(opts...)
+		if err != nil {
+			return nil, err
+		}
+
+		s.noDirs = !c.recursive
+
+		return s.Serve(rw)
+	}
+
+	s, err := newSource(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.recursive {
+		return s.ServeDir(rw)
+	}
+
+	return s.Serve(rw)
+}
+
+// refuse tells the client about err before the exchange has started, and
+// returns it.
+func refuse(rw io.ReadWriter, err error) error {
+	(&options{}).sendError(bufio.NewWriter(rw), SeverityError, "scp: "+err.Error())
+
+	return err
+}
+
+// scpCommand is an scp command line, as parsed by parseCommand.
+type scpCommand struct {
+	sink, recursive, preserve, dirOnly bool
+
+	path string
+}
+
+// parseCommand parses the command line an scp client sends to start the
+// remote side of a transfer.
+func parseCommand(line string) (*scpCommand, error) {
+	args, err := shellquote.Split(line)
+	if err != nil {
+		return nil, fmt.Errorf("invalid command %q: %v", line, err)
+	}
+
+	if len(args) == 0 || path.Base(args[0]) != "scp" {
+		return nil, fmt.Errorf("invalid command %q; expected scp", line)
+	}
+	args = args[1:]
+
+	var c scpCommand
+	var source bool
+
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		arg := args[0]
+		args = args[1:]
+
+		if arg == "--" {
+			break
+		}
+
+		for _, r := range arg[1:] {
+			switch r {
+			case 't':
+				c.sink = true
+			case 'f':
+				source = true
+			case 'r':
+				c.recursive = true
+			case 'p':
+				c.preserve = true
+			case 'd':
+				c.dirOnly = true
+			case 'q', 'v':
+			default:
+				return nil, fmt.Errorf("unsupported option -%c", r)
+			}
+		}
+	}
+
+	if c.sink == source {
+		return nil, fmt.Errorf("invalid command %q; expected exactly one of -t and -f", line)
+	}
+
+	if len(args) != 1 {
+		return nil, fmt.Errorf("invalid command %q; expected a single path", line)
+	}
+	c.path = args[0]
+
+	return &c, nil
+}
+
+// clean returns the command's path cleaned up as an absolute, slash-separated
+// path, with no ".." in it.
+func (c *scpCommand) clean() string {
+	return path.Clean("/" + c.path)
+}
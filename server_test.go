@@ -0,0 +1,536 @@
+package scp
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"fknsrs.biz/p/scp/protocol"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected *scpCommand
+	}{
+		{line: "scp -t /upload", expected: &scpCommand{sink: true, path: "/upload"}},
+		{line: "scp -rf dir", expected: &scpCommand{recursive: true, path: "dir"}},
+		{line: "/usr/bin/scp -p -t -- -x", expected: &scpCommand{sink: true, preserve: true, path: "-x"}},
+		{line: "scp -d -t /upload", expected: &scpCommand{sink: true, dirOnly: true, path: "/upload"}},
+		{line: "scp -qvf 'a b'", expected: &scpCommand{path: "a b"}},
+		{line: `scp -prt a\ b`, expected: &scpCommand{sink: true, recursive: true, preserve: true, path: "a b"}},
+		{line: "ls -t /upload"},
+		{line: "scp -t"},
+		{line: "scp -t a b"},
+		{line: "scp -tf a"},
+		{line: "scp a"},
+		{line: "scp -z -t a"},
+		{line: "scp -t 'a"},
+		{line: ""},
+	}
+
+	for _, tt := range tests {
+		c, err := parseCommand(tt.line)
+
+		if tt.expected == nil {
+			if err == nil {
+				t.Errorf("parseCommand(%q) gave %+v; expected an error", tt.line, c)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("parseCommand(%q) gave error %v", tt.line, err)
+		} else if *c != *tt.expected {
+			t.Errorf("parseCommand(%q) gave %+v; expected %+v", tt.line, c, tt.expected)
+		}
+	}
+}
+
+// serveClient returns a client for a server that hands every command to
+// ServeCommand with root and opts.
+func serveClient(t testing.TB, root string, opts ...Option) *ssh.Client {
+	return newFakeClient(t, func(cmd string, ch ssh.Channel) int {
+		if _, err := ServeCommand(ch, cmd, root, opts...); err != nil {
+			return 1
+		}
+
+		return 0
+	})
+}
+
+func TestServeCommandRoot(t *testing.T) {
+	root := t.TempDir()
+	c := serveClient(t, root)
+
+	// However hard the client tries, it can't get out of root.
+	if _, err := Write(c, "/../../escaped", NewFile("f", 5, 0644, strings.NewReader("hello"))); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(root, "escaped"))
+	if err != nil || string(b) != "hello" {
+		t.Fatalf("file written to /../../escaped has %q, %v; expected it inside root", b, err)
+	}
+
+	f, err := Read(c, "../escaped")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, f); got != "hello" {
+		t.Fatalf("Read gave %q", got)
+	}
+}
+
+func TestServeCommandRefuses(t *testing.T) {
+	c := serveClient(t, t.TempDir())
+
+	_, err := Write(c, "/", NewFile("f", 1, 0644, strings.NewReader("x")), WithExtraArgs("-z"))
+
+	var pe *ProtocolError
+	if !errors.As(err, &pe) || !strings.Contains(pe.Message, "unsupported option -z") {
+		t.Fatalf("Write with an unsupported flag gave %v; expected it to be refused", err)
+	}
+
+	_, err = Write(c, "/missing", NewFile("f", 1, 0644, strings.NewReader("x")), WithArgvHook(func(argv []string) []string {
+		return append(argv[:len(argv)-2], "-d", "-t", "/missing")
+	}))
+	if !errors.As(err, &pe) || !strings.Contains(pe.Message, "not a directory") {
+		t.Fatalf("Write with -d to a missing directory gave %v; expected it to be refused", err)
+	}
+}
+
+func TestServeCommandPreserve(t *testing.T) {
+	root := t.TempDir()
+	c := serveClient(t, root)
+
+	f := NewFile("f", 1, 0600, strings.NewReader("x"))
+	f.SetTimes(time.Unix(1500000000, 0), time.Unix(1400000000, 0))
+
+	if _, err := Write(c, "/", f, WithPreserve()); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(root, "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(time.Unix(1500000000, 0)) || info.Mode() != 0600 {
+		t.Fatalf("file written with WithPreserve has %v and %v", info.ModTime(), info.Mode())
+	}
+
+	// A Source only knows modification times, so that's what it sends for
+	// both.
+	g, err := Read(c, "/f", WithPreserve())
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, g)
+
+	if !g.ModTime().Equal(time.Unix(1500000000, 0)) || !g.AccessTime().Equal(g.ModTime()) || g.Mode() != 0600 {
+		t.Fatalf("file read back with WithPreserve has %v, %v and %v", g.ModTime(), g.AccessTime(), g.Mode())
+	}
+}
+
+func TestSinkFunc(t *testing.T) {
+	var mu sync.Mutex
+	got := map[string]string{}
+
+	c := newFakeClient(t, func(cmd string, ch ssh.Channel) int {
+		s, err := NewSinkFunc(func(f *File) error {
+			b, err := ioutil.ReadAll(f)
+			if err != nil {
+				return err
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			got[f.Path()] = string(b)
+
+			return nil
+		}, WithDirectories())
+		if err != nil {
+			return 1
+		}
+
+		if _, err := s.Serve(ch); err != nil {
+			return 1
+		}
+
+		return 0
+	})
+
+	root := t.TempDir()
+	writeLocal(t, root, "a", "aaa")
+	if err := os.Mkdir(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeLocal(t, filepath.Join(root, "sub"), "b", "bb")
+
+	if _, err := WriteDir(c, "/", root); err != nil {
+		t.Fatal(err)
+	}
+
+	base := filepath.Base(root)
+	expected := map[string]string{base: "", base + "/a": "aaa", base + "/sub": "", base + "/sub/b": "bb"}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(got) != len(expected) {
+		t.Fatalf("sink function was given %q; expected %q", got, expected)
+	}
+	for p, content := range expected {
+		if c, ok := got[p]; !ok || c != content {
+			t.Errorf("sink function was given %q for %s; expected %q", c, p, content)
+		}
+	}
+}
+
+func TestSinkConcurrent(t *testing.T) {
+	var mu sync.Mutex
+	var calls int
+
+	// A progress callback that panics on a 4 byte file, and otherwise
+	// counts the calls it gets from every session at once.
+	s, err := NewSinkFunc(func(f *File) error {
+		_, err := ioutil.ReadAll(f)
+		return err
+	}, WithProgress(func(transferred, total int64) {
+		if total == 4 {
+			panic("boom")
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		calls++
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newFakeClient(t, func(cmd string, ch ssh.Channel) int {
+		if _, err := s.Serve(ch); err != nil {
+			return 1
+		}
+
+		return 0
+	})
+
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			_, errs[i] = Write(c, "/", NewFile("f", 5, 0644, strings.NewReader("hello")))
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("write %d gave %v", i, err)
+		}
+	}
+
+	mu.Lock()
+	if calls < len(errs) {
+		t.Errorf("progress was called %d times for %d files", calls, len(errs))
+	}
+	mu.Unlock()
+
+	// The panic ends the one session it happened in, and not the next.
+	if _, err := Write(c, "/", NewFile("f", 4, 0644, strings.NewReader("boom"))); err == nil {
+		t.Fatal("write with a panicking callback succeeded")
+	}
+	if _, err := Write(c, "/", NewFile("f", 5, 0644, strings.NewReader("hello"))); err != nil {
+		t.Fatalf("write after a panicking callback gave %v", err)
+	}
+}
+
+func TestSourceConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	// More than a chunk, so that progress is reported while it's being sent.
+	want := strings.Repeat("x", 3*defaultChunkSize)
+	writeLocal(t, dir, "f", want)
+
+	var mu sync.Mutex
+	var calls int
+	var fail bool
+
+	s, err := NewSource(filepath.Join(dir, "f"), WithProgress(func(transferred, total int64) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if fail {
+			panic("boom")
+		}
+
+		calls++
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newFakeClient(t, func(cmd string, ch ssh.Channel) int {
+		if _, err := s.Serve(ch); err != nil {
+			return 1
+		}
+
+		return 0
+	})
+
+	read := func() (string, error) {
+		f, err := Read(c, "/f")
+		if err != nil {
+			return "", err
+		}
+
+		b, err := ioutil.ReadAll(f)
+
+		return string(b), err
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			var content string
+			if content, errs[i] = read(); errs[i] == nil && content != want {
+				errs[i] = errors.New("read " + strconv.Itoa(len(content)) + " bytes")
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("read %d gave %v", i, err)
+		}
+	}
+
+	mu.Lock()
+	if calls < len(errs) {
+		t.Errorf("progress was called %d times for %d files", calls, len(errs))
+	}
+	fail = true
+	mu.Unlock()
+
+	// The panic ends the one session it happened in, and not the next.
+	if _, err := read(); err == nil {
+		t.Fatal("read with a panicking callback succeeded")
+	}
+
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+
+	if _, err := read(); err != nil {
+		t.Fatalf("read after a panicking callback gave %v", err)
+	}
+}
+
+func TestWithFileHook(t *testing.T) {
+	dir := t.TempDir()
+	moved := filepath.Join(t.TempDir(), "moved")
+
+	s, err := NewSink(dir, WithFileHook(func(f *File, target string) (string, error) {
+		switch {
+		case f.Size() > 10:
+			return "", errors.New(f.Path() + ": too large")
+		case f.Name() == "move":
+			return moved, nil
+		}
+
+		return target, nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Serve(server)
+		server.Close()
+		done <- err
+	}()
+
+	// Play an scp client that carries on past a refused file, as OpenSSH's
+	// does.
+	e, d := protocol.NewEncoder(client), protocol.NewDecoder(client)
+	expect := func(severity byte) {
+		t.Helper()
+
+		st, err := d.ReadStatus()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st == nil && severity != protocol.OK || st != nil && st.Severity != severity {
+			t.Fatalf("got status %+v; expected %02x", st, severity)
+		}
+	}
+
+	expect(protocol.OK)
+	e.WriteRecord(protocol.Record{Kind: 'D', Mode: 0755, Name: "tree"})
+	expect(protocol.OK)
+	e.WriteRecord(protocol.Record{Kind: 'C', Mode: 0644, Size: 100, Name: "big"})
+	expect(protocol.Warning)
+	for _, name := range []string{"small", "move"} {
+		e.WriteRecord(protocol.Record{Kind: 'C', Mode: 0644, Size: 3, Name: name})
+		expect(protocol.OK)
+		e.Write([]byte("abc"))
+		e.WriteOK()
+		expect(protocol.OK)
+	}
+	e.WriteRecord(protocol.Record{Kind: 'E'})
+	expect(protocol.OK)
+	client.Close()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readTree(t, dir); !sameTree(got, map[string]string{"tree/": "", "tree/small": "abc"}) {
+		t.Fatalf("sink created %q", got)
+	}
+	if b, err := ioutil.ReadFile(moved); err != nil || string(b) != "abc" {
+		t.Fatalf("redirected file has %q, %v", b, err)
+	}
+}
+
+func TestServeCommandWith(t *testing.T) {
+	fsys := fstest.MapFS{
+		"pub/a.txt":     {Data: []byte("aaa"), Mode: 0644},
+		"pub/sub/b.txt": {Data: []byte("bb"), Mode: 0644},
+	}
+
+	var mu sync.Mutex
+	uploaded := map[string]string{}
+
+	serve := func(uploads bool) *ssh.Client {
+		newSink := func(dir string, opts ...Option) (*Sink, error) {
+			return NewSinkFunc(func(f *File) error {
+				b, err := ioutil.ReadAll(f)
+				if err != nil {
+					return err
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+
+				uploaded[path.Join(dir, f.Path())] = string(b)
+
+				return nil
+			}, opts...)
+		}
+		if !uploads {
+			newSink = nil
+		}
+
+		return newFakeClient(t, func(cmd string, ch ssh.Channel) int {
+			if _, err := ServeCommandWith(ch, cmd, newSink, func(name string, opts ...Option) (*Source, error) {
+				return NewSourceFS(fsys, name, opts...)
+			}); err != nil {
+				return 1
+			}
+
+			return 0
+		})
+	}
+
+	c := serve(true)
+
+	f, err := Read(c, "/pub/../pub/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, f); got != "aaa" {
+		t.Fatalf("Read gave %q", got)
+	}
+
+	got := map[string]string{}
+	if _, err := ReadDir(c, "pub", func(f *File) error {
+		got[f.Path()] = readAll(t, f)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !sameTree(got, map[string]string{"pub/a.txt": "aaa", "pub/sub/b.txt": "bb"}) {
+		t.Fatalf("ReadDir gave %q", got)
+	}
+
+	if _, err := Write(c, "/up", NewFile("f", 5, 0644, strings.NewReader("hello"))); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	if !sameTree(uploaded, map[string]string{"up/f": "hello"}) {
+		t.Errorf("sink function was given %q", uploaded)
+	}
+	mu.Unlock()
+
+	// Without a sink, uploads are refused but downloads still work.
+	c = serve(false)
+
+	_, err = Write(c, "/up", NewFile("f", 5, 0644, strings.NewReader("hello")))
+
+	var pe *ProtocolError
+	if !errors.As(err, &pe) || !strings.Contains(pe.Message, "uploads not supported") {
+		t.Fatalf("Write without a sink gave %v; expected it to be refused", err)
+	}
+
+	if _, err := Read(c, "pub/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewSourceFS(fsys, "/pub"); err == nil {
+		t.Error("NewSourceFS accepted an absolute name")
+	}
+}
+
+func TestServeCommandWithoutRecursion(t *testing.T) {
+	root := t.TempDir()
+	c := serveClient(t, root)
+
+	_, err := WriteDir(c, "/", makeTree(t), WithArgvHook(func(argv []string) []string {
+		for i, a := range argv {
+			if a == "-rt" {
+				argv[i] = "-t"
+			}
+		}
+
+		return argv
+	}))
+
+	var pe *ProtocolError
+	if !errors.As(err, &pe) || !strings.Contains(pe.Message, "without -r") {
+		t.Fatalf("WriteDir to a sink without -r gave %v; expected it to be refused", err)
+	}
+
+	if got := readTree(t, root); len(got) != 0 {
+		t.Fatalf("sink created %q", got)
+	}
+}
@@ -0,0 +1,533 @@
+package scp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Sink implements the receiving end of the protocol, the part played by
+// `scp -t`, so that an SSH server can accept uploads from standard scp clients
+// without running a real scp. It writes the files it receives to the local
+// filesystem, or hands them to a function (see NewSinkFunc).
+type Sink struct {
+	dir string
+	fn  func(f *File) error
+	o   *options
+
+	// noDirs is set by ServeCommand for a client that didn't ask for -r,
+	// which isn't expected to send any directories.
+	noDirs bool
+}
+
+// NewSink returns a Sink that receives files into dir. As with `scp -t`, if
+// dir is an existing directory, files and directories are created inside it;
+// otherwise a single file (or directory, for a recursive upload) is created at
+// dir itself. With WithPreserve the times and exact modes sent by the client
+// are applied to what's created; without it, times are ignored and modes are
+// subject to the umask. WithEvents, WithTrace and the like work as they do for
+// the other transfers.
+func NewSink(dir string, opts ...Option) (*Sink, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Sink{dir: dir, o: o}, nil
+}
+
+// NewSinkFunc returns a Sink that hands each file it receives to fn rather
+// than writing it anywhere, for servers that keep files somewhere other than
+// the local filesystem. As with ReadDir, the File has its Path set relative to
+// the top of the upload, its content streams straight off the channel and is
+// only valid until fn returns, and with WithDirectories fn is called for each
+// directory too. If fn returns an error, it's reported to the client and the
+// exchange ends.
+func NewSinkFunc(fn func(f *File) error, opts ...Option) (*Sink, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Sink{fn: fn, o: o}, nil
+}
+
+// Serve runs the exchange with a client over rw, which is usually an
+// ssh.Channel on which the client has asked to run `scp -t`. It returns once
+// the client has finished sending and closed its side, along with any warnings
+// the client sent, for files it couldn't read and the like.
+//
+// A failure on this side, such as a file that can't be created or a full disk,
+// is reported to the client with an error status before Serve returns it. The
+// caller is responsible for sending the exit status and closing the channel
+// afterwards.
+//
+// The names of files and directories are checked as Read does, so a client
+// can't use them to write outside dir.
+//
+// Serve can be called for several clients at once, and each call is a transfer
+// of its own, with its own events and progress.
+func (s *Sink) Serve(rw io.ReadWriter) ([]string, error) {
+	o := s.o.transfer()
+
+	k := &sink{
+		o:      o,
+		rw:     o.readWriter(rw, rw),
+		fn:     s.fn,
+		noDirs: s.noDirs,
+	}
+
+	if s.fn == nil {
+		info, err := os.Stat(s.dir)
+
+		k.dir = s.dir
+		k.isDir = err == nil && info.IsDir()
+	}
+
+	err := k.serve()
+
+	return k.warnings, err
+}
+
+// sinkDir is a directory a sink has descended into.
+type sinkDir struct {
+	name, path string
+	mode       os.FileMode
+
+	// created is true if the directory didn't exist before, in which case
+	// its mode is set once everything in it has been received.
+	created bool
+
+	mtime, atime time.Time
+}
+
+// sink holds the state of an exchange run by Sink.Serve.
+type sink struct {
+	o  *options
+	rw *bufio.ReadWriter
+
+	// fn is given the files received, if there is one, and otherwise they
+	// go into dir.
+	fn    func(f *File) error
+	dir   string
+	isDir bool
+
+	noDirs bool
+
+	stack []sinkDir
+
+	// Times from a T record apply to the C or D record that follows it.
+	mtime, atime time.Time
+
+	buf []byte
+
+	warnings []string
+}
+
+func (k *sink) serve() error {
+	// The client waits for this before it sends anything.
+	if err := k.o.sendOK(k.rw.Writer); err != nil {
+		return err
+	}
+
+	for {
+		// A callback that panicked ends the transfer, even if the sink's
+		// function carried on past the error reading a file's content.
+		if k.o.callbackErr != nil {
+			return k.fail(k.o.callbackErr)
+		}
+
+		b, err := k.rw.ReadByte()
+		if err == io.EOF {
+			if len(k.stack) != 0 {
+				return fmt.Errorf("client went away inside %s", k.stack[len(k.stack)-1].name)
+			}
+
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := k.rw.UnreadByte(); err != nil {
+			return err
+		}
+
+		switch b {
+		case SeverityWarning, SeverityError:
+			pe, err := k.o.readResponse(k.rw.Reader)
+			if err != nil {
+				return err
+			}
+
+			if pe.Severity == SeverityError {
+				return pe
+			}
+
+			k.warn(k.name(""), pe.Message)
+
+			continue
+		}
+
+		l, err := k.o.readRecord(k.rw.Reader)
+		if err != nil {
+			return err
+		}
+
+		switch b {
+		case 'T':
+			if k.mtime, k.atime, err = parseTime(l); err != nil {
+				return k.fail(err)
+			}
+		case 'D':
+			err = k.enter(l)
+		case 'E':
+			err = k.leave()
+		case 'C':
+			err = k.file(l)
+		default:
+			err = k.fail(fmt.Errorf("invalid record type; expected C, D, E or T but got %02x", b))
+		}
+		if err != nil {
+			return err
+		}
+
+		if b != 'C' {
+			if err := k.o.sendOK(k.rw.Writer); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (k *sink) warn(name, msg string) {
+	k.warnings = append(k.warnings, msg)
+
+	k.o.emit(Event{Type: EventWarning, Name: name, Message: msg})
+}
+
+// fail reports err to the client and returns it.
+func (k *sink) fail(err error) error {
+	if serr := k.o.sendError(k.rw.Writer, SeverityError, "scp: "+err.Error()); serr != nil {
+		return serr
+	}
+
+	return err
+}
+
+// target returns the local path for something called name in the directory
+// currently being received into. A sink with a function has no local paths,
+// so it just gets the name.
+func (k *sink) target(name string) (string, error) {
+	if k.fn != nil {
+		return name, nil
+	}
+
+	if len(k.stack) == 0 && !k.isDir {
+		return k.dir, nil
+	}
+
+	local, err := k.o.localName(name)
+	if err != nil {
+		return "", err
+	}
+
+	if len(k.stack) != 0 {
+		return filepath.Join(k.stack[len(k.stack)-1].path, local), nil
+	}
+
+	return filepath.Join(k.dir, local), nil
+}
+
+// name returns the slash-separated path of name relative to the root of the
+// transfer, for events.
+func (k *sink) name(name string) string {
+	elems := make([]string, 0, len(k.stack)+1)
+	for _, d := range k.stack {
+		elems = append(elems, d.name)
+	}
+
+	return path.Join(append(elems, name)...)
+}
+
+// enter handles the D record l, creating the directory if need be.
+func (k *sink) enter(l []byte) error {
+	mode, _, name, err := parseRecord('D', l)
+	if err != nil {
+		return k.fail(err)
+	}
+
+	if k.noDirs {
+		return k.fail(fmt.Errorf("received directory without -r"))
+	}
+
+	if len(k.stack) >= k.o.depthLimit() {
+		return k.fail(fmt.Errorf("%w: %s is more than %d levels down", ErrTooDeep, k.name(name), k.o.depthLimit()))
+	}
+
+	target, err := k.target(name)
+	if err != nil {
+		return k.fail(err)
+	}
+
+	d := sinkDir{name: name, path: target, mode: mode, mtime: k.mtime, atime: k.atime}
+	k.mtime, k.atime = time.Time{}, time.Time{}
+
+	if k.fn != nil {
+		k.stack = append(k.stack, d)
+
+		if !k.o.directories {
+			return nil
+		}
+
+		f := NewFile(name, 0, mode|os.ModeDir, strings.NewReader(""))
+		f.dir = true
+		f.path = k.name("")
+		f.mtime = d.mtime
+		f.atime = d.atime
+		f.transferID = k.o.transferID
+
+		if err := k.fn(f); err != nil {
+			return k.fail(err)
+		}
+
+		return nil
+	}
+
+	// The directory has to be writable for anything to be created in it,
+	// whatever mode it's meant to end up with.
+	if err := os.Mkdir(d.path, mode|0700); err == nil {
+		d.created = true
+	} else if info, serr := os.Stat(d.path); serr != nil || !info.IsDir() {
+		return k.fail(err)
+	}
+
+	k.stack = append(k.stack, d)
+
+	return nil
+}
+
+// leave handles an E record, finishing off the directory being left.
+func (k *sink) leave() error {
+	if len(k.stack) == 0 {
+		return k.fail(fmt.Errorf("unexpected E record at top level"))
+	}
+
+	d := k.stack[len(k.stack)-1]
+	k.stack = k.stack[:len(k.stack)-1]
+
+	if k.fn != nil {
+		return nil
+	}
+
+	if d.created || k.o.preserve {
+		if err := os.Chmod(d.path, d.mode); err != nil {
+			return k.fail(err)
+		}
+	}
+
+	if k.o.preserve && !d.mtime.IsZero() {
+		if err := os.Chtimes(d.path, d.atime, d.mtime); err != nil {
+			return k.fail(err)
+		}
+	}
+
+	return nil
+}
+
+// file handles the C record l, receiving the content that follows it into a
+// local file.
+func (k *sink) file(l []byte) (err error) {
+	mode, size, name, err := parseCopy(l)
+	if err != nil {
+		return k.fail(err)
+	}
+
+	mtime, atime := k.mtime, k.atime
+	k.mtime, k.atime = time.Time{}, time.Time{}
+
+	p, err := k.target(name)
+	if err != nil {
+		return k.fail(err)
+	}
+	n := k.name(name)
+
+	f := NewFile(name, size, mode, nil)
+	f.path = n
+	f.mtime = mtime
+	f.atime = atime
+	f.transferID = k.o.transferID
+
+	if k.o.fileHook != nil {
+		var target string
+		var herr error
+		if err := k.o.safely("file hook", func() { target, herr = k.o.fileHook(f, p) }); err != nil {
+			return k.fail(err)
+		}
+
+		// Refusing a file with a warning lets the client go on to the
+		// next one, as OpenSSH's scp does for a file it can't create.
+		if herr != nil {
+			return k.o.sendError(k.rw.Writer, SeverityWarning, "scp: "+herr.Error())
+		}
+
+		if target != "" {
+			p = target
+		}
+	}
+
+	k.o.emit(Event{Type: EventStart, Name: n, Total: size})
+	defer func() {
+		k.o.emit(Event{Type: EventDone, Name: n, Total: size, Err: err})
+	}()
+
+	if k.fn != nil {
+		return k.deliver(f)
+	}
+
+	fd, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return k.fail(err)
+	}
+	defer fd.Close()
+
+	if err := k.o.sendOK(k.rw.Writer); err != nil {
+		return err
+	}
+
+	// Once the content has started, it has to be read in full whatever
+	// happens to the local file, or the rest of it would be taken for the
+	// next record. A failure to write is held back until the end.
+	sw := &sinkWriter{w: fd}
+	var received int64
+	pw := &progressWriter{w: sw, fn: func(t int64) error {
+		k.o.emit(Event{Type: EventProgress, Name: n, Transferred: t, Total: size})
+		if k.o.callbackErr != nil {
+			return k.o.callbackErr
+		}
+
+		err := k.o.throttle(int(t - received))
+		received = t
+
+		return err
+	}}
+	if k.buf == nil {
+		k.buf = make([]byte, k.o.chunkSize())
+	}
+
+	if t, err := copyN(pw, k.rw, size, k.buf); err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("content of %s ended after %d of %d bytes", n, t, size)
+		}
+
+		return err
+	}
+
+	// The content is followed by a status byte saying whether the client
+	// managed to read all of it.
+	pe, err := k.o.readResponse(k.rw.Reader)
+	if err != nil {
+		return err
+	}
+	if pe != nil {
+		if pe.Severity == SeverityError {
+			return pe
+		}
+
+		k.warn(n, pe.Message)
+	}
+
+	if sw.err != nil {
+		return k.fail(sw.err)
+	}
+
+	if k.o.preserve {
+		if err := fd.Chmod(mode); err != nil {
+			return k.fail(err)
+		}
+	}
+
+	if err := fd.Close(); err != nil {
+		return k.fail(err)
+	}
+
+	if k.o.preserve && !mtime.IsZero() {
+		if err := os.Chtimes(p, atime, mtime); err != nil {
+			return k.fail(err)
+		}
+	}
+
+	return k.o.sendOK(k.rw.Writer)
+}
+
+// deliver acknowledges the C record for f and hands it to the sink's function,
+// with its content coming off the channel.
+func (k *sink) deliver(f *File) error {
+	if err := k.o.sendOK(k.rw.Writer); err != nil {
+		return err
+	}
+
+	lr := &io.LimitedReader{R: k.rw, N: f.Size()}
+
+	var received int64
+	f.Reader = &progressReader{r: lr, fn: func(t int64) error {
+		k.o.emit(Event{Type: EventProgress, Name: f.Path(), Transferred: t, Total: f.Size()})
+		if k.o.callbackErr != nil {
+			return k.o.callbackErr
+		}
+
+		err := k.o.throttle(int(t - received))
+		received = t
+
+		return err
+	}}
+
+	ferr := k.fn(f)
+
+	// Whatever fn left unread has to be got out of the way before the status
+	// byte that follows it.
+	if _, err := io.Copy(ioutil.Discard, lr); err != nil {
+		return err
+	}
+	if lr.N > 0 {
+		return fmt.Errorf("content of %s ended after %d of %d bytes", f.Path(), f.Size()-lr.N, f.Size())
+	}
+
+	pe, err := k.o.readResponse(k.rw.Reader)
+	if err != nil {
+		return err
+	}
+	if pe != nil {
+		if pe.Severity == SeverityError {
+			return pe
+		}
+
+		k.warn(f.Path(), pe.Message)
+	}
+
+	if ferr != nil {
+		return k.fail(ferr)
+	}
+
+	return k.o.sendOK(k.rw.Writer)
+}
+
+// sinkWriter records the first error returned by w, and discards everything
+// written after it.
+type sinkWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (w *sinkWriter) Write(p []byte) (int, error) {
+	if w.err == nil {
+		_, w.err = w.w.Write(p)
+	}
+
+	return len(p), nil
+}
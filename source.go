@@ -0,0 +1,127 @@
+package scp
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+)
+
+// Source implements the sending end of the protocol, the part played by
+// `scp -f`, so that an SSH server can satisfy downloads by standard scp clients
+// without running a real scp. It sends files from the local filesystem or an
+// fs.FS, using the same code that Write and WriteDir use to send them to a
+// remote scp.
+type Source struct {
+	path string
+	fsys fs.FS
+	o    *options
+}
+
+// NewSource returns a Source that sends the local file or directory at path.
+// With WithPreserve, the modification times of what's sent are included, as
+// they are for a client that asked for them with -p. WithEvents, WithTrace and
+// the like work as they do for the other transfers.
+func NewSource(path string, opts ...Option) (*Source, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Source{path: path, o: o}, nil
+}
+
+// NewSourceFS returns a Source that sends the file or directory called name in
+// fsys, which is named as fs.FS names things: slash-separated and without a
+// leading slash. Symbolic links are dealt with as for NewSource, although
+// SymlinksAsFiles only works if fsys has a ReadLink method, as os.DirFS does.
+// Since the client is sent the base name of what's being sent, a directory can
+// only be sent to it with ServeDir if name isn't ".".
+func NewSourceFS(fsys fs.FS, name string, opts ...Option) (*Source, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Source{path: name, fsys: fsys, o: o}, nil
+}
+
+// Serve sends the file to a client over rw, which is usually an ssh.Channel on
+// which the client has asked to run `scp -f`. It returns once the client has
+// acknowledged the file, along with any warnings the client sent about it. If
+// the path is a directory, the client is told so and an error is returned, as
+// a directory can only be sent to a client that asked for -r; see ServeDir.
+//
+// A failure on this side, such as a file that can't be opened, is reported to
+// the client with an error status before Serve returns it. The caller is
+// responsible for sending the exit status and closing the channel afterwards.
+//
+// Serve and ServeDir can be called for several clients at once, and each call
+// is a transfer of its own, with its own events and progress.
+func (s *Source) Serve(rw io.ReadWriter) ([]string, error) {
+	return s.serve(rw, false)
+}
+
+// ServeDir is like Serve, but for a client that asked for `scp -rf`: if the
+// path is a directory, the whole tree beneath it is sent, with D and E
+// records marking out its structure as WriteDir does. A path that isn't a
+// directory is sent as a single file.
+func (s *Source) ServeDir(rw io.ReadWriter) ([]string, error) {
+	return s.serve(rw, true)
+}
+
+func (s *Source) serve(rw io.ReadWriter, recursive bool) (warnings []string, err error) {
+	o := s.o.transfer()
+
+	o.emit(Event{Type: EventStart, Name: s.path})
+	defer func() {
+		o.emit(Event{Type: EventDone, Name: s.path, Err: err})
+	}()
+
+	k := &sender{o: o, rw: o.readWriter(rw, rw), fsys: s.fsys}
+
+	// The client starts things off with a zero byte once it's ready.
+	if err := k.ack(false, s.path); err != nil {
+		return k.warnings, err
+	}
+
+	// As with WriteDir, the base name of the path is what the client gets,
+	// so something like "." has to be resolved first. That's not possible
+	// in an fs.FS, whose names are already as clean as they can be.
+	path := s.path
+	if s.fsys == nil {
+		path, err = filepath.Abs(path)
+	}
+	if err == nil {
+		err = s.send(k, path, recursive)
+	}
+	if err == nil {
+		err = k.settle()
+	}
+
+	// An error from the client has already been seen by it, but one from
+	// this side has to be passed on, or it's left waiting for a record that
+	// will never come.
+	if _, ok := err.(*ProtocolError); err != nil && !ok {
+		k.o.sendError(k.rw.Writer, SeverityError, "scp: "+err.Error())
+	}
+
+	return k.warnings, err
+}
+
+func (s *Source) send(k *sender, path string, recursive bool) error {
+	info, err := k.stat(path)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() && !recursive {
+		return fmt.Errorf("%s: not a regular file", s.path)
+	}
+
+	return k.tree(path)
+}
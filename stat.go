@@ -0,0 +1,241 @@
+package scp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kballard/go-shellquote"
+	"golang.org/x/crypto/ssh"
+)
+
+// remoteModTime runs stat on the remote host to find the modification time of
+// file. GNU stat is tried first, falling back to the BSD flavour.
+func remoteModTime(c *ssh.Client, file string) (time.Time, error) {
+	s, err := c.NewSession()
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer s.Close()
+
+	cmd := shellquote.Join("stat", "-c", "%Y", file) + " 2>/dev/null || " + shellquote.Join("stat", "-f", "%m", file)
+
+	out, err := s.Output(cmd)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return parseStatModTime(out)
+}
+
+// remoteSize runs wc on the remote host to find the size of file in bytes.
+func remoteSize(c *ssh.Client, file string) (int64, error) {
+	s, err := c.NewSession()
+	if err != nil {
+		return 0, err
+	}
+	defer s.Close()
+
+	out, err := s.Output("wc -c < " + shellquote.Join(file))
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(string(bytes.TrimSpace(out)), 10, 64)
+}
+
+// parseStatModTime understands the output of `stat -c %Y` and `stat -f %m`
+// (seconds since the epoch), as well as the "Modify:" line of the default GNU
+// stat output and of BSD `stat -x`.
+func parseStatModTime(out []byte) (time.Time, error) {
+	out = bytes.TrimSpace(out)
+
+	if n, err := strconv.ParseInt(string(out), 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+
+	for _, l := range strings.Split(string(out), "\n") {
+		l = strings.TrimSpace(l)
+		if !strings.HasPrefix(l, "Modify:") {
+			continue
+		}
+
+		v := strings.TrimSpace(strings.TrimPrefix(l, "Modify:"))
+
+		if t, err := time.Parse("2006-01-02 15:04:05.999999999 -0700", v); err == nil {
+			return t, nil
+		}
+		if t, err := time.ParseInLocation("Mon Jan _2 15:04:05 2006", v, time.Local); err == nil {
+			return t, nil
+		}
+
+		return time.Time{}, fmt.Errorf("unrecognised modification time %q in stat output", v)
+	}
+
+	return time.Time{}, fmt.Errorf("couldn't find modification time in stat output %q", string(out))
+}
+
+// CheckWritable confirms that dir exists on the remote host and that a file
+// can be created in it, by creating and then removing an empty marker file.
+// If it can't, the returned error wraps ErrNotWritable. As with Write, an empty
+// dir is the remote user's home directory.
+func CheckWritable(c *ssh.Client, dir string) error {
+	s, err := c.NewSession()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	// The command runs in the home directory, which is where `scp -t ""`
+	// writes to.
+	if dir == "" {
+		dir = "."
+	}
+
+	marker := path.Join(dir, ".scp-writable-"+newTransferID())
+
+	out, err := s.CombinedOutput(": > " + shellquote.Join(marker) + " && rm -f " + shellquote.Join(marker))
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("%w: %s: %s", ErrNotWritable, dir, msg)
+		}
+
+		return fmt.Errorf("%w: %s: %v", ErrNotWritable, dir, err)
+	}
+
+	return nil
+}
+
+// verifyPlacement checks that a file called name written with `scp -t dir`
+// ended up where it was expected to: inside dir if that's a directory, or at
+// dir itself otherwise.
+func verifyPlacement(c *ssh.Client, dir, name string) error {
+	s, err := c.NewSession()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	d := shellquote.Join(dir)
+	p := shellquote.Join(strings.TrimSuffix(dir, "/") + "/" + name)
+
+	if err := s.Run("if [ -d " + d + " ]; then [ -f " + p + " ]; else [ -f " + d + " ]; fi"); err != nil {
+		if _, ok := err.(*ssh.ExitError); ok {
+			return fmt.Errorf("%w: %s not found in or at %s", ErrNotPlaced, name, dir)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// verifyChecksum runs command, a template as given to WithChecksum, on the
+// file called name written with `scp -t dir`, and checks that the digest it
+// prints matches sum. As with verifyPlacement, the file is inside dir if
+// that's a directory, or is dir itself otherwise.
+func verifyChecksum(c *ssh.Client, dir, name, command string, sum []byte) error {
+	s, err := c.NewSession()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	d := shellquote.Join(dir)
+	p := shellquote.Join(strings.TrimSuffix(dir, "/") + "/" + name)
+
+	// The path is passed as a positional parameter so that the template
+	// doesn't need to know which of the two it is.
+	cmd := "if [ -d " + d + " ]; then set -- " + p + "; else set -- " + d + "; fi; " + strings.ReplaceAll(command, "%s", `"$1"`)
+
+	out, err := s.Output(cmd)
+	if err != nil {
+		return fmt.Errorf("computing checksum of %s: %w", name, err)
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return fmt.Errorf("computing checksum of %s: no output from %q", name, command)
+	}
+
+	// GNU coreutils puts a backslash in front of the digest when it has
+	// had to escape the file name.
+	remote, err := hex.DecodeString(strings.TrimPrefix(fields[0], "\\"))
+	if err != nil {
+		return fmt.Errorf("computing checksum of %s: unexpected output %q", name, fields[0])
+	}
+
+	if !bytes.Equal(remote, sum) {
+		return fmt.Errorf("%w: sent %x, remote %s has %x", ErrChecksumMismatch, sum, name, remote)
+	}
+
+	return nil
+}
+
+// Stat fetches the name, size and mode of the remote file without
+// transferring its content, by starting a read and abandoning it as soon as
+// the header has arrived. With WithPreserve, the modification and access
+// times are filled in too, and with WithStatModTime the modification time is
+// looked up separately if the header didn't include it. The File it returns
+// has no content; its Reader is nil.
+//
+// Closing the session before acknowledging the header leaves the remote scp
+// with nowhere to send the content, so it exits rather than waiting.
+func Stat(c *ssh.Client, file string, opts ...Option) (*File, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := c.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	stdout, err := s.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stdin, err := s.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	flags := "-qf"
+	if o.preserve {
+		flags = "-pqf"
+	}
+
+	cmd, err := o.command(o.sourceProgram(), flags, file)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.Start(cmd); err != nil {
+		return nil, err
+	}
+
+	f, err := readHeader(o, o.readWriter(stdout, stdin))
+	if err != nil {
+		return nil, err
+	}
+
+	if o.statModTime && f.mtime.IsZero() {
+		// The remote scp is done with once the header has arrived.
+		s.Close()
+
+		if f.mtime, err = remoteModTime(c, file); err != nil {
+			return nil, err
+		}
+	}
+
+	f.transferID = o.transferID
+
+	return f, nil
+}
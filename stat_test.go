@@ -0,0 +1,217 @@
+package scp
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseStatModTime(t *testing.T) {
+	tests := []struct {
+		out      string
+		expected time.Time
+	}{
+		// stat -c %Y and stat -f %m.
+		{out: "1700000000\n", expected: time.Unix(1700000000, 0)},
+		{out: "  1700000000  ", expected: time.Unix(1700000000, 0)},
+		// The default output of GNU stat.
+		{
+			out: "  File: f\n  Size: 5         \tBlocks: 8          IO Block: 4096   regular file\n" +
+				"Access: 2023-11-14 22:13:20.000000000 +0000\n" +
+				"Modify: 2023-11-14 22:13:20.123456789 +0100\n" +
+				"Change: 2023-11-14 22:13:20.123456789 +0100\n",
+			expected: time.Date(2023, 11, 14, 21, 13, 20, 123456789, time.UTC),
+		},
+		// BSD stat -x.
+		{
+			out: "  File: \"f\"\n  Size: 5            FileType: Regular File\n" +
+				"Access: Tue Nov 14 22:13:20 2023\n" +
+				"Modify: Tue Nov  7 22:13:20 2023\n",
+			expected: time.Date(2023, 11, 7, 22, 13, 20, 0, time.Local),
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := parseStatModTime([]byte(tt.out))
+		if err != nil {
+			t.Errorf("parseStatModTime(%q) gave error %v", tt.out, err)
+		} else if !got.Equal(tt.expected) {
+			t.Errorf("parseStatModTime(%q) is %v; expected %v", tt.out, got, tt.expected)
+		}
+	}
+
+	for _, out := range []string{"", "stat: cannot stat 'f': No such file or directory\n", "Modify: yesterday\n", "17000x\n"} {
+		if _, err := parseStatModTime([]byte(out)); err == nil {
+			t.Errorf("parseStatModTime(%q) succeeded", out)
+		}
+	}
+}
+
+func TestWithStatModTime(t *testing.T) {
+	c := newTestClient(t)
+	p := writeLocal(t, t.TempDir(), "f", "hello")
+
+	mtime := time.Unix(1500000000, 0)
+	if err := os.Chtimes(p, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := Read(c, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, f)
+
+	if !f.ModTime().IsZero() {
+		t.Fatalf("Read gave a modification time of %v without asking for one", f.ModTime())
+	}
+
+	f, err = Read(c, p, WithStatModTime())
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, f)
+
+	if !f.ModTime().Equal(mtime) {
+		t.Fatalf("Read with WithStatModTime gave a modification time of %v; expected %v", f.ModTime(), mtime)
+	}
+}
+
+func TestStat(t *testing.T) {
+	c := newTestClient(t)
+	p := writeLocal(t, t.TempDir(), "f", "hello")
+
+	mtime := time.Unix(1500000000, 0)
+	if err := os.Chtimes(p, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := Stat(c, p, WithPreserve())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f.Name() != "f" || f.Size() != 5 || f.Mode() != 0644 || !f.ModTime().Equal(mtime) {
+		t.Errorf("Stat gave %q, %d, %v, %v", f.Name(), f.Size(), f.Mode(), f.ModTime())
+	}
+	if f.Reader != nil {
+		t.Error("Stat gave a File with content")
+	}
+
+	for _, opts := range [][]Option{nil, {WithStatModTime()}} {
+		f, err := Stat(c, p, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if opts == nil && !f.ModTime().IsZero() {
+			t.Errorf("Stat without asking for times gave modification time %v", f.ModTime())
+		} else if opts != nil && !f.ModTime().Equal(mtime) {
+			t.Errorf("Stat with WithStatModTime gave modification time %v; expected %v", f.ModTime(), mtime)
+		}
+	}
+
+	if _, err := Stat(c, p+".missing"); err == nil {
+		t.Error("Stat of a missing file succeeded")
+	}
+}
+
+func TestCheckWritable(t *testing.T) {
+	c := newTestClient(t)
+	dir := t.TempDir()
+
+	if err := CheckWritable(c, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("CheckWritable left %v behind", entries)
+	}
+
+	missing := filepath.Join(dir, "missing")
+
+	if err := CheckWritable(c, missing); !errors.Is(err, ErrNotWritable) {
+		t.Fatalf("CheckWritable of a missing directory gave %v; expected ErrNotWritable", err)
+	}
+
+	_, err := Write(c, missing, NewFile("f", 1, 0644, strings.NewReader("x")), WithWritableCheck())
+	if !errors.Is(err, ErrNotWritable) {
+		t.Fatalf("Write with WithWritableCheck to a missing directory gave %v; expected ErrNotWritable", err)
+	}
+}
+
+func TestCheckWritableHome(t *testing.T) {
+	cmds := make(chan string, 1)
+	c := newFakeClient(t, func(cmd string, ch ssh.Channel) int {
+		cmds <- cmd
+		return 0
+	})
+
+	if err := CheckWritable(c, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// The marker goes in the home directory, not the root.
+	if cmd := <-cmds; !strings.HasPrefix(cmd, ": > .scp-writable-") {
+		t.Fatalf("CheckWritable of the home directory ran %q", cmd)
+	}
+}
+
+func TestWithVerifyPlacement(t *testing.T) {
+	c := newTestClient(t)
+	dir := t.TempDir()
+
+	if _, err := Write(c, dir, NewFile("f", 1, 0644, strings.NewReader("x")), WithVerifyPlacement()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Write(c, filepath.Join(dir, "g"), NewFile("f", 1, 0644, strings.NewReader("x")), WithVerifyPlacement()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A sink that throws the file away.
+	c = newFakeClient(t, withCommand(fakeSink("\x00", "\x00", 0), "", 1))
+
+	_, err := Write(c, dir, NewFile("lost", 1, 0644, strings.NewReader("x")), WithVerifyPlacement())
+	if !errors.Is(err, ErrNotPlaced) {
+		t.Fatalf("Write of a file that went missing gave %v; expected ErrNotPlaced", err)
+	}
+}
+
+func TestWithChecksum(t *testing.T) {
+	c := newTestClient(t)
+	dir := t.TempDir()
+
+	if _, err := Write(c, dir, NewFile("f", 5, 0644, strings.NewReader("hello")), WithChecksum(sha256.New, "sha256sum %s")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Write(c, filepath.Join(dir, "g"), NewFile("f", 5, 0644, strings.NewReader("hello")), WithChecksum(sha256.New, "sha256sum %s")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A host that ends up with different content, and a transfer that only
+	// finishes once the session it ran in is closed.
+	done := make(chan struct{})
+	sink := fakeSink("\x00", "\x00", 0)
+	c = newFakeClient(t, withCommand(func(cmd string, ch ssh.Channel) int {
+		defer close(done)
+		return sink(cmd, ch)
+	}, strings.Repeat("00", sha256.Size)+"  f\n", 0))
+
+	_, err := Write(c, dir, NewFile("f", 5, 0644, strings.NewReader("hello")), WithChecksum(sha256.New, "sha256sum %s"))
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("Write to a host with a different digest gave %v; expected ErrChecksumMismatch", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session left open after a checksum mismatch")
+	}
+}
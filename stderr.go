@@ -0,0 +1,84 @@
+package scp
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"fknsrs.biz/p/scp/protocol"
+	"golang.org/x/crypto/ssh"
+)
+
+// stderrLimit is how much of the remote scp's stderr is kept. Anything useful
+// it has to say is at the start.
+const stderrLimit = 4096
+
+// stderrBuffer keeps the start of what the remote scp writes to its stderr,
+// so that it can be added to errors. It's written to by the session's own
+// copying goroutine, which never blocks on it.
+type stderrBuffer struct {
+	mu sync.Mutex
+	b  []byte
+}
+
+// newStderrBuffer attaches a stderrBuffer to s, which must not have been
+// started yet. It's set as s.Stderr rather than read from StderrPipe, so
+// attaching it can't fail, and nothing the remote side does with its stderr,
+// including writing far more than stderrLimit, holds up a transfer.
+func newStderrBuffer(s *ssh.Session) *stderrBuffer {
+	b := &stderrBuffer{}
+	s.Stderr = b
+
+	return b
+}
+
+func (b *stderrBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if room := stderrLimit - len(b.b); room > 0 {
+		b.b = append(b.b, p[:min(int64(room), int64(len(p)))]...)
+	}
+
+	return len(p), nil
+}
+
+// String returns what's been kept so far on a single line, sanitised in the
+// same way as protocol messages.
+func (b *stderrBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var lines []string
+	for _, l := range strings.Split(string(b.b), "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			lines = append(lines, l)
+		}
+	}
+
+	return protocol.Sanitize(strings.Join(lines, "; "))
+}
+
+// annotate adds what the remote scp has written to stderr to err, if it has
+// written anything. If err is io.EOF, the remote scp has most likely exited
+// before it could say anything on stdout, so annotate waits for it first: to
+// be sure of having all of its stderr, and because its exit status says more
+// than the EOF does.
+func (b *stderrBuffer) annotate(s *ssh.Session, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if err == io.EOF {
+		if werr := wait(s); werr != nil {
+			err = werr
+		}
+	}
+
+	if msg := b.String(); msg != "" {
+		return fmt.Errorf("%w (remote stderr: %s)", err, msg)
+	}
+
+	return err
+}
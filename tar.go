@@ -0,0 +1,57 @@
+package scp
+
+import (
+	"archive/tar"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ReadTar reads the remote file or directory tree at dir, as ReadDir does, and
+// writes it to w as a tar archive. Each entry is named by its Path, so the
+// archive unpacks into a directory with the same name as dir. Directories,
+// including empty ones, get entries of their own. Every entry has the mode the
+// remote side reported, and with WithPreserve its modification and access
+// times too; without it, they're all given the time the transfer started.
+//
+// The archive is only finished once the whole tree has been read, so w is left
+// holding a complete one only if ReadTar succeeds. Warnings are returned as for
+// ReadDir.
+func ReadTar(c *ssh.Client, dir string, w io.Writer, opts ...Option) ([]string, error) {
+	tw := tar.NewWriter(w)
+	now := time.Now()
+
+	warnings, err := ReadDir(c, dir, func(f *File) error {
+		h := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     f.Path(),
+			Size:     f.Size(),
+			Mode:     int64(f.Mode().Perm()),
+			ModTime:  f.ModTime(),
+		}
+		if f.IsDir() {
+			h.Typeflag = tar.TypeDir
+			h.Name += "/"
+			h.Size = 0
+		}
+		if h.ModTime.IsZero() {
+			h.ModTime = now
+		} else {
+			h.AccessTime = f.AccessTime()
+		}
+
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+
+		_, err := io.Copy(tw, f)
+
+		return err
+	}, append(append([]Option(nil), opts...), WithDirectories())...)
+	if err != nil {
+		return warnings, err
+	}
+
+	return warnings, tw.Close()
+}
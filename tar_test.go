@@ -0,0 +1,79 @@
+package scp
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadTar(t *testing.T) {
+	c := newTestClient(t)
+	root := makeTree(t)
+
+	mtime := time.Unix(1500000000, 0)
+	if err := os.Chmod(filepath.Join(root, "a.txt"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(root, "sub", "b.txt"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := ReadTar(c, root, &buf, WithPreserve()); err != nil {
+		t.Fatal(err)
+	}
+
+	type entry struct {
+		typ     byte
+		mode    int64
+		content string
+	}
+
+	got := map[string]entry{}
+	var b *tar.Header
+
+	tr := tar.NewReader(&buf)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got[h.Name] = entry{h.Typeflag, h.Mode, string(content)}
+		if h.Name == "tree/sub/b.txt" {
+			b = h
+		}
+	}
+
+	expected := map[string]entry{
+		"tree/":          {tar.TypeDir, 0755, ""},
+		"tree/a.txt":     {tar.TypeReg, 0600, "aaa"},
+		"tree/empty/":    {tar.TypeDir, 0755, ""},
+		"tree/sub/":      {tar.TypeDir, 0755, ""},
+		"tree/sub/b.txt": {tar.TypeReg, 0644, "bb"},
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("ReadTar wrote %v; expected %v", got, expected)
+	}
+	for name, e := range expected {
+		if got[name] != e {
+			t.Errorf("ReadTar wrote %v for %s; expected %v", got[name], name, e)
+		}
+	}
+
+	if b == nil || !b.ModTime.Equal(mtime) {
+		t.Fatalf("ReadTar with WithPreserve wrote %+v; expected modification time %v", b, mtime)
+	}
+}
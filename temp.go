@@ -0,0 +1,60 @@
+package scp
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// tempFile creates a temporary file in dir (or the default directory for
+// temporary files, if dir is empty), and returns it along with a function
+// that closes and removes it. The function is safe to call more than once.
+func tempFile(dir, prefix string) (*os.File, func() error, error) {
+	t, err := ioutil.TempFile(dir, prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var once sync.Once
+	var cerr error
+	cleanup := func() error {
+		once.Do(func() {
+			t.Close()
+			cerr = os.Remove(t.Name())
+		})
+
+		return cerr
+	}
+
+	return t, cleanup, nil
+}
+
+// spool reads the content of f into a temporary file in dir, and returns a
+// File with the same details whose Reader is that file, positioned at the
+// start. The temporary file is removed when the returned File is closed.
+func spool(f *File, dir string) (*File, error) {
+	t, cleanup, err := tempFile(dir, "scp-read-")
+	if err != nil {
+		f.abort()
+		return nil, err
+	}
+
+	if _, err := io.Copy(t, f); err != nil {
+		f.abort()
+		cleanup()
+		return nil, err
+	}
+
+	if _, err := t.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	g := *f
+	g.Reader = t
+	g.abort = func() { cleanup() }
+	g.close = cleanup
+
+	return &g, nil
+}
@@ -0,0 +1,93 @@
+package scp
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+
+	"fknsrs.biz/p/scp/protocol"
+)
+
+// The framing itself is left to the protocol package's Encoder and Decoder,
+// which share the buffers of the bufio types they're given; the functions
+// here just trace what goes through them.
+
+// sendRecord sends a single protocol record.
+func (o *options) sendRecord(w *bufio.Writer, r protocol.Record) error {
+	o.traceRecord(">", r.String())
+
+	return protocol.NewEncoder(w).WriteRecord(r)
+}
+
+// sendOK sends a zero status byte, which acknowledges whatever the remote
+// side sent last, or marks the end of the content of a file.
+func (o *options) sendOK(w *bufio.Writer) error {
+	o.traceStatus(">", nil)
+
+	return protocol.NewEncoder(w).WriteOK()
+}
+
+// sendError sends a status byte of the given severity followed by msg, which
+// is how either side reports a problem to the other. The message is sanitized
+// so that it can't end early or carry control characters.
+func (o *options) sendError(w *bufio.Writer, severity byte, msg string) error {
+	o.traceStatus(">", &ProtocolError{Severity: severity, Message: protocol.Sanitize(msg)})
+
+	return protocol.NewEncoder(w).WriteStatus(severity, msg)
+}
+
+// readRecord reads a single record from the remote side, including its
+// trailing newline.
+func (o *options) readRecord(r *bufio.Reader) ([]byte, error) {
+	l, err := protocol.NewDecoder(r).ReadLine()
+	if len(l) > 0 {
+		o.traceRecord("<", string(l))
+	}
+
+	return l, err
+}
+
+// readResponse is readResponse, traced.
+func (o *options) readResponse(r *bufio.Reader) (*ProtocolError, error) {
+	pe, err := readResponse(r)
+	if err == nil {
+		o.traceStatus("<", pe)
+	}
+
+	return pe, err
+}
+
+// traceRecord writes a record sent (">") or received ("<") to the writer
+// given to WithTrace.
+func (o *options) traceRecord(dir, record string) {
+	if o.trace == nil {
+		return
+	}
+
+	fmt.Fprintf(o.trace, "%s %s\n", dir, protocol.Sanitize(strings.TrimSuffix(record, "\n")))
+}
+
+// traceCommand writes the command line that starts the remote scp to the
+// writer given to WithTrace.
+func (o *options) traceCommand(cmd string) {
+	if o.trace == nil {
+		return
+	}
+
+	fmt.Fprintf(o.trace, "> exec %s\n", protocol.Sanitize(cmd))
+}
+
+// traceStatus writes a status byte sent (">") or received ("<"), along with
+// its message if there is one, to the writer given to WithTrace.
+func (o *options) traceStatus(dir string, pe *ProtocolError) {
+	if o.trace == nil {
+		return
+	}
+
+	if pe == nil {
+		fmt.Fprintf(o.trace, "%s \\x00\n", dir)
+		return
+	}
+
+	fmt.Fprintf(o.trace, "%s \\x%02x %s\n", dir, pe.Severity, pe.Message)
+}
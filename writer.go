@@ -0,0 +1,202 @@
+package scp
+
+import (
+	"errors"
+	"hash"
+	"io"
+
+	"fknsrs.biz/p/scp/protocol"
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrWriterClosed is returned by Writer.WriteFile once the Writer has been
+// closed.
+var ErrWriterClosed = errors.New("writer closed")
+
+// Writer writes a series of files to the same remote directory over a single
+// session, which saves starting a new session and remote scp for each one.
+// The remote side handles the files one at a time, so a Writer must not be
+// used from more than one goroutine at once.
+type Writer struct {
+	c   *ssh.Client
+	dir string
+	o   *options
+	k   *sender
+
+	// err is the error that ended the session, if any. Nothing more can be
+	// written once there's been one.
+	err error
+}
+
+// NewWriter starts a remote scp to receive files into dir, as Write does, and
+// returns a Writer for sending them. The options apply to every file written;
+// WithWritableCheck runs the check once, before the session is started. The
+// Writer must be closed once all the files have been written.
+func NewWriter(c *ssh.Client, dir string, opts ...Option) (*Writer, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return newWriter(c, dir, o)
+}
+
+func newWriter(c *ssh.Client, dir string, o *options) (*Writer, error) {
+	if o.checkWritable {
+		if err := CheckWritable(c, dir); err != nil {
+			return nil, err
+		}
+	}
+
+	flags := "-t"
+	if o.preserve {
+		flags = "-pt"
+	}
+
+	k, err := startSender(c, o, flags, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Writer{c: c, dir: dir, o: o, k: k}, nil
+}
+
+// WriteFile sends file, returning any warnings the remote side sent about it
+// and maybe an error, with the same meaning as for Write. Once an error has
+// been returned the session has been shut down, and every later call returns
+// the same error, unless nothing of the file was sent, as for one whose name
+// can't be, or writing with WithContinueOnError and the remote side refused
+// the file before its content was sent. In that case the session carries on,
+// and with WithContinueOnError the failure is recorded for Close to report.
+func (w *Writer) WriteFile(file *File) (warnings []string, err error) {
+	w.o.emit(Event{Type: EventStart, Name: file.Name(), Total: file.Size()})
+	defer func() {
+		w.o.emit(Event{Type: EventDone, Name: file.Name(), Total: file.Size(), Err: err})
+	}()
+	if w.o.callbackErr != nil {
+		return nil, w.o.callbackErr
+	}
+
+	return w.write(file)
+}
+
+// write does the work of WriteFile, without the events that mark the start
+// and end of a transfer, so that Write can send its own.
+func (w *Writer) write(file *File) ([]string, error) {
+	if w.err != nil {
+		return nil, w.err
+	}
+
+	name := file.Name()
+	if w.o.gzip {
+		name += ".gz"
+	}
+
+	warnings, err := w.send(file)
+	if err != nil && w.err == nil {
+		// The session is still good for the next file.
+		w.k.skip(name, err)
+	}
+
+	return warnings, err
+}
+
+// send sends file, shutting the session down if it fails in a way that
+// leaves the remote side out of step.
+func (w *Writer) send(file *File) ([]string, error) {
+	if w.o.gzip {
+		gz, err := NewGzipFile(file.Name()+".gz", file.Mode(), file)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+
+		file = gz
+	}
+
+	// A name that can't be sent is caught before anything is, which leaves
+	// the session good for the next file.
+	if err := protocol.CheckName(file.Name()); err != nil {
+		return nil, err
+	}
+
+	if w.k.listed(file.Name(), file.Size()) {
+		return nil, nil
+	}
+
+	// The digest is taken over exactly what's sent, so after any
+	// compression.
+	var h hash.Hash
+	if w.o.checksumHash != nil {
+		h = w.o.checksumHash()
+
+		tee := *file
+		tee.Reader = io.TeeReader(file, h)
+		file = &tee
+	}
+
+	n := len(w.k.warnings)
+
+	if err := w.k.file(file); err != nil {
+		if !w.o.continueOnError || !refused(err) {
+			w.k.abandon()
+			w.err = err
+		}
+
+		return w.k.warnings[n:], err
+	}
+
+	// The remote scp has closed the file by the time it acknowledges the
+	// content, so it can be looked for straight away.
+	if w.o.verifyPlacement || h != nil {
+		if err := w.k.settle(); err != nil {
+			w.k.abandon()
+			w.err = err
+
+			return w.k.warnings[n:], err
+		}
+	}
+	if w.o.verifyPlacement {
+		if err := verifyPlacement(w.c, w.dir, file.Name()); err != nil {
+			return w.k.warnings[n:], err
+		}
+	}
+
+	var sum []byte
+	if h != nil {
+		sum = h.Sum(nil)
+		if err := verifyChecksum(w.c, w.dir, file.Name(), w.o.checksumCommand, sum); err != nil {
+			return w.k.warnings[n:], err
+		}
+	}
+
+	w.k.done(file.Name(), file, sum)
+
+	return w.k.warnings[n:], nil
+}
+
+// Warnings returns every warning the remote side has sent so far. With
+// WithPipelining, that includes any about the last file, which only arrive
+// once Close has been called.
+func (w *Writer) Warnings() []string {
+	return w.k.warnings
+}
+
+// Close tells the remote scp that there are no more files and shuts the
+// session down, waiting for the remote scp to exit unless WithTeardown says
+// otherwise. If writing a file has already failed, the session is gone and
+// Close does nothing. When writing with WithContinueOnError, Close returns a
+// *BatchError if any of the files written couldn't be sent.
+func (w *Writer) Close() error {
+	if w.err != nil {
+		return nil
+	}
+
+	w.err = ErrWriterClosed
+
+	if err := w.k.close(); err != nil {
+		return err
+	}
+
+	return w.k.batchErr()
+}